@@ -1,14 +1,13 @@
 package main
 
 import (
+	"btrzaws"
 	"fmt"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
 )
 
-func checkELBs(sess *session.Session) {
-	svc := elb.New(sess)
+func checkELBs(svc btrzaws.ELBAPI) {
 	allTags := []*elb.TagDescription{}
 	resp, err := svc.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{})
 	if err != nil {
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"betterconfig"
 	"betterweb"
 	"btrzaws"
 	"fmt"
 	"logging"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var ()
 
 func main() {
+	config, err := betterconfig.Load(betterconfig.GetConfigurationFileName())
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("%v while loading the configuration", err))
+		os.Exit(1)
+	}
 	sess, err := btrzaws.GetAWSSession()
 	if err != nil {
 		logging.RecordLogLine(fmt.Sprintf("%v while creating a session", err))
 		os.Exit(1)
 	}
-	server, err := betterweb.CreateHealthCheckServer()
+	server, err := betterweb.CreateHealthCheckServer(config)
 	if err != nil {
 		fmt.Println(err, "\r\nExiting service")
 		os.Exit(1)
@@ -24,6 +32,13 @@ func main() {
 
 	logging.RecordLogLine("monitor starting - version " + server.ServerVersion)
 	server.SetSession(sess)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			server.ReloadConfiguration()
+		}
+	}()
 	logging.RecordLogLine("monitor started.\r\n")
 	server.Start()
 }
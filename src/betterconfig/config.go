@@ -0,0 +1,393 @@
+package betterconfig
+
+import (
+	"btrzaws"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultConfigurationFile - used when MONITOR_CONFIG is not set
+	DefaultConfigurationFile = "secrets/monitor.json"
+	// DefaultListeningPort - web server port
+	DefaultListeningPort = 3000
+	// DefaultUsersDatabase - sqlite users database
+	DefaultUsersDatabase = "secrets/users.sqlite"
+	// DefaultSSHKnownHostsFile - host keys of the instances, by instance id
+	DefaultSSHKnownHostsFile = "secrets/known_hosts"
+)
+
+// the checker defaults, the values the monitor always used
+const (
+	DefaultRestartThreshold          = 3
+	DefaultReportingThreshold        = 3
+	DefaultSoftRestartDuration       = 45 * time.Second
+	DefaultHardRestartDuration       = 7 * time.Minute
+	DefaultNotificationResetDuration = time.Hour
+	DefaultRestartJobDeadline        = DefaultHardRestartDuration
+	DefaultASGReplacementDeadline    = 10 * time.Minute
+	DefaultScanInterval              = 9 * time.Second
+	DefaultScanCycleDeadline         = 8 * time.Second
+	DefaultMaxConcurrentChecks       = 10
+	DefaultLatencyWarnThreshold      = 2 * time.Second
+	DefaultLatencyCriticalThreshold  = 4 * time.Second
+	DefaultActionBudgetWindow        = time.Hour
+)
+
+// Duration - time.Duration read from strings like "45s" or "7m"
+type Duration time.Duration
+
+// UnmarshalJSON - parse a duration string
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations should be strings like \"45s\": %s", string(data))
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON - write the duration as a string
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// NotificationsConfiguration - where failure notifications are sent
+type NotificationsConfiguration struct {
+	PhoneNumber      string `json:"phone_number"`
+	FirebaseAuthCode string `json:"firebase_authcode"`
+}
+
+// DiagnosticsConfiguration - the diagnostics bundle collected before restarting a service
+type DiagnosticsConfiguration struct {
+	Enabled      bool   `json:"enabled"`
+	JournalLines int    `json:"journal_lines"`
+	Directory    string `json:"directory"`
+	BundlesKept  int    `json:"bundles_kept"`
+}
+
+// GuardrailsConfiguration - limits of the remediation actions, 0 disables a limit
+type GuardrailsConfiguration struct {
+	MaxConcurrent              int      `json:"max_concurrent"`
+	MaxConcurrentPerRepository int      `json:"max_concurrent_per_repository"`
+	MinHealthyInstances        int      `json:"min_healthy_instances"`
+	ActionBudget               int      `json:"action_budget"`
+	ActionBudgetWindow         Duration `json:"action_budget_window"`
+}
+
+// CorrelationConfiguration - when dependents failing together raise a single correlated incident
+type CorrelationConfiguration struct {
+	MinFailing int     `json:"min_failing_instances"`
+	MinRatio   float64 `json:"min_failing_ratio"`
+}
+
+// CheckerConfiguration - instances checker thresholds and timing
+type CheckerConfiguration struct {
+	RestartThreshold          int                         `json:"restart_threshold"`
+	ReportingThreshold        int                         `json:"reporting_threshold"`
+	SoftRestartDuration       Duration                    `json:"soft_restart_duration"`
+	HardRestartDuration       Duration                    `json:"hard_restart_duration"`
+	NotificationResetDuration Duration                    `json:"notification_reset_duration"`
+	RestartJobDeadline        Duration                    `json:"restart_job_deadline"`
+	ScanInterval              Duration                    `json:"scan_interval"`
+	ScanCycleDeadline         Duration                    `json:"scan_cycle_deadline"`
+	MaxConcurrentChecks       int                         `json:"max_concurrent_checks"`
+	LatencyWarnThreshold      Duration                    `json:"latency_warn_threshold"`
+	LatencyCriticalThreshold  Duration                    `json:"latency_critical_threshold"`
+	HealthcheckRoutesFile     string                      `json:"healthcheck_routes_file,omitempty"`
+	HealthcheckRoutes         []*btrzaws.HealthcheckRoute `json:"healthcheck_routes,omitempty"`
+	Diagnostics               DiagnosticsConfiguration    `json:"diagnostics"`
+	Guardrails                GuardrailsConfiguration     `json:"guardrails"`
+	Correlation               CorrelationConfiguration    `json:"correlation"`
+	// DryRun, DryRunRepositories - record the actions instead of taking them, for all the services or the listed ones
+	DryRun             bool     `json:"dry_run"`
+	DryRunRepositories []string `json:"dry_run_repositories,omitempty"`
+	// MarkASGUnhealthy - let auto scaling groups replace their failing members instead of terminating them
+	MarkASGUnhealthy       bool     `json:"mark_asg_unhealthy"`
+	ASGReplacementDeadline Duration `json:"asg_replacement_deadline"`
+}
+
+// RemediationStepConfiguration - a remediation policy step
+type RemediationStepConfiguration struct {
+	Action    string   `json:"action"`
+	Command   string   `json:"command,omitempty"`
+	Threshold int      `json:"threshold"`
+	Attempts  int      `json:"attempts,omitempty"`
+	Cooldown  Duration `json:"cooldown,omitempty"`
+}
+
+// RemediationPolicyConfiguration - remediation steps of the instances of the repositories or with the tag values
+type RemediationPolicyConfiguration struct {
+	Name         string                          `json:"name"`
+	Repositories []string                        `json:"repositories,omitempty"`
+	Tags         map[string][]string             `json:"tags,omitempty"`
+	Steps        []*RemediationStepConfiguration `json:"steps"`
+}
+
+// Configuration - the monitor daemon configuration
+type Configuration struct {
+	Environment     string                     `json:"environment"`
+	ListeningPort   int                        `json:"listening_port"`
+	UsersDatabase   string                     `json:"users_database"`
+	SSHKeysLocation string                     `json:"ssh_keys_location"`
+	LogEntriesToken string                     `json:"le_token"`
+	Notifications   NotificationsConfiguration `json:"notifications"`
+	Checker         CheckerConfiguration       `json:"checker"`
+	// SSHKnownHostsFile - known_hosts file of the instances host keys, SSH_KNOWN_HOSTS overrides it
+	SSHKnownHostsFile string `json:"ssh_known_hosts_file"`
+	// SSHTrustOnFirstUse - record the key of instances without a known key instead of refusing them
+	SSHTrustOnFirstUse bool `json:"ssh_trust_on_first_use"`
+	// SSHBastions - jump hosts to the private instances, selected by SSH-Bastion tag or vpc
+	SSHBastions []*btrzaws.SSHBastion `json:"ssh_bastions,omitempty"`
+	// SSHUseAgent, SSHForwardAgent - authenticate with the ssh agent keys, and forward the agent to the instances
+	SSHUseAgent     bool `json:"ssh_use_agent"`
+	SSHForwardAgent bool `json:"ssh_forward_agent"`
+	// Regions - aws regions to monitor, AWS_REGIONS overrides it with a comma separated list
+	Regions []string `json:"regions"`
+	// Accounts - accounts to monitor through assumed roles, the monitor own account when empty
+	Accounts []*btrzaws.AccountProfile `json:"accounts,omitempty"`
+	// Discovery - selector groups, an instance matching any of them is monitored
+	Discovery []*btrzaws.DiscoverySelector `json:"discovery"`
+	// Dependencies - the services every repository depends on, instances can add theirs with a Depends-On tag
+	Dependencies map[string][]string `json:"service_dependencies,omitempty"`
+	// RemediationPolicies - remediation ladders replacing the default escalation of the instances they apply to
+	RemediationPolicies []*RemediationPolicyConfiguration `json:"remediation_policies,omitempty"`
+	// FileName - the file the configuration was loaded from
+	FileName string `json:"-"`
+}
+
+// Default - configuration with the values the monitor always used
+func Default() *Configuration {
+	return &Configuration{
+		Environment:       "production",
+		ListeningPort:     DefaultListeningPort,
+		Regions:           []string{btrzaws.DefaultRegion},
+		UsersDatabase:     DefaultUsersDatabase,
+		SSHKnownHostsFile: DefaultSSHKnownHostsFile,
+		Checker: CheckerConfiguration{
+			RestartThreshold:          DefaultRestartThreshold,
+			ReportingThreshold:        DefaultReportingThreshold,
+			SoftRestartDuration:       Duration(DefaultSoftRestartDuration),
+			HardRestartDuration:       Duration(DefaultHardRestartDuration),
+			NotificationResetDuration: Duration(DefaultNotificationResetDuration),
+			RestartJobDeadline:        Duration(DefaultRestartJobDeadline),
+			ASGReplacementDeadline:    Duration(DefaultASGReplacementDeadline),
+			ScanInterval:              Duration(DefaultScanInterval),
+			ScanCycleDeadline:         Duration(DefaultScanCycleDeadline),
+			MaxConcurrentChecks:       DefaultMaxConcurrentChecks,
+			LatencyWarnThreshold:      Duration(DefaultLatencyWarnThreshold),
+			LatencyCriticalThreshold:  Duration(DefaultLatencyCriticalThreshold),
+			Correlation: CorrelationConfiguration{
+				MinFailing: btrzaws.DefaultCorrelationMinFailing,
+				MinRatio:   btrzaws.DefaultCorrelationMinRatio,
+			},
+			Guardrails: GuardrailsConfiguration{
+				ActionBudgetWindow: Duration(DefaultActionBudgetWindow),
+			},
+			Diagnostics: DiagnosticsConfiguration{
+				JournalLines: btrzaws.DefaultDiagnosticsJournalLines,
+				Directory:    btrzaws.DefaultDiagnosticsDirectory,
+				BundlesKept:  btrzaws.DefaultDiagnosticsBundlesKept,
+			},
+		},
+	}
+}
+
+// GetConfigurationFileName - MONITOR_CONFIG or the default file
+func GetConfigurationFileName() string {
+	if fileName := os.Getenv("MONITOR_CONFIG"); fileName != "" {
+		return fileName
+	}
+	return DefaultConfigurationFile
+}
+
+// Load - read the file over the defaults, apply environment overrides and validate.
+// a missing file is allowed only for the default file name
+func Load(fileName string) (*Configuration, error) {
+	config := Default()
+	config.FileName = fileName
+	fileData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) || fileName != DefaultConfigurationFile {
+			return nil, err
+		}
+	} else if err = json.Unmarshal(fileData, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if err = config.applyEnvironment(); err != nil {
+		return nil, err
+	}
+	if config.Checker.HealthcheckRoutesFile != "" && len(config.Checker.HealthcheckRoutes) == 0 {
+		config.Checker.HealthcheckRoutes, err = btrzaws.LoadHealthcheckRoutes(config.Checker.HealthcheckRoutesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Checker.HealthcheckRoutes) == 0 {
+		config.Checker.HealthcheckRoutes = btrzaws.DefaultHealthcheckRoutes()
+	}
+	if len(config.Discovery) == 0 {
+		config.Discovery = btrzaws.DefaultDiscoverySelectors()
+	}
+	if len(config.Accounts) == 0 {
+		config.Accounts = btrzaws.DefaultAccountProfiles()
+	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return config, nil
+}
+
+// applyEnvironment - environment variables override the file values
+func (config *Configuration) applyEnvironment() error {
+	overrides := map[string]*string{
+		"env":                     &config.Environment,
+		"PHONE_NUMBER":            &config.Notifications.PhoneNumber,
+		"FIREBASE_AUTHCODE":       &config.Notifications.FirebaseAuthCode,
+		"LE_TOKEN":                &config.LogEntriesToken,
+		"SSH_KEYS_LOCATION":       &config.SSHKeysLocation,
+		"SSH_KNOWN_HOSTS":         &config.SSHKnownHostsFile,
+		"USERS_DATABASE":          &config.UsersDatabase,
+		"HEALTHCHECK_ROUTES_FILE": &config.Checker.HealthcheckRoutesFile,
+	}
+	for name, value := range overrides {
+		if environmentValue := os.Getenv(name); environmentValue != "" {
+			*value = environmentValue
+		}
+	}
+	if os.Getenv("HEALTHCHECK_ROUTES_FILE") != "" {
+		config.Checker.HealthcheckRoutes = nil
+	}
+	if regions := os.Getenv("AWS_REGIONS"); regions != "" {
+		config.Regions = []string{}
+		for _, region := range strings.Split(regions, ",") {
+			config.Regions = append(config.Regions, strings.TrimSpace(region))
+		}
+	}
+	if dryRun := os.Getenv("MONITOR_DRY_RUN"); dryRun != "" {
+		enabled, err := strconv.ParseBool(dryRun)
+		if err != nil {
+			return fmt.Errorf("bad MONITOR_DRY_RUN %s", dryRun)
+		}
+		config.Checker.DryRun = enabled
+	}
+	if port := os.Getenv("MONITOR_PORT"); port != "" {
+		listeningPort, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("bad MONITOR_PORT %s", port)
+		}
+		config.ListeningPort = listeningPort
+	}
+	return nil
+}
+
+// Validate - check the configuration values
+func (config *Configuration) Validate() error {
+	if config.Environment == "" {
+		return errors.New("environment is required")
+	}
+	if config.ListeningPort <= 0 || config.ListeningPort > 65535 {
+		return fmt.Errorf("bad listening port %d", config.ListeningPort)
+	}
+	if config.UsersDatabase == "" {
+		return errors.New("users database is required")
+	}
+	if len(config.Regions) == 0 {
+		return errors.New("at least one region is required")
+	}
+	for _, region := range config.Regions {
+		if strings.TrimSpace(region) == "" {
+			return errors.New("empty region name")
+		}
+	}
+	checker := config.Checker
+	if checker.RestartThreshold < 1 || checker.ReportingThreshold < 1 {
+		return errors.New("restart and reporting thresholds should be at least 1")
+	}
+	if checker.MaxConcurrentChecks < 1 {
+		return errors.New("max concurrent checks should be at least 1")
+	}
+	durations := map[string]Duration{
+		"soft_restart_duration":       checker.SoftRestartDuration,
+		"hard_restart_duration":       checker.HardRestartDuration,
+		"notification_reset_duration": checker.NotificationResetDuration,
+		"restart_job_deadline":        checker.RestartJobDeadline,
+		"asg_replacement_deadline":    checker.ASGReplacementDeadline,
+		"scan_interval":               checker.ScanInterval,
+		"scan_cycle_deadline":         checker.ScanCycleDeadline,
+		"latency_warn_threshold":      checker.LatencyWarnThreshold,
+		"latency_critical_threshold":  checker.LatencyCriticalThreshold,
+	}
+	for name, duration := range durations {
+		if duration <= 0 {
+			return fmt.Errorf("%s should be positive", name)
+		}
+	}
+	if checker.ScanCycleDeadline > checker.ScanInterval {
+		return errors.New("scan_cycle_deadline should not be longer than scan_interval")
+	}
+	if checker.LatencyWarnThreshold > checker.LatencyCriticalThreshold {
+		return errors.New("latency_warn_threshold should not be above latency_critical_threshold")
+	}
+	if diagnostics := checker.Diagnostics; diagnostics.Enabled &&
+		(diagnostics.JournalLines < 1 || diagnostics.BundlesKept < 1 || diagnostics.Directory == "") {
+		return errors.New("diagnostics need a directory, and journal_lines and bundles_kept of at least 1")
+	}
+	if guardrails := checker.Guardrails; guardrails.MaxConcurrent < 0 || guardrails.MaxConcurrentPerRepository < 0 ||
+		guardrails.MinHealthyInstances < 0 || guardrails.ActionBudget < 0 || guardrails.ActionBudgetWindow <= 0 {
+		return errors.New("guardrails limits should not be negative, and action_budget_window should be positive")
+	}
+	if correlation := checker.Correlation; correlation.MinFailing < 1 || correlation.MinRatio <= 0 || correlation.MinRatio > 1 {
+		return errors.New("correlation min_failing_instances should be at least 1, and min_failing_ratio between 0 and 1")
+	}
+	if err := btrzaws.ValidateDependencies(config.Dependencies); err != nil {
+		return err
+	}
+	if err := btrzaws.ValidateDiscoverySelectors(config.Discovery); err != nil {
+		return err
+	}
+	if err := btrzaws.ValidateAccountProfiles(config.Accounts); err != nil {
+		return err
+	}
+	if err := btrzaws.ValidateSSHBastions(config.SSHBastions); err != nil {
+		return err
+	}
+	if err := btrzaws.ValidateRemediationPolicies(config.GetRemediationPolicies()); err != nil {
+		return err
+	}
+	return btrzaws.ValidateHealthcheckRoutes(checker.HealthcheckRoutes)
+}
+
+// GetRemediationPolicies - the remediation policies with their durations
+func (config *Configuration) GetRemediationPolicies() []*btrzaws.RemediationPolicy {
+	policies := []*btrzaws.RemediationPolicy{}
+	for _, policyConfiguration := range config.RemediationPolicies {
+		policy := &btrzaws.RemediationPolicy{
+			Name:         policyConfiguration.Name,
+			Repositories: policyConfiguration.Repositories,
+			Tags:         policyConfiguration.Tags,
+			Steps:        []*btrzaws.RemediationStep{},
+		}
+		for _, step := range policyConfiguration.Steps {
+			policy.Steps = append(policy.Steps, &btrzaws.RemediationStep{
+				Action:    step.Action,
+				Command:   step.Command,
+				Threshold: step.Threshold,
+				Attempts:  step.Attempts,
+				Cooldown:  time.Duration(step.Cooldown),
+			})
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
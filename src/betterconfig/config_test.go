@@ -0,0 +1,108 @@
+package betterconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfiguration(t *testing.T, content string) string {
+	directory, err := ioutil.TempDir("", "monitor-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(directory, "monitor.json")
+	if err = ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadSampleConfiguration(t *testing.T) {
+	os.Chdir("../..")
+	defer os.Chdir("src/betterconfig")
+	config, err := Load("samples/monitor.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(config.Checker.HardRestartDuration) != 7*time.Minute {
+		t.Fatalf("bad hard restart duration %v", config.Checker.HardRestartDuration)
+	}
+	if len(config.Checker.HealthcheckRoutes) != 4 {
+		t.Fatalf("expected the sample routes, got %d", len(config.Checker.HealthcheckRoutes))
+	}
+	if len(config.Accounts) != 2 || config.Accounts[1].ExternalID != "btrz-monitor" {
+		t.Fatal("expected the sample accounts")
+	}
+	if len(config.SSHBastions) != 1 || config.SSHBastions[0].VPCs[0] != "vpc-0a1b2c3d" {
+		t.Fatal("expected the sample bastion")
+	}
+	if config.Checker.Guardrails.MaxConcurrentPerRepository != 2 || time.Duration(config.Checker.Guardrails.ActionBudgetWindow) != time.Hour {
+		t.Fatalf("bad guardrails %+v", config.Checker.Guardrails)
+	}
+	if len(config.Dependencies["btrz-api-sales"]) != 2 || config.Checker.Correlation.MinFailing != 3 {
+		t.Fatal("expected the sample dependencies")
+	}
+	policies := config.GetRemediationPolicies()
+	if len(policies) != 1 || len(policies[0].Steps) != 3 || policies[0].Steps[1].Cooldown != 3*time.Minute {
+		t.Fatal("expected the sample remediation policy")
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	fileName := writeConfiguration(t, `{"environment":"staging","notifications":{"phone_number":"+1000"}}`)
+	defer os.RemoveAll(filepath.Dir(fileName))
+	os.Setenv("PHONE_NUMBER", "+2000")
+	defer os.Unsetenv("PHONE_NUMBER")
+	os.Setenv("AWS_REGIONS", "us-east-1, ca-central-1")
+	defer os.Unsetenv("AWS_REGIONS")
+	os.Setenv("MONITOR_DRY_RUN", "true")
+	defer os.Unsetenv("MONITOR_DRY_RUN")
+	config, err := Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Environment != "staging" || config.Notifications.PhoneNumber != "+2000" {
+		t.Fatalf("bad configuration %+v", config)
+	}
+	if !config.Checker.DryRun {
+		t.Fatal("MONITOR_DRY_RUN should turn the dry run on")
+	}
+	if config.Checker.RestartThreshold != 3 || config.ListeningPort != DefaultListeningPort {
+		t.Fatal("missing values should keep the defaults")
+	}
+	if len(config.Regions) != 2 || config.Regions[1] != "ca-central-1" {
+		t.Fatalf("bad regions %v", config.Regions)
+	}
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	invalidConfigurations := []string{
+		`{"checker":{"restart_threshold":0}}`,
+		`{"checker":{"scan_interval":"5s","scan_cycle_deadline":"10s"}}`,
+		`{"checker":{"soft_restart_duration":45}}`,
+		`{"checker":{"healthcheck_routes":[{"path":"/healthcheck"}]}}`,
+		`{"regions":[]}`,
+		`{"checker":{"guardrails":{"max_concurrent":-1}}}`,
+		`{"checker":{"guardrails":{"action_budget":5,"action_budget_window":"0s"}}}`,
+		`{"checker":{"correlation":{"min_failing_instances":3,"min_failing_ratio":1.5}}}`,
+		`{"service_dependencies":{"btrz-api-sales":["btrz-api-sales"]}}`,
+		`{"accounts":[{"name":"staging","role_arn":"monitor"}]}`,
+		`{"ssh_bastions":[{"name":"bastion","address":"10.0.0.1","user":"ubuntu","password":"secret","via":"bastion"}]}`,
+		`{"remediation_policies":[{"name":"workers","steps":[{"action":"explode","threshold":1}]}]}`,
+		`{"remediation_policies":[{"name":"workers","steps":[{"action":"reboot","threshold":1,"cooldown":"-1m"}]}]}`,
+		`{"listening_port":`,
+	}
+	for _, content := range invalidConfigurations {
+		fileName := writeConfiguration(t, content)
+		if _, err := Load(fileName); err == nil {
+			t.Errorf("%s should be rejected", content)
+		}
+		os.RemoveAll(filepath.Dir(fileName))
+	}
+	if _, err := Load("missing-monitor.json"); err == nil {
+		t.Error("an explicit missing file should be rejected")
+	}
+}
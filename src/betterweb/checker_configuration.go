@@ -0,0 +1,193 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"time"
+)
+
+// InstancesCheckerConfiguration - checker settings, zero values are replaced by the defaults
+type InstancesCheckerConfiguration struct {
+	Environment               string
+	NotificationsOptions      []string
+	RestartThreshold          int
+	ReportingThreshold        int
+	SoftRestartDuration       time.Duration
+	HardRestartDuration       time.Duration
+	NotificationResetDuration time.Duration
+	LatencyWarnThreshold      time.Duration
+	LatencyCriticalThreshold  time.Duration
+	// RestartJobDeadline - time a full restart has to become healthy before it's escalated
+	RestartJobDeadline time.Duration
+	// MarkASGUnhealthy - auto scaling group members are marked unhealthy instead of terminated
+	MarkASGUnhealthy bool
+	// ASGReplacementDeadline - time a group has to replace an unhealthy member before an alert
+	ASGReplacementDeadline time.Duration
+	// MaxConcurrentChecks - size of the healthcheck worker pool
+	MaxConcurrentChecks int
+	// ScanCycleDeadline - instances not picked up by then are left for the next cycle
+	ScanCycleDeadline time.Duration
+	// ScanInterval - minimal time between scan cycles
+	ScanInterval time.Duration
+	// HealthcheckRoutes - rules resolving the healthcheck endpoint of each instance
+	HealthcheckRoutes []*btrzaws.HealthcheckRoute
+	// DiscoverySelectors - instances matching any of the selectors are checked
+	DiscoverySelectors []*btrzaws.DiscoverySelector
+	// Regions - the instances of every region are discovered and checked
+	Regions []string
+	// Accounts - the accounts to monitor, each one in its own regions or in Regions
+	Accounts []*btrzaws.AccountProfile
+	// Diagnostics - the bundle collected before restarting a service
+	Diagnostics btrzaws.DiagnosticsSettings
+	// DryRun, DryRunRepositories - the actions on all the instances, or on the instances of the repositories,
+	// are recorded instead of taken
+	DryRun             bool
+	DryRunRepositories []string
+	// Dependencies - the services each repository depends on, besides the instances Depends-On tag
+	Dependencies map[string][]string
+	// Correlation - when dependents failing together raise a single correlated incident
+	Correlation CorrelationSettings
+	// Guardrails - limits of the remediation actions, blocked instances are only notified about
+	Guardrails RemediationGuardrails
+	// RemediationPolicies - remediation ladders, the default escalation is used for the other instances
+	RemediationPolicies []*btrzaws.RemediationPolicy
+}
+
+// NewCheckerConfiguration - checker settings from the daemon configuration
+func NewCheckerConfiguration(config *betterconfig.Configuration) InstancesCheckerConfiguration {
+	checker := config.Checker
+	return InstancesCheckerConfiguration{
+		Environment:               config.Environment,
+		RestartThreshold:          checker.RestartThreshold,
+		ReportingThreshold:        checker.ReportingThreshold,
+		SoftRestartDuration:       time.Duration(checker.SoftRestartDuration),
+		HardRestartDuration:       time.Duration(checker.HardRestartDuration),
+		NotificationResetDuration: time.Duration(checker.NotificationResetDuration),
+		LatencyWarnThreshold:      time.Duration(checker.LatencyWarnThreshold),
+		LatencyCriticalThreshold:  time.Duration(checker.LatencyCriticalThreshold),
+		RestartJobDeadline:        time.Duration(checker.RestartJobDeadline),
+		MarkASGUnhealthy:          checker.MarkASGUnhealthy,
+		ASGReplacementDeadline:    time.Duration(checker.ASGReplacementDeadline),
+		MaxConcurrentChecks:       checker.MaxConcurrentChecks,
+		ScanCycleDeadline:         time.Duration(checker.ScanCycleDeadline),
+		ScanInterval:              time.Duration(checker.ScanInterval),
+		HealthcheckRoutes:         checker.HealthcheckRoutes,
+		DiscoverySelectors:        config.Discovery,
+		Regions:                   config.Regions,
+		Accounts:                  config.Accounts,
+		RemediationPolicies:       config.GetRemediationPolicies(),
+		Dependencies:              config.Dependencies,
+		Correlation: CorrelationSettings{
+			MinFailing: checker.Correlation.MinFailing,
+			MinRatio:   checker.Correlation.MinRatio,
+		},
+		DryRun:             checker.DryRun,
+		DryRunRepositories: checker.DryRunRepositories,
+		Guardrails: RemediationGuardrails{
+			MaxConcurrent:              checker.Guardrails.MaxConcurrent,
+			MaxConcurrentPerRepository: checker.Guardrails.MaxConcurrentPerRepository,
+			MinHealthyInstances:        checker.Guardrails.MinHealthyInstances,
+			ActionBudget:               checker.Guardrails.ActionBudget,
+			ActionBudgetWindow:         time.Duration(checker.Guardrails.ActionBudgetWindow),
+		},
+		Diagnostics: btrzaws.DiagnosticsSettings{
+			Enabled:      checker.Diagnostics.Enabled,
+			JournalLines: checker.Diagnostics.JournalLines,
+			Directory:    checker.Diagnostics.Directory,
+			BundlesKept:  checker.Diagnostics.BundlesKept,
+		},
+	}
+}
+
+// setDefaults - the zero values are replaced by the daemon configuration defaults
+func (configurations *InstancesCheckerConfiguration) setDefaults() {
+	defaults := NewCheckerConfiguration(betterconfig.Default())
+	if configurations.Environment == "" {
+		configurations.Environment = defaults.Environment
+	}
+	if configurations.RestartThreshold <= 0 {
+		configurations.RestartThreshold = defaults.RestartThreshold
+	}
+	if configurations.ReportingThreshold <= 0 {
+		configurations.ReportingThreshold = defaults.ReportingThreshold
+	}
+	if configurations.SoftRestartDuration == 0 {
+		configurations.SoftRestartDuration = defaults.SoftRestartDuration
+	}
+	if configurations.HardRestartDuration == 0 {
+		configurations.HardRestartDuration = defaults.HardRestartDuration
+	}
+	if configurations.NotificationResetDuration == 0 {
+		configurations.NotificationResetDuration = defaults.NotificationResetDuration
+	}
+	if configurations.LatencyWarnThreshold == 0 {
+		configurations.LatencyWarnThreshold = defaults.LatencyWarnThreshold
+	}
+	if configurations.LatencyCriticalThreshold == 0 {
+		configurations.LatencyCriticalThreshold = defaults.LatencyCriticalThreshold
+	}
+	if configurations.RestartJobDeadline == 0 {
+		configurations.RestartJobDeadline = defaults.RestartJobDeadline
+	}
+	if configurations.ASGReplacementDeadline == 0 {
+		configurations.ASGReplacementDeadline = defaults.ASGReplacementDeadline
+	}
+	if configurations.MaxConcurrentChecks <= 0 {
+		configurations.MaxConcurrentChecks = defaults.MaxConcurrentChecks
+	}
+	if configurations.ScanCycleDeadline == 0 {
+		configurations.ScanCycleDeadline = defaults.ScanCycleDeadline
+	}
+	if configurations.ScanInterval == 0 {
+		configurations.ScanInterval = defaults.ScanInterval
+	}
+	if len(configurations.HealthcheckRoutes) == 0 {
+		configurations.HealthcheckRoutes = btrzaws.DefaultHealthcheckRoutes()
+	}
+	if len(configurations.DiscoverySelectors) == 0 {
+		configurations.DiscoverySelectors = btrzaws.DefaultDiscoverySelectors()
+	}
+	if len(configurations.Regions) == 0 {
+		configurations.Regions = defaults.Regions
+	}
+	if len(configurations.Accounts) == 0 {
+		configurations.Accounts = btrzaws.DefaultAccountProfiles()
+	}
+	if configurations.Correlation.MinFailing <= 0 {
+		configurations.Correlation.MinFailing = defaults.Correlation.MinFailing
+	}
+	if configurations.Correlation.MinRatio <= 0 {
+		configurations.Correlation.MinRatio = defaults.Correlation.MinRatio
+	}
+	if configurations.Guardrails.ActionBudgetWindow == 0 {
+		configurations.Guardrails.ActionBudgetWindow = defaults.Guardrails.ActionBudgetWindow
+	}
+	if configurations.Diagnostics.JournalLines <= 0 {
+		configurations.Diagnostics.JournalLines = defaults.Diagnostics.JournalLines
+	}
+	if configurations.Diagnostics.Directory == "" {
+		configurations.Diagnostics.Directory = defaults.Diagnostics.Directory
+	}
+	if configurations.Diagnostics.BundlesKept <= 0 {
+		configurations.Diagnostics.BundlesKept = defaults.Diagnostics.BundlesKept
+	}
+}
+
+// config - copy of the running configuration
+func (ic *InstancesChecker) config() InstancesCheckerConfiguration {
+	ic.configurationsLock.RLock()
+	defer ic.configurationsLock.RUnlock()
+	return ic.Configurations
+}
+
+// UpdateConfigurations - replace the running configuration, fault and restart counters are kept.
+// the targets are created again, accounts roles may have changed
+func (ic *InstancesChecker) UpdateConfigurations(configurations InstancesCheckerConfiguration) {
+	configurations.setDefaults()
+	ic.configurationsLock.Lock()
+	ic.Configurations = configurations
+	ic.configurationsLock.Unlock()
+	ic.targetsLock.Lock()
+	ic.targets = make(map[string]*btrzaws.MonitoringTarget)
+	ic.targetsLock.Unlock()
+}
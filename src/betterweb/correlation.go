@@ -0,0 +1,185 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"clock"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CorrelationSettings - when the failures of the dependents of a service are correlated
+type CorrelationSettings struct {
+	// MinFailing, MinRatio - failing dependents needed, in number and in share of all the dependents
+	MinFailing int
+	MinRatio   float64
+}
+
+// isCorrelated - enough failing dependents, in number and in share, to open an incident and to keep it open
+func (settings CorrelationSettings) isCorrelated(failing, dependents int) bool {
+	return failing >= settings.MinFailing && float64(failing) >= settings.MinRatio*float64(dependents)
+}
+
+// CorrelatedIncident - dependents of a service failing together, they aren't remediated while it's open
+type CorrelatedIncident struct {
+	ID string
+	// Dependency - the likely root cause, the service the failing instances depend on
+	Dependency string
+	// DependencyFailing - failing instances of the dependency, when it's a monitored service
+	DependencyFailing int
+	// Dependents - discovered instances depending on the service
+	Dependents int
+	// Failing, Repositories - the failing dependents qualified ids and their services
+	Failing      []string
+	Repositories []string
+	Opened       time.Time
+	Resolved     time.Time
+}
+
+// correlations - the dependents of every service and the correlated incidents, safe for concurrent use
+type correlations struct {
+	lock  sync.Mutex
+	clock clock.Clock
+	// dependents - discovered instances per dependency, members - discovered instances per repository
+	dependents map[string][]*btrzaws.BetterezInstance
+	members    map[string][]*btrzaws.BetterezInstance
+	// dependencies - the dependencies of every discovered instance id
+	dependencies map[string][]string
+	open         map[string]*CorrelatedIncident
+	resolved     []*CorrelatedIncident
+}
+
+func newCorrelations(correlationsClock clock.Clock) *correlations {
+	return &correlations{
+		clock:        correlationsClock,
+		dependents:   make(map[string][]*btrzaws.BetterezInstance),
+		members:      make(map[string][]*btrzaws.BetterezInstance),
+		dependencies: make(map[string][]string),
+		open:         make(map[string]*CorrelatedIncident),
+	}
+}
+
+// setInstances - the discovered instances with their dependencies, from the configuration and their Depends-On tag
+func (store *correlations) setInstances(instances []*btrzaws.BetterezInstance, dependencies map[string][]string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.dependents = make(map[string][]*btrzaws.BetterezInstance)
+	store.members = make(map[string][]*btrzaws.BetterezInstance)
+	store.dependencies = make(map[string][]string)
+	for _, instance := range instances {
+		store.members[instance.Repository] = append(store.members[instance.Repository], instance)
+		instanceDependencies := instance.GetDependencies(dependencies)
+		store.dependencies[instance.InstanceID] = instanceDependencies
+		for _, dependency := range instanceDependencies {
+			store.dependents[dependency] = append(store.dependents[dependency], instance)
+		}
+	}
+}
+
+// correlate - the incident of the dependency with the most failing dependents, when the instance is one of them
+// and the dependency has an open incident or enough failing dependents. opened is true for a new incident
+func (store *correlations) correlate(instanceID string, settings CorrelationSettings,
+	isFailing func(instanceID string) bool) (incident *CorrelatedIncident, opened bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var rootCause string
+	mostFailing := 0
+	for _, dependency := range store.dependencies[instanceID] {
+		failing := store.countFailing(store.dependents[dependency], isFailing)
+		_, isOpen := store.open[dependency]
+		correlated := settings.isCorrelated(failing, len(store.dependents[dependency]))
+		if (isOpen || correlated) && failing > mostFailing {
+			rootCause, mostFailing = dependency, failing
+		}
+	}
+	if rootCause == "" {
+		return nil, false
+	}
+	incident, found := store.open[rootCause]
+	if !found {
+		now := store.clock.Now()
+		incident = &CorrelatedIncident{ID: fmt.Sprintf("%s-%d", rootCause, now.Unix()), Dependency: rootCause, Opened: now}
+		store.open[rootCause] = incident
+	}
+	store.update(incident, isFailing)
+	return copyCorrelatedIncident(incident), !found
+}
+
+// update - the failing dependents of the incident. the lock must be held
+func (store *correlations) update(incident *CorrelatedIncident, isFailing func(instanceID string) bool) {
+	dependents := store.dependents[incident.Dependency]
+	incident.Dependents = len(dependents)
+	incident.DependencyFailing = store.countFailing(store.members[incident.Dependency], isFailing)
+	incident.Failing = []string{}
+	incident.Repositories = []string{}
+	repositories := map[string]bool{}
+	for _, instance := range dependents {
+		if !isFailing(instance.InstanceID) {
+			continue
+		}
+		incident.Failing = append(incident.Failing, instance.GetQualifiedID())
+		if !repositories[instance.Repository] {
+			repositories[instance.Repository] = true
+			incident.Repositories = append(incident.Repositories, instance.Repository)
+		}
+	}
+	sort.Strings(incident.Failing)
+	sort.Strings(incident.Repositories)
+}
+
+func (store *correlations) countFailing(instances []*btrzaws.BetterezInstance, isFailing func(instanceID string) bool) int {
+	failing := 0
+	for _, instance := range instances {
+		if isFailing(instance.InstanceID) {
+			failing++
+		}
+	}
+	return failing
+}
+
+// resolve - close the incidents with fewer failing dependents than needed, in number or in share,
+// their instances are remediated again
+func (store *correlations) resolve(settings CorrelationSettings, isFailing func(instanceID string) bool) []CorrelatedIncident {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	resolved := []CorrelatedIncident{}
+	for dependency, incident := range store.open {
+		store.update(incident, isFailing)
+		if settings.isCorrelated(len(incident.Failing), incident.Dependents) {
+			continue
+		}
+		incident.Resolved = store.clock.Now()
+		delete(store.open, dependency)
+		store.resolved = append(store.resolved, incident)
+		resolved = append(resolved, *copyCorrelatedIncident(incident))
+	}
+	if len(store.resolved) > resolvedIncidentsKept {
+		store.resolved = store.resolved[len(store.resolved)-resolvedIncidentsKept:]
+	}
+	return resolved
+}
+
+// getIncidents - copies of the open and resolved correlated incidents
+func (store *correlations) getIncidents() (open []CorrelatedIncident, resolved []CorrelatedIncident) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	open, resolved = []CorrelatedIncident{}, []CorrelatedIncident{}
+	for _, incident := range store.open {
+		open = append(open, *copyCorrelatedIncident(incident))
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].Opened.Before(open[j].Opened)
+	})
+	for _, incident := range store.resolved {
+		resolved = append(resolved, *copyCorrelatedIncident(incident))
+	}
+	return open, resolved
+}
+
+func copyCorrelatedIncident(incident *CorrelatedIncident) *CorrelatedIncident {
+	incidentCopy := *incident
+	incidentCopy.Failing = append([]string{}, incident.Failing...)
+	incidentCopy.Repositories = append([]string{}, incident.Repositories...)
+	return &incidentCopy
+}
@@ -0,0 +1,117 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"fmt"
+	"logging"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NotifyDegraded, NotifyHostKeyMismatch, NotifyUnderCapacity, NotifyRemediationBlocked, NotifyCorrelatedFailure -
+	// the notifications recorded in dry run, besides the failure notification of the notify action
+	NotifyDegraded           = "notify-degraded"
+	NotifyHostKeyMismatch    = "notify-host-key-mismatch"
+	NotifyUnderCapacity      = "notify-under-capacity"
+	NotifyRemediationBlocked = "notify-remediation-blocked"
+	NotifyCorrelatedFailure  = "notify-correlated-failure"
+	// dryRunDecisionsKept - decisions kept for the dry run endpoint
+	dryRunDecisionsKept = 500
+)
+
+// DryRunDecision - an action the monitor would have taken on an instance in dry run
+type DryRunDecision struct {
+	Time        time.Time
+	Action      string
+	InstanceID  string
+	QualifiedID string
+	Repository  string
+	Location    string
+	Group       string `json:",omitempty"`
+	// Detail - the command, policy step or notification reason
+	Detail string `json:",omitempty"`
+	// Status - the last healthcheck error of the instance
+	Status string `json:",omitempty"`
+	// Failures, Restarts - the consecutive failed healthchecks and the restarts counted when deciding
+	Failures int
+	Restarts int
+}
+
+// DryRunResponse - the dry run endpoint response
+type DryRunResponse struct {
+	DryRun       bool
+	Repositories []string
+	Decisions    []DryRunDecision
+}
+
+// dryRunDecisions - the latest dry run decisions, safe for concurrent use
+type dryRunDecisions struct {
+	lock      sync.Mutex
+	decisions []DryRunDecision
+}
+
+func (decisions *dryRunDecisions) record(decision DryRunDecision) {
+	decisions.lock.Lock()
+	defer decisions.lock.Unlock()
+	decisions.decisions = append(decisions.decisions, decision)
+	if len(decisions.decisions) > dryRunDecisionsKept {
+		decisions.decisions = decisions.decisions[len(decisions.decisions)-dryRunDecisionsKept:]
+	}
+}
+
+func (decisions *dryRunDecisions) get() []DryRunDecision {
+	decisions.lock.Lock()
+	defer decisions.lock.Unlock()
+	return append([]DryRunDecision{}, decisions.decisions...)
+}
+
+// isDryRun - the whole monitor or the instance service is in dry run
+func (ic *InstancesChecker) isDryRun(instance *btrzaws.BetterezInstance) bool {
+	configurations := ic.config()
+	if configurations.DryRun {
+		return true
+	}
+	for _, repository := range configurations.DryRunRepositories {
+		if repository == instance.Repository {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunRecorded - true when the instance is in dry run, the action is then logged and recorded instead of taken
+func (ic *InstancesChecker) dryRunRecorded(instance *btrzaws.BetterezInstance, action, detail string) bool {
+	if !ic.isDryRun(instance) {
+		return false
+	}
+	decision := DryRunDecision{
+		Time:        ic.clock.Now(),
+		Action:      action,
+		InstanceID:  instance.InstanceID,
+		QualifiedID: instance.GetQualifiedID(),
+		Repository:  instance.Repository,
+		Location:    instance.GetLocation(),
+		Group:       instance.AutoScalingGroupName,
+		Detail:      detail,
+		Status:      instance.ServiceStatusErrorCode,
+		Failures:    ic.faultyInstances.get(instance.InstanceID),
+		Restarts:    ic.restartedServicesCounterMap.get(instance.InstanceID).countingPoint,
+	}
+	ic.dryRunDecisions.record(decision)
+	ic.incidents.recordEvent(instance, EventAction, strings.TrimSuffix(fmt.Sprintf("dry run, would %s: %s", action, detail), ": "))
+	logging.RecordLogLine(fmt.Sprintf("info: dry run: would %s %s (%s)  detail = %q  status = %q  failures = %d  restarts = %d",
+		action, decision.QualifiedID, decision.Repository, detail, decision.Status, decision.Failures, decision.Restarts))
+	return true
+}
+
+// GetDryRunDecisions - the dry run settings and the latest would have acted decisions
+func (ic *InstancesChecker) GetDryRunDecisions() DryRunResponse {
+	configurations := ic.config()
+	return DryRunResponse{
+		DryRun:       configurations.DryRun,
+		Repositories: append([]string{}, configurations.DryRunRepositories...),
+		Decisions:    ic.dryRunDecisions.get(),
+	}
+}
@@ -0,0 +1,227 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"clock"
+	"fmt"
+	"logging"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ReplacementInProgress - the instance is marked unhealthy, waiting for the group to replace it
+	ReplacementInProgress = "replacing"
+	// ReplacementUnderCapacity - the group stayed below its desired capacity past the deadline, an alert was sent
+	ReplacementUnderCapacity = "under-capacity"
+	// ReplacementCompleted - the instance left the group and the group is back to its desired capacity
+	ReplacementCompleted = "replaced"
+	// ReplacementFailed - the group couldn't be checked, ReplacementMaxErrors checks failed in a row
+	ReplacementFailed = "failed"
+)
+
+const (
+	// ReplacementPollInterval - wait between auto scaling group checks
+	ReplacementPollInterval = 30 * time.Second
+	// ReplacementFollowedDeadlines - the group is followed for this many deadlines, the replacement then ends
+	// under capacity and the instance is checked again
+	ReplacementFollowedDeadlines = 3
+	// ReplacementMaxErrors - failed group checks in a row before the replacement ends as failed
+	ReplacementMaxErrors = 10
+	// completedReplacementsKept - finished replacements kept for the replacements endpoint
+	completedReplacementsKept = 20
+)
+
+// GroupReplacement - an instance marked unhealthy in its auto scaling group, followed until the group replaced it
+type GroupReplacement struct {
+	ID          string
+	Group       string
+	InstanceID  string
+	QualifiedID string
+	Repository  string
+	State       string
+	Started     time.Time
+	Deadline    time.Time
+	// GiveUp - the replacement ends at this time if the group is still under capacity
+	GiveUp   time.Time
+	Finished time.Time
+	// Desired, Healthy - the group capacity at the last check
+	Desired int
+	Healthy int
+	Error   string `json:",omitempty"`
+	// Errors - failed group checks in a row
+	Errors   int `json:",omitempty"`
+	instance *btrzaws.BetterezInstance
+}
+
+// GroupReplacementsResponse - the replacements endpoint response
+type GroupReplacementsResponse struct {
+	InFlight  []GroupReplacement
+	Completed []GroupReplacement
+}
+
+// groupReplacements - in flight and recently completed replacements, safe for concurrent use
+type groupReplacements struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	inFlight  map[string]*GroupReplacement
+	completed []*GroupReplacement
+	// deadline - time the group has to replace the instance, read when a replacement starts
+	deadline func() time.Duration
+	// alert - called once when the group is still under capacity at the deadline
+	alert func(replacement GroupReplacement, instance *btrzaws.BetterezInstance)
+	// finished - called when the replacement ended, in any state
+	finished func(replacement GroupReplacement, instance *btrzaws.BetterezInstance)
+	// replacementsGroup - running pollers, for tests
+	replacementsGroup sync.WaitGroup
+}
+
+func newGroupReplacements(replacementsClock clock.Clock) *groupReplacements {
+	return &groupReplacements{
+		clock:    replacementsClock,
+		inFlight: make(map[string]*GroupReplacement),
+		deadline: func() time.Duration { return betterconfig.DefaultASGReplacementDeadline },
+		alert:    func(replacement GroupReplacement, instance *btrzaws.BetterezInstance) {},
+		finished: func(replacement GroupReplacement, instance *btrzaws.BetterezInstance) {},
+	}
+}
+
+// isReplacing - true while the instance replacement is followed
+func (replacements *groupReplacements) isReplacing(instanceID string) bool {
+	replacements.lock.Lock()
+	defer replacements.lock.Unlock()
+	_, found := replacements.inFlight[instanceID]
+	return found
+}
+
+// start - mark the instance unhealthy and follow its group in the background
+func (replacements *groupReplacements) start(instance *btrzaws.BetterezInstance) (*GroupReplacement, error) {
+	replacements.lock.Lock()
+	if _, found := replacements.inFlight[instance.InstanceID]; found {
+		replacements.lock.Unlock()
+		return nil, fmt.Errorf("instance %s is already being replaced", instance.GetQualifiedID())
+	}
+	now := replacements.clock.Now()
+	deadline := replacements.deadline()
+	instanceCopy := *instance
+	replacement := &GroupReplacement{
+		ID:          fmt.Sprintf("%s-%d", instance.InstanceID, now.Unix()),
+		Group:       instance.AutoScalingGroupName,
+		InstanceID:  instance.InstanceID,
+		QualifiedID: instance.GetQualifiedID(),
+		Repository:  instance.Repository,
+		State:       ReplacementInProgress,
+		Started:     now,
+		Deadline:    now.Add(deadline),
+		GiveUp:      now.Add(ReplacementFollowedDeadlines * deadline),
+		instance:    &instanceCopy,
+	}
+	replacements.inFlight[instance.InstanceID] = replacement
+	replacements.lock.Unlock()
+
+	if err := replacement.instance.MarkUnhealthy(); err != nil {
+		replacements.lock.Lock()
+		delete(replacements.inFlight, instance.InstanceID)
+		replacements.lock.Unlock()
+		return nil, err
+	}
+	logging.RecordLogLine(fmt.Sprintf("info: %s marked unhealthy, waiting for auto scaling group %s to replace it",
+		replacement.QualifiedID, replacement.Group))
+	replacements.replacementsGroup.Add(1)
+	go replacements.follow(replacement)
+	return replacement, nil
+}
+
+// follow - check the group until it's back to its desired capacity without the instance, or the replacement ended
+func (replacements *groupReplacements) follow(replacement *GroupReplacement) {
+	defer replacements.replacementsGroup.Done()
+	for {
+		<-replacements.clock.After(ReplacementPollInterval)
+		if replacements.poll(replacement) {
+			return
+		}
+	}
+}
+
+// poll - update the group capacity, returns true when the replacement ended
+func (replacements *groupReplacements) poll(replacement *GroupReplacement) bool {
+	capacity, err := replacement.instance.GetGroupCapacity()
+	replacements.lock.Lock()
+	now := replacements.clock.Now()
+	if err != nil {
+		replacement.Error = err.Error()
+		replacement.Errors++
+		logging.RecordLogLine(fmt.Sprintf("warning: %v while following the replacement of %s", err, replacement.QualifiedID))
+		if replacement.Errors >= ReplacementMaxErrors {
+			replacements.finish(replacement, ReplacementFailed, now)
+			replacements.lock.Unlock()
+			logging.RecordLogLine(fmt.Sprintf("error: auto scaling group %s couldn't be checked %d times in a row, stopped following the replacement of %s",
+				replacement.Group, ReplacementMaxErrors, replacement.QualifiedID))
+			replacements.finished(*replacement, replacement.instance)
+			return true
+		}
+	} else {
+		replacement.Error = ""
+		replacement.Errors = 0
+		replacement.Desired, replacement.Healthy = capacity.Desired, capacity.Healthy
+		if capacity.Healthy >= capacity.Desired && !capacity.IsHealthyMember(replacement.InstanceID) {
+			replacements.finish(replacement, ReplacementCompleted, now)
+			replacements.lock.Unlock()
+			logging.RecordLogLine(fmt.Sprintf("info: auto scaling group %s replaced %s, %d healthy of %d desired",
+				replacement.Group, replacement.QualifiedID, capacity.Healthy, capacity.Desired))
+			replacements.finished(*replacement, replacement.instance)
+			return true
+		}
+	}
+	alert := replacement.State == ReplacementInProgress && !now.Before(replacement.Deadline)
+	if alert {
+		replacement.State = ReplacementUnderCapacity
+	}
+	replacementCopy := *replacement
+	givenUp := !now.Before(replacement.GiveUp)
+	if givenUp {
+		replacements.finish(replacement, ReplacementUnderCapacity, now)
+	}
+	replacements.lock.Unlock()
+	if alert {
+		logging.RecordLogLine(fmt.Sprintf("fatal: auto scaling group %s has %d healthy instances of %d desired, %v after marking %s unhealthy",
+			replacementCopy.Group, replacementCopy.Healthy, replacementCopy.Desired, now.Sub(replacementCopy.Started), replacementCopy.QualifiedID))
+		replacements.alert(replacementCopy, replacement.instance)
+	}
+	if givenUp {
+		logging.RecordLogLine(fmt.Sprintf("error: auto scaling group %s is still under capacity, stopped following the replacement of %s",
+			replacementCopy.Group, replacementCopy.QualifiedID))
+		replacements.finished(replacementCopy, replacement.instance)
+	}
+	return givenUp
+}
+
+// finish - the replacement ended in the state, the instance is checked again. the lock must be held
+func (replacements *groupReplacements) finish(replacement *GroupReplacement, state string, now time.Time) {
+	replacement.State = state
+	replacement.Finished = now
+	delete(replacements.inFlight, replacement.InstanceID)
+	replacements.completed = append(replacements.completed, replacement)
+	if len(replacements.completed) > completedReplacementsKept {
+		replacements.completed = replacements.completed[len(replacements.completed)-completedReplacementsKept:]
+	}
+}
+
+// getReplacements - copies of the in flight and completed replacements
+func (replacements *groupReplacements) getReplacements() GroupReplacementsResponse {
+	replacements.lock.Lock()
+	defer replacements.lock.Unlock()
+	response := GroupReplacementsResponse{InFlight: []GroupReplacement{}, Completed: []GroupReplacement{}}
+	for _, replacement := range replacements.inFlight {
+		response.InFlight = append(response.InFlight, *replacement)
+	}
+	sort.Slice(response.InFlight, func(i, j int) bool {
+		return response.InFlight[i].Started.Before(response.InFlight[j].Started)
+	})
+	for _, replacement := range replacements.completed {
+		response.Completed = append(response.Completed, *replacement)
+	}
+	return response
+}
@@ -0,0 +1,400 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"clock"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// IncidentOpen - the instance is failing, nothing was done yet
+	IncidentOpen = "open"
+	// IncidentAcknowledged - someone took the incident, the monitor keeps remediating and recording
+	IncidentAcknowledged = "acknowledged"
+	// IncidentRemediating - the monitor acted on the instance
+	IncidentRemediating = "remediating"
+	// IncidentResolved - the instance passed its healthcheck, or isn't discovered anymore
+	IncidentResolved = "resolved"
+)
+
+const (
+	// EventCheck, EventAction, EventNotification, EventState - the kinds of the timeline events
+	EventCheck        = "check"
+	EventAction       = "action"
+	EventNotification = "notification"
+	EventState        = "state"
+)
+
+const (
+	// resolvedIncidentsKept - resolved incidents kept for the incidents endpoint
+	resolvedIncidentsKept = 50
+	// incidentTimelineKept - the latest events kept in a timeline
+	incidentTimelineKept = 200
+	// incidentRecordsKept - the latest commands, restarts and diagnostics kept with an incident
+	incidentRecordsKept = 20
+)
+
+// Incident - the failure of an instance, from its first failed healthcheck until it passes again,
+// or an auto scaling group under capacity until its replacement ended
+type Incident struct {
+	ID          string
+	InstanceID  string
+	QualifiedID string
+	// Group - the auto scaling group of a group incident, which has no instance id
+	Group string `json:",omitempty"`
+	// Repository - the failing service
+	Repository   string
+	State        string
+	Opened       time.Time
+	Acknowledged time.Time
+	Resolved     time.Time
+	// Timeline - the checks, actions, notifications and state changes, the oldest are dropped past the limit
+	Timeline        []IncidentEvent
+	TimelineDropped int `json:",omitempty"`
+	// Commands - the remediation commands run on the instance, with their output and exit status
+	Commands []btrzaws.CommandResult
+	// Restarts - the completed full server restarts of the instance
+	Restarts []RestartJob
+	// Diagnostics - the bundles collected before the service restarts
+	Diagnostics []DiagnosticsReference
+	// RecordsDropped - the oldest commands, restarts and diagnostics dropped past the limit
+	RecordsDropped int `json:",omitempty"`
+}
+
+// IncidentEvent - an entry of the incident timeline
+type IncidentEvent struct {
+	Time    time.Time
+	Kind    string
+	Message string
+	// Repeated - the same event happened again that many times, Time is the last one
+	Repeated int `json:",omitempty"`
+}
+
+// IncidentSummary - an incident without its records, listed by the incidents endpoint
+type IncidentSummary struct {
+	ID           string
+	InstanceID   string
+	QualifiedID  string
+	Group        string `json:",omitempty"`
+	Repository   string
+	State        string
+	Opened       time.Time
+	Acknowledged time.Time
+	Resolved     time.Time
+	LastEvent    IncidentEvent
+}
+
+// DiagnosticsReference - a diagnostics bundle of the incident, downloaded from /incidents/diagnostics?id=
+type DiagnosticsReference struct {
+	ID        string
+	Collected time.Time
+	Sections  []string
+	Error     string `json:",omitempty"`
+}
+
+// IncidentsResponse - the open and resolved incidents
+type IncidentsResponse struct {
+	Open     []Incident
+	Resolved []Incident
+	// Correlated, CorrelatedResolved - the incidents of dependents failing together
+	Correlated         []CorrelatedIncident
+	CorrelatedResolved []CorrelatedIncident
+}
+
+// IncidentsListResponse - the incidents endpoint response
+type IncidentsListResponse struct {
+	Open               []IncidentSummary
+	Resolved           []IncidentSummary
+	Correlated         []CorrelatedIncident
+	CorrelatedResolved []CorrelatedIncident
+}
+
+// incidents - open and recently resolved incidents, safe for concurrent use
+type incidents struct {
+	lock     sync.Mutex
+	clock    clock.Clock
+	open     map[string]*Incident
+	resolved []*Incident
+}
+
+func newIncidents(incidentsClock clock.Clock) *incidents {
+	return &incidents{
+		clock: incidentsClock,
+		open:  make(map[string]*Incident),
+	}
+}
+
+// recordCheck - add the failed healthcheck to the instance incident, opening one when needed
+func (store *incidents) recordCheck(instance *btrzaws.BetterezInstance, message string) {
+	store.recordEvent(instance, EventCheck, message)
+}
+
+// recordAction - add the action to the instance incident, which is then remediating unless acknowledged
+func (store *incidents) recordAction(instance *btrzaws.BetterezInstance, message string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident := store.getOpenIncident(instance.InstanceID, instance.GetQualifiedID(), instance.Repository)
+	store.addEvent(incident, EventAction, message)
+	store.setRemediating(incident)
+}
+
+// recordNotification - add the sent notification to the instance incident
+func (store *incidents) recordNotification(instance *btrzaws.BetterezInstance, message string) {
+	store.recordEvent(instance, EventNotification, message)
+}
+
+// recordGroupNotification - add the sent notification to the auto scaling group incident, opening one when needed
+func (store *incidents) recordGroupNotification(location, group, repository, message string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key := groupIncidentKey(location, group)
+	incident := store.getOpenIncident(key, key, repository)
+	if incident.Group == "" {
+		incident.Group, incident.InstanceID = group, ""
+	}
+	store.addEvent(incident, EventNotification, message)
+}
+
+// groupIncidentKey - the key of an auto scaling group incident, instance ids have no slashes
+func groupIncidentKey(location, group string) string {
+	return location + "/" + group
+}
+
+// recordEvent - add the event to the instance incident, opening one when needed
+func (store *incidents) recordEvent(instance *btrzaws.BetterezInstance, kind, message string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident := store.getOpenIncident(instance.InstanceID, instance.GetQualifiedID(), instance.Repository)
+	store.addEvent(incident, kind, message)
+}
+
+// recordCommand - attach the command result to the instance incident, opening one when needed
+func (store *incidents) recordCommand(instance *btrzaws.BetterezInstance, result btrzaws.CommandResult) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident := store.getOpenIncident(instance.InstanceID, instance.GetQualifiedID(), instance.Repository)
+	incident.Commands = append(incident.Commands, result)
+	if dropped := len(incident.Commands) - incidentRecordsKept; dropped > 0 {
+		incident.Commands = append([]btrzaws.CommandResult{}, incident.Commands[dropped:]...)
+		incident.RecordsDropped += dropped
+	}
+	store.addEvent(incident, EventAction, fmt.Sprintf("command %q with %s: %s, exit code %d",
+		result.Command, result.Executor, result.Status, result.ExitCode))
+	store.setRemediating(incident)
+}
+
+// recordRestart - attach the completed server restart to the instance incident, opening one when needed
+func (store *incidents) recordRestart(job RestartJob) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident := store.getOpenIncident(job.InstanceID, job.QualifiedID, job.Repository)
+	job.Transitions = append([]RestartTransition{}, job.Transitions...)
+	incident.Restarts = append(incident.Restarts, job)
+	if dropped := len(incident.Restarts) - incidentRecordsKept; dropped > 0 {
+		incident.Restarts = append([]RestartJob{}, incident.Restarts[dropped:]...)
+		incident.RecordsDropped += dropped
+	}
+	message := fmt.Sprintf("server restart %s finished %s", job.ID, job.State)
+	if job.Error != "" {
+		message += ", " + job.Error
+	}
+	store.addEvent(incident, EventAction, message)
+	store.setRemediating(incident)
+}
+
+// recordDiagnostics - attach the saved diagnostics bundle to the instance incident, opening one when needed
+func (store *incidents) recordDiagnostics(instance *btrzaws.BetterezInstance, bundle *btrzaws.DiagnosticsBundle) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident := store.getOpenIncident(instance.InstanceID, instance.GetQualifiedID(), instance.Repository)
+	reference := DiagnosticsReference{ID: bundle.ID, Collected: bundle.Collected, Sections: []string{}, Error: bundle.Error}
+	for _, section := range bundle.Sections {
+		reference.Sections = append(reference.Sections, section.Name)
+	}
+	incident.Diagnostics = append(incident.Diagnostics, reference)
+	if dropped := len(incident.Diagnostics) - incidentRecordsKept; dropped > 0 {
+		incident.Diagnostics = append([]DiagnosticsReference{}, incident.Diagnostics[dropped:]...)
+		incident.RecordsDropped += dropped
+	}
+	store.addEvent(incident, EventAction, fmt.Sprintf("diagnostics %s collected", bundle.ID))
+}
+
+// getOpenIncident - the open incident of the instance, a new one when it has none. the lock must be held
+func (store *incidents) getOpenIncident(instanceID, qualifiedID, repository string) *Incident {
+	incident, found := store.open[instanceID]
+	if !found {
+		now := store.clock.Now()
+		incident = &Incident{
+			ID:          fmt.Sprintf("%s-%d", instanceID, now.Unix()),
+			InstanceID:  instanceID,
+			QualifiedID: qualifiedID,
+			Repository:  repository,
+			State:       IncidentOpen,
+			Opened:      now,
+			Timeline:    []IncidentEvent{},
+		}
+		store.open[instanceID] = incident
+	}
+	return incident
+}
+
+// addEvent - append the event to the timeline, an event repeating the last one is merged into it. the lock must be held
+func (store *incidents) addEvent(incident *Incident, kind, message string) {
+	now := store.clock.Now()
+	if last := len(incident.Timeline) - 1; last >= 0 &&
+		incident.Timeline[last].Kind == kind && incident.Timeline[last].Message == message {
+		incident.Timeline[last].Time = now
+		incident.Timeline[last].Repeated++
+		return
+	}
+	incident.Timeline = append(incident.Timeline, IncidentEvent{Time: now, Kind: kind, Message: message})
+	if dropped := len(incident.Timeline) - incidentTimelineKept; dropped > 0 {
+		incident.Timeline = append([]IncidentEvent{}, incident.Timeline[dropped:]...)
+		incident.TimelineDropped += dropped
+	}
+}
+
+// setRemediating - an open incident is remediating once the monitor acted. the lock must be held
+func (store *incidents) setRemediating(incident *Incident) {
+	if incident.State == IncidentOpen {
+		incident.State = IncidentRemediating
+		store.addEvent(incident, EventState, IncidentRemediating)
+	}
+}
+
+// acknowledge - someone took the open incident, the note is added to its timeline
+func (store *incidents) acknowledge(id, note string) (*Incident, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, incident := range store.open {
+		if incident.ID != id {
+			continue
+		}
+		if incident.State != IncidentAcknowledged {
+			incident.State = IncidentAcknowledged
+			incident.Acknowledged = store.clock.Now()
+		}
+		message := IncidentAcknowledged
+		if note != "" {
+			message = fmt.Sprintf("%s: %s", IncidentAcknowledged, note)
+		}
+		store.addEvent(incident, EventState, message)
+		incidentCopy := copyIncident(incident)
+		return &incidentCopy, nil
+	}
+	return nil, fmt.Errorf("no open incident %s", id)
+}
+
+// resolve - close the instance incident, if it has one
+func (store *incidents) resolve(instanceID, reason string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	incident, found := store.open[instanceID]
+	if !found {
+		return
+	}
+	store.addEvent(incident, EventCheck, reason)
+	store.addEvent(incident, EventState, IncidentResolved)
+	incident.State = IncidentResolved
+	incident.Resolved = store.clock.Now()
+	delete(store.open, instanceID)
+	store.resolved = append(store.resolved, incident)
+	if len(store.resolved) > resolvedIncidentsKept {
+		store.resolved = store.resolved[len(store.resolved)-resolvedIncidentsKept:]
+	}
+}
+
+// resolveMissing - close the incidents of the instances that aren't discovered anymore, terminated or replaced.
+// the incidents of the instances still being remediated are kept, a stopped server isn't discovered.
+// the group incidents are closed when their replacement ends
+func (store *incidents) resolveMissing(instances []*btrzaws.BetterezInstance, isRemediating func(instanceID string) bool) {
+	discovered := map[string]bool{}
+	for _, instance := range instances {
+		discovered[instance.InstanceID] = true
+	}
+	store.lock.Lock()
+	missing := []string{}
+	for instanceID := range store.open {
+		if !discovered[instanceID] && !isRemediating(instanceID) && store.open[instanceID].Group == "" {
+			missing = append(missing, instanceID)
+		}
+	}
+	store.lock.Unlock()
+	for _, instanceID := range missing {
+		store.resolve(instanceID, "instance not discovered anymore")
+	}
+}
+
+// getIncident - a copy of the open or resolved incident
+func (store *incidents) getIncident(id string) (*Incident, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, incident := range store.open {
+		if incident.ID == id {
+			incidentCopy := copyIncident(incident)
+			return &incidentCopy, true
+		}
+	}
+	for _, incident := range store.resolved {
+		if incident.ID == id {
+			incidentCopy := copyIncident(incident)
+			return &incidentCopy, true
+		}
+	}
+	return nil, false
+}
+
+// getIncidents - copies of the open and resolved incidents
+func (store *incidents) getIncidents() IncidentsResponse {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	response := IncidentsResponse{Open: []Incident{}, Resolved: []Incident{}}
+	for _, incident := range store.open {
+		response.Open = append(response.Open, copyIncident(incident))
+	}
+	sort.Slice(response.Open, func(i, j int) bool {
+		return response.Open[i].Opened.Before(response.Open[j].Opened)
+	})
+	for _, incident := range store.resolved {
+		response.Resolved = append(response.Resolved, copyIncident(incident))
+	}
+	return response
+}
+
+func copyIncident(incident *Incident) Incident {
+	incidentCopy := *incident
+	incidentCopy.Timeline = append([]IncidentEvent{}, incident.Timeline...)
+	incidentCopy.Commands = append([]btrzaws.CommandResult{}, incident.Commands...)
+	incidentCopy.Restarts = append([]RestartJob{}, incident.Restarts...)
+	incidentCopy.Diagnostics = append([]DiagnosticsReference{}, incident.Diagnostics...)
+	return incidentCopy
+}
+
+// summarizeIncidents - the incidents without their records, of the state when it's not empty
+func summarizeIncidents(incidentsList []Incident, state string) []IncidentSummary {
+	summaries := []IncidentSummary{}
+	for _, incident := range incidentsList {
+		if state != "" && incident.State != state {
+			continue
+		}
+		summary := IncidentSummary{
+			ID:           incident.ID,
+			InstanceID:   incident.InstanceID,
+			QualifiedID:  incident.QualifiedID,
+			Group:        incident.Group,
+			Repository:   incident.Repository,
+			State:        incident.State,
+			Opened:       incident.Opened,
+			Acknowledged: incident.Acknowledged,
+			Resolved:     incident.Resolved,
+		}
+		if len(incident.Timeline) > 0 {
+			summary.LastEvent = incident.Timeline[len(incident.Timeline)-1]
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
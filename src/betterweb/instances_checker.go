@@ -2,221 +2,834 @@ package betterweb
 
 import (
 	"btrzaws"
+	"clock"
 	"fmt"
 	"log"
 	"logging"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type InstancesChecker struct {
-	faultyInstances             map[string]int
-	restartedServicesCounterMap map[string]restartCounter
-	restartingInstances         map[string]restartCounter
+	faultyInstances   *faultsCounter
+	degradedInstances *instanceFlags
+	// hostKeyMismatches - instances whose ssh host key mismatched or couldn't be verified, not remediated until healthy
+	hostKeyMismatches *instanceFlags
+	// guardrailBlocks - instances left to notifications by a remediation guardrail, alerted once until healthy
+	guardrailBlocks             *instanceFlags
+	restartedServicesCounterMap *restartCounters
+	restartingInstances         *restartCounters
 	lastOKLogLine               time.Time
-	clientResponse              *ClientResponse
-	sess                        *session.Session
-	Configurations              InstancesCheckerConfiguration
-	tempCheckedInstances        []*btrzaws.BetterezInstance
+	// snapshot - *ClientResponse published at the end of every scan cycle, read only
+	snapshot           atomic.Value
+	lastScanStatistics ScanStatistics
+	sess               *session.Session
+	// targets - account/region to monitoring target, created on first use
+	targets     map[string]*btrzaws.MonitoringTarget
+	targetsLock sync.Mutex
+	// stsClient - assumes the accounts roles, created from the monitor session when nil
+	stsClient stscreds.AssumeRoler
+	// targetFactory - creates the targets with their aws clients, aws sdk clients by default
+	targetFactory btrzaws.TargetFactory
+	// notifications - sends the text messages, created from the monitor session when nil
+	notifications btrzaws.SNSAPI
+	// clock - time source of all the timing logic, the system clock by default
+	clock clock.Clock
+	// executors - run the remediation commands over ssh or ssm
+	executors btrzaws.RemediationExecutors
+	// serviceRestarter - restarts the instance service with its remediation executor by default
+	serviceRestarter func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error)
+	// diagnosticsCollector - collects the diagnostics bundle with the instance remediation executor by default
+	diagnosticsCollector func(instance *btrzaws.BetterezInstance) (*btrzaws.DiagnosticsBundle, error)
+	// policiesProgress - the remediation policy step of the failing instances
+	policiesProgress *policiesProgress
+	// remediations - the remediations of failing instances, run outside of the scan workers
+	remediations *remediations
+	// restartJobs - full server restarts in progress
+	restartJobs *restartJobs
+	// groupReplacements - auto scaling group members marked unhealthy, waiting for their replacement
+	groupReplacements *groupReplacements
+	// guardrails - the remediations in progress and the actions counted against the guardrails
+	guardrails *remediationGuardrails
+	// correlations - the services dependents and the incidents of dependents failing together
+	correlations *correlations
+	// dryRunDecisions - the actions not taken on the instances in dry run
+	dryRunDecisions *dryRunDecisions
+	// incidents - remediation records of the failing instances
+	incidents *incidents
+	// Configurations - set before starting, use config() and UpdateConfigurations afterwards
+	Configurations       InstancesCheckerConfiguration
+	configurationsLock   sync.RWMutex
+	tempCheckedInstances []*btrzaws.BetterezInstance
+	// instancesLoader - discovers the instances to check, aws by default
+	instancesLoader func() ([]*btrzaws.BetterezInstance, error)
+	initialized     sync.Once
 }
 
-type InstancesCheckerConfiguration struct {
-	Environment          string
-	NotificationsOptions []string
+// ScanStatistics - timing and queue statistics of a single scan cycle
+type ScanStatistics struct {
+	CycleStart       time.Time
+	Duration         time.Duration
+	Workers          int
+	InstancesQueued  int
+	InstancesChecked int
+	InstancesSkipped int
+	InstancesExpired int
+	MaxQueueWait     time.Duration
 }
 
 func (ic *InstancesChecker) initChecker(sess *session.Session) {
 	ic.sess = sess
-	ic.faultyInstances = make(map[string]int)
-	ic.restartedServicesCounterMap = make(map[string]restartCounter)
-	ic.restartingInstances = make(map[string]restartCounter)
-	ic.lastOKLogLine = time.Now().Add(ServerAliveDurationNotification)
-	ic.clientResponse = &ClientResponse{Version: "1.0.0.4"}
-	ic.Configurations.Environment = os.Getenv("env")
-	if ic.Configurations.Environment == "" {
-		ic.Configurations.Environment = "production"
+	ic.targets = make(map[string]*btrzaws.MonitoringTarget)
+	ic.faultyInstances = newFaultsCounter()
+	ic.degradedInstances = newInstanceFlags()
+	ic.hostKeyMismatches = newInstanceFlags()
+	ic.guardrailBlocks = newInstanceFlags()
+	ic.policiesProgress = newPoliciesProgress()
+	ic.restartedServicesCounterMap = newRestartCounters()
+	ic.restartingInstances = newRestartCounters()
+	if ic.clock == nil {
+		ic.clock = clock.Real()
 	}
+	if ic.executors == nil {
+		ic.executors = btrzaws.NewRemediationExecutors(ic.clock)
+	}
+	if ic.serviceRestarter == nil {
+		ic.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+			return instance.RestartService(ic.executors)
+		}
+	}
+	if ic.diagnosticsCollector == nil {
+		ic.diagnosticsCollector = func(instance *btrzaws.BetterezInstance) (*btrzaws.DiagnosticsBundle, error) {
+			return instance.CollectDiagnostics(ic.executors, ic.config().Diagnostics, ic.clock.Now())
+		}
+	}
+	ic.incidents = newIncidents(ic.clock)
+	ic.guardrails = newRemediationGuardrails(ic.clock)
+	ic.dryRunDecisions = &dryRunDecisions{}
+	ic.correlations = newCorrelations(ic.clock)
+	ic.remediations = newRemediations()
+	ic.restartJobs = newRestartJobs(ic.clock)
+	ic.restartJobs.deadline = func() time.Duration { return ic.config().RestartJobDeadline }
+	ic.restartJobs.escalate = ic.escalateRestart
+	ic.restartJobs.finished = ic.restartFinished
+	ic.groupReplacements = newGroupReplacements(ic.clock)
+	ic.groupReplacements.deadline = func() time.Duration { return ic.config().ASGReplacementDeadline }
+	ic.groupReplacements.alert = ic.alertGroupUnderCapacity
+	ic.groupReplacements.finished = ic.groupReplacementFinished
+	ic.lastOKLogLine = ic.clock.Now().Add(ServerAliveDurationNotification)
+	ic.snapshot.Store(&ClientResponse{Version: ClientResponseVersion})
+	if ic.instancesLoader == nil {
+		ic.instancesLoader = ic.loadInstancesFromAWS
+	}
+	if ic.targetFactory == nil {
+		ic.targetFactory = ic.createAWSTarget
+	}
+	if ic.notifications == nil && sess != nil {
+		ic.notifications = sns.New(sess)
+	}
+	ic.Configurations.setDefaults()
+}
+
+// init - initialize the checker once, before it's shared: a configuration reload may update it right after
+func (ic *InstancesChecker) init(sess *session.Session) {
+	ic.initialized.Do(func() {
+		ic.initChecker(sess)
+	})
 }
 
 func (ic *InstancesChecker) CheckInstances(sess *session.Session) {
-	ic.initChecker(sess)
+	ic.init(sess)
 	go func() {
-		updateTime := time.Now()
 		for {
-			err := ic.getInstances()
+			cycleStart := ic.clock.Now()
+			err := ic.runScanCycle()
 			if err != nil {
 				log.Fatalln(err, "getting instances")
 			}
-			ic.scanInstances()
-			for !time.Now().After(updateTime.Add(time.Second * 9)) {
-				time.Sleep(time.Second)
-			}
-			updateTime = time.Now()
-			ic.updateResponseInstances()
+			ic.waitForNextCycle(cycleStart)
 		}
 	}()
 }
 
-func (ic *InstancesChecker) updateResponseInstances() {
-	ic.clientResponse.Instances = ic.clientResponse.Instances[:0]
-	for _, instance := range ic.tempCheckedInstances {
-		ic.clientResponse.Instances = append(ic.clientResponse.Instances, instance)
+// waitForNextCycle - sleep until ScanInterval passed since the cycle start
+func (ic *InstancesChecker) waitForNextCycle(cycleStart time.Time) {
+	wait := cycleStart.Add(ic.config().ScanInterval).Sub(ic.clock.Now())
+	if wait > 0 {
+		ic.clock.Sleep(wait)
 	}
 }
 
-func (ic *InstancesChecker) getTags() []*btrzaws.AwsTag {
-	instanceTag := &btrzaws.AwsTag{TagName: "tag:Nginx-Configuration", TagValues: []string{"api", "app", "connex"}}
-	tags := []*btrzaws.AwsTag{
-		btrzaws.NewWithValues("tag:Environment", ic.Configurations.Environment),
-		btrzaws.NewWithValues("tag:Service-Type", "http"),
-		btrzaws.NewWithValues("tag:Online", "yes"),
-		btrzaws.NewWithValues("instance-state-name", "running"),
-		instanceTag,
+// runScanCycle - discover, check and publish the instances
+func (ic *InstancesChecker) runScanCycle() error {
+	err := ic.getInstances()
+	if err != nil {
+		return err
 	}
-	return tags
+	failing := ic.scanInstances()
+	ic.resolveCorrelatedIncidents()
+	ic.remediateFailingInstances(failing)
+	ic.publishSnapshot()
+	return nil
+}
+
+// publishSnapshot - replace the client response with copies of the checked instances.
+// the published response is never modified, so handlers can read it without locking
+func (ic *InstancesChecker) publishSnapshot() {
+	response := &ClientResponse{
+		TimeStamp:      ic.clock.Now(),
+		Version:        ClientResponseVersion,
+		ScanStatistics: ic.lastScanStatistics,
+		Instances:      make([]*btrzaws.BetterezInstance, 0, len(ic.tempCheckedInstances)),
+	}
+	for _, instance := range ic.tempCheckedInstances {
+		instanceCopy := *instance
+		response.Instances = append(response.Instances, &instanceCopy)
+	}
+	ic.snapshot.Store(response)
+}
+
+// GetClientResponse - return the last published snapshot
+func (ic *InstancesChecker) GetClientResponse() *ClientResponse {
+	response, _ := ic.snapshot.Load().(*ClientResponse)
+	return response
 }
 
 func (ic *InstancesChecker) getInstances() error {
-	reservations, err := btrzaws.GetInstancesWithTags(ic.sess, ic.getTags())
+	instances, err := ic.instancesLoader()
 	if err != nil {
 		return err
 	}
-	ic.tempCheckedInstances = ic.tempCheckedInstances[:0]
+	ic.tempCheckedInstances = instances
+	ic.guardrails.setMembers(instances)
+	ic.correlations.setInstances(instances, ic.config().Dependencies)
+	ic.incidents.resolveMissing(instances, ic.restartJobs.isRestarting)
+	return nil
+}
+
+// loadInstancesFromAWS - discover the instances of all the accounts and regions.
+// a failing target is logged and skipped, an error is returned only when all of them fail
+func (ic *InstancesChecker) loadInstancesFromAWS() ([]*btrzaws.BetterezInstance, error) {
+	configurations := ic.config()
+	instances := []*btrzaws.BetterezInstance{}
+	seenInstances := make(map[string]bool)
+	var lastError error
+	targetsCount := 0
+	failedTargets := 0
+	for _, account := range configurations.Accounts {
+		for _, region := range account.GetRegions(configurations.Regions) {
+			targetsCount++
+			target, err := ic.getTarget(account, region)
+			if err == nil {
+				var targetInstances []*btrzaws.BetterezInstance
+				targetInstances, err = loadTargetInstances(target, configurations, seenInstances)
+				instances = append(instances, targetInstances...)
+			}
+			if err != nil {
+				logging.RecordLogLine(fmt.Sprintf("error: %v while getting instances in %s",
+					err, btrzaws.GetTargetKey(account.Name, region)))
+				lastError = err
+				failedTargets++
+			}
+		}
+	}
+	if failedTargets == targetsCount {
+		return nil, lastError
+	}
+	return instances, nil
+}
+
+// getTarget - the cached target of the account region
+func (ic *InstancesChecker) getTarget(account *btrzaws.AccountProfile, region string) (*btrzaws.MonitoringTarget, error) {
+	ic.targetsLock.Lock()
+	defer ic.targetsLock.Unlock()
+	targetKey := btrzaws.GetTargetKey(account.Name, region)
+	if target, found := ic.targets[targetKey]; found {
+		return target, nil
+	}
+	target, err := ic.targetFactory(account, region)
+	if err != nil {
+		return nil, err
+	}
+	ic.targets[targetKey] = target
+	return target, nil
+}
+
+// createAWSTarget - target with the aws sdk clients, called with targetsLock held
+func (ic *InstancesChecker) createAWSTarget(account *btrzaws.AccountProfile, region string) (*btrzaws.MonitoringTarget, error) {
+	if account.RoleARN != "" && ic.stsClient == nil {
+		sess := ic.sess
+		if sess == nil {
+			var err error
+			if sess, err = btrzaws.GetAWSSession(); err != nil {
+				return nil, err
+			}
+		}
+		ic.stsClient = sts.New(sess)
+	}
+	return btrzaws.CreateMonitoringTarget(account, region, ic.stsClient)
+}
+
+func loadTargetInstances(target *btrzaws.MonitoringTarget, configurations InstancesCheckerConfiguration,
+	seenInstances map[string]bool) ([]*btrzaws.BetterezInstance, error) {
+	instances := []*btrzaws.BetterezInstance{}
+	for _, selector := range configurations.DiscoverySelectors {
+		reservations, err := btrzaws.DescribeInstancesWithTags(target.Clients.EC2, selector.GetTags(configurations.Environment))
+		if err != nil {
+			return nil, err
+		}
+		selected := selectInstances(selector, reservations, seenInstances, configurations.HealthcheckRoutes)
+		for _, instance := range selected {
+			instance.SetTarget(target)
+		}
+		instances = append(instances, selected...)
+	}
+	return instances, nil
+}
+
+// selectInstances - drop excluded, opted out and already selected instances
+func selectInstances(selector *btrzaws.DiscoverySelector, reservations []*ec2.Reservation,
+	seenInstances map[string]bool, routes []*btrzaws.HealthcheckRoute) []*btrzaws.BetterezInstance {
+	instances := []*btrzaws.BetterezInstance{}
 	for idx := range reservations {
 		for _, instance := range reservations[idx].Instances {
-			ic.tempCheckedInstances = append(ic.tempCheckedInstances, btrzaws.LoadFromAWSInstance(instance))
+			instanceID := aws.StringValue(instance.InstanceId)
+			if seenInstances[instanceID] || btrzaws.IsMonitoringDisabled(instance) || selector.Excludes(instance) {
+				continue
+			}
+			seenInstances[instanceID] = true
+			betterezInstance := btrzaws.LoadFromAWSInstance(instance)
+			betterezInstance.HealthcheckEndpoint = btrzaws.ResolveHealthcheckEndpoint(routes, betterezInstance)
+			instances = append(instances, betterezInstance)
 		}
 	}
-	return err
+	return instances
 }
 
 func (ic *InstancesChecker) instanceShouldSkipChecking(instance *btrzaws.BetterezInstance) bool {
-	if isThisInstanceStillStarting(instance.InstanceID, &ic.restartingInstances) {
-		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = restarting  ", instance.InstanceID))
+	if isThisInstanceStillStarting(instance.InstanceID, ic.restartingInstances, ic.clock.Now()) ||
+		ic.restartJobs.isRestarting(instance.InstanceID) {
+		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = restarting  ", instance.GetQualifiedID()))
 		return true
 	}
-	if isThisInstanceJustCreated(instance) {
-		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = new  ", instance.InstanceID))
+	if ic.remediations.isRunning(instance.InstanceID) {
+		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = remediating  ", instance.GetQualifiedID()))
+		return true
+	}
+	if ic.groupReplacements.isReplacing(instance.InstanceID) {
+		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = replacing  ", instance.GetQualifiedID()))
+		return true
+	}
+	if isThisInstanceJustCreated(instance, ic.config().HardRestartDuration, ic.clock.Now()) {
+		logging.RecordLogLine(fmt.Sprintf("  instanceId = %s  checked = false  reason = new  ", instance.GetQualifiedID()))
 		return true
 	}
 	return false
 }
 
-func (ic *InstancesChecker) scanInstances() {
-	instancesIndex := 0
+// scanInstances - check the instances with the concurrent workers, returns the failing ones
+func (ic *InstancesChecker) scanInstances() []*btrzaws.BetterezInstance {
+	configurations := ic.config()
+	workers := configurations.MaxConcurrentChecks
+	stats := ScanStatistics{
+		CycleStart:      ic.clock.Now(),
+		Workers:         workers,
+		InstancesQueued: len(ic.tempCheckedInstances),
+	}
+	deadline := stats.CycleStart.Add(configurations.ScanCycleDeadline)
+	queue := make(chan *btrzaws.BetterezInstance, len(ic.tempCheckedInstances))
 	for _, instance := range ic.tempCheckedInstances {
-		instancesIndex++
-		if ic.instanceShouldSkipChecking(instance) {
-			continue
-		}
-		instanceIsFaulty := false
-		ok, err := instance.CheckInstanceHealth()
-		if err != nil {
-			logging.RecordLogLine(fmt.Sprintf("warning: error %v while checking instance! Fault counted.", err))
-			instanceIsFaulty = true
-		} else {
-			if ok {
-				ic.handleWorkingInstance(instance)
+		queue <- instance
+	}
+	close(queue)
+	var checked, skipped, expired, maxQueueWait int64
+	failing := []*btrzaws.BetterezInstance{}
+	var failingLock sync.Mutex
+	var workersGroup sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		workersGroup.Add(1)
+		go func() {
+			defer workersGroup.Done()
+			for instance := range queue {
+				dequeueTime := ic.clock.Now()
+				queueWait := int64(dequeueTime.Sub(stats.CycleStart))
+				for {
+					currentMax := atomic.LoadInt64(&maxQueueWait)
+					if queueWait <= currentMax || atomic.CompareAndSwapInt64(&maxQueueWait, currentMax, queueWait) {
+						break
+					}
+				}
+				if dequeueTime.After(deadline) {
+					atomic.AddInt64(&expired, 1)
+					continue
+				}
+				instanceChecked, instanceFailing := ic.checkInstance(instance)
+				if instanceChecked {
+					atomic.AddInt64(&checked, 1)
+				} else {
+					atomic.AddInt64(&skipped, 1)
+				}
+				if instanceFailing {
+					failingLock.Lock()
+					failing = append(failing, instance)
+					failingLock.Unlock()
+				}
 			}
-		}
-		if instanceIsFaulty {
-			ic.handleFaultyInstance(instance)
-		}
+		}()
 	}
+	workersGroup.Wait()
+	stats.Duration = ic.clock.Now().Sub(stats.CycleStart)
+	stats.InstancesChecked = int(checked)
+	stats.InstancesSkipped = int(skipped)
+	stats.InstancesExpired = int(expired)
+	stats.MaxQueueWait = time.Duration(maxQueueWait)
+	ic.recordScanStatistics(stats)
+	return failing
+}
+
+func (ic *InstancesChecker) recordScanStatistics(stats ScanStatistics) {
+	ic.lastScanStatistics = stats
+	logging.RecordLogLine(fmt.Sprintf("  scan  duration = %v  workers = %d  queued = %d  checked = %d  skipped = %d  expired = %d  max_queue_wait = %v  ",
+		stats.Duration, stats.Workers, stats.InstancesQueued, stats.InstancesChecked,
+		stats.InstancesSkipped, stats.InstancesExpired, stats.MaxQueueWait))
+	if stats.InstancesExpired > 0 {
+		logging.RecordLogLine(fmt.Sprintf("warning: %d instances were not checked before the %v cycle deadline",
+			stats.InstancesExpired, ic.config().ScanCycleDeadline))
+	}
+}
+
+// checkInstance - check a single instance and handle the result. checked is false if the check was skipped,
+// failing is true when the instance failed its healthcheck, it's remediated once the whole cycle was checked
+func (ic *InstancesChecker) checkInstance(instance *btrzaws.BetterezInstance) (checked, failing bool) {
+	if ic.instanceShouldSkipChecking(instance) {
+		return false, false
+	}
+	ok, err := instance.CheckInstanceHealth()
+	if err != nil || !ok {
+		logging.RecordLogLine(fmt.Sprintf("warning: error %v while checking instance %s! Fault counted.", err, instance.GetQualifiedID()))
+		ic.handleFaultyInstance(instance)
+		return true, true
+	}
+	configurations := ic.config()
+	latencyLevel := instance.ApplyLatencyThresholds(configurations.LatencyWarnThreshold,
+		configurations.LatencyCriticalThreshold)
+	if latencyLevel != btrzaws.LatencyNormal {
+		ic.handleDegradedInstance(instance, latencyLevel)
+	} else {
+		ic.handleWorkingInstance(instance)
+	}
+	return true, false
 }
 
 func (ic *InstancesChecker) wasInstanceFaulty(instance *btrzaws.BetterezInstance) bool {
-	return ic.faultyInstances[instance.InstanceID] > 0
+	return ic.faultyInstances.get(instance.InstanceID) > 0
 }
 
 func (ic *InstancesChecker) resetRestartCounterForInstance(instance *btrzaws.BetterezInstance) {
-	ic.restartingInstances[instance.InstanceID] = restartCounter{
-		countingPoint:     0,
-		restartCheckpoint: time.Now(),
-	}
+	ic.restartedServicesCounterMap.set(instance.InstanceID, 0, ic.clock.Now())
 }
 
 func (ic *InstancesChecker) setInstanceAsHealthy(instance *btrzaws.BetterezInstance) {
-	ic.faultyInstances[instance.InstanceID] = 0
+	ic.clearInstanceFaults(instance)
+	ic.incidents.resolve(instance.InstanceID, "healthcheck passed")
+}
+
+// clearInstanceFaults - the instance answers its healthcheck, it's not failing or remediated anymore
+func (ic *InstancesChecker) clearInstanceFaults(instance *btrzaws.BetterezInstance) {
+	ic.faultyInstances.reset(instance.InstanceID)
+	ic.hostKeyMismatches.clear(instance.InstanceID)
+	ic.guardrailBlocks.clear(instance.InstanceID)
+	ic.guardrails.release(instance.InstanceID)
+	ic.policiesProgress.clear(instance.InstanceID)
 }
 
 func (ic *InstancesChecker) handleWorkingInstance(instance *btrzaws.BetterezInstance) {
 	if ic.wasInstanceFaulty(instance) {
-		logging.RecordLogLine(fmt.Sprintf("info: Service %s on %s is back to normal.", instance.Repository, instance.InstanceID))
+		logging.RecordLogLine(fmt.Sprintf("info: Service %s on %s is back to normal.", instance.Repository, instance.GetQualifiedID()))
 	}
-	if ic.restartedServicesCounterMap[instance.InstanceID].countingPoint > 0 &&
-		ic.restartedServicesCounterMap[instance.InstanceID].restartCheckpoint.Before(time.Now()) {
-		logging.RecordLogLine(fmt.Sprintf("info: Clearing Service %s on %s notification counter.", instance.Repository, instance.InstanceID))
+	restartedServicesCounter := ic.restartedServicesCounterMap.get(instance.InstanceID)
+	if restartedServicesCounter.countingPoint > 0 &&
+		restartedServicesCounter.restartCheckpoint.Before(ic.clock.Now()) {
+		logging.RecordLogLine(fmt.Sprintf("info: Clearing Service %s on %s notification counter.", instance.Repository, instance.GetQualifiedID()))
 		ic.resetRestartCounterForInstance(instance)
 	}
 	ic.setInstanceAsHealthy(instance)
+	ic.degradedInstances.clear(instance.InstanceID)
+}
+
+// handleDegradedInstance - slow instances are reported, and alerted on when critical, but never restarted.
+// a critical latency keeps the instance incident open, with the alert, until the instance is back to normal
+func (ic *InstancesChecker) handleDegradedInstance(instance *btrzaws.BetterezInstance, latencyLevel int) {
+	if ic.wasInstanceFaulty(instance) {
+		logging.RecordLogLine(fmt.Sprintf("info: Service %s on %s is responding again.", instance.Repository, instance.GetQualifiedID()))
+	}
+	logging.RecordLogLine(fmt.Sprintf("warning: Instance %s (%s) is degraded, %s.",
+		instance.GetQualifiedID(), instance.Repository, instance.ServiceStatusErrorCode))
+	if latencyLevel != btrzaws.LatencyCritical {
+		ic.setInstanceAsHealthy(instance)
+		return
+	}
+	ic.clearInstanceFaults(instance)
+	ic.incidents.recordCheck(instance, fmt.Sprintf("response time above critical threshold %s", ic.config().LatencyCriticalThreshold))
+	if ic.degradedInstances.set(instance.InstanceID) && !ic.dryRunRecorded(instance, NotifyDegraded, "critical latency") {
+		notifyInstanceDegradedStatus(instance, ic.notifications)
+		ic.incidents.recordNotification(instance, "degraded alert sent")
+	}
 }
 
 func (ic *InstancesChecker) increaseInstanceFaultCount(instance *btrzaws.BetterezInstance) {
-	ic.faultyInstances[instance.InstanceID] = ic.faultyInstances[instance.InstanceID] + 1
+	ic.faultyInstances.increase(instance.InstanceID)
 }
 
 func (ic *InstancesChecker) recordFailureWarning(instance *btrzaws.BetterezInstance) {
 	logging.RecordLogLine(fmt.Sprintf("warning: Instance %s (%s) failed healthcheck, %d failure count.",
-		instance.InstanceID, instance.Repository,
-		ic.faultyInstances[instance.InstanceID]))
+		instance.GetQualifiedID(), instance.Repository,
+		ic.faultyInstances.get(instance.InstanceID)))
 }
 
 func (ic *InstancesChecker) increaseInstanceRestartCounter(instance *btrzaws.BetterezInstance) {
-	ic.restartedServicesCounterMap[instance.InstanceID] = restartCounter{
-		countingPoint:     ic.restartedServicesCounterMap[instance.InstanceID].countingPoint + 1,
-		restartCheckpoint: time.Now().Add(time.Hour * 1),
-	}
+	ic.restartedServicesCounterMap.increase(instance.InstanceID, ic.clock.Now().Add(ic.config().NotificationResetDuration))
 }
 
 func (ic *InstancesChecker) setInstanceRestartCounter(instance *btrzaws.BetterezInstance) {
-	ic.restartingInstances[instance.InstanceID] = restartCounter{
-		countingPoint:     1,
-		restartCheckpoint: time.Now().Add(HardRestartDuration),
-	}
+	ic.restartingInstances.set(instance.InstanceID, 1, ic.clock.Now().Add(ic.config().HardRestartDuration))
 }
 
 func (ic *InstancesChecker) restartInstance(instance *btrzaws.BetterezInstance) {
-	logging.RecordLogLine(fmt.Sprintf("fatal: server %s (%s) is out, restarting", instance.InstanceID, instance.Repository))
-	err := instance.RestartService()
+	if ic.restartJobs.isRestarting(instance.InstanceID) {
+		logging.RecordLogLine(fmt.Sprintf("info: server %s is already restarting", instance.GetQualifiedID()))
+		return
+	}
+	if ic.dryRunRecorded(instance, btrzaws.ActionRestartService, "default escalation") {
+		ic.restartingInstances.set(instance.InstanceID, 1, ic.clock.Now().Add(ic.config().SoftRestartDuration))
+		return
+	}
+	logging.RecordLogLine(fmt.Sprintf("fatal: server %s (%s) is out, restarting", instance.GetQualifiedID(), instance.Repository))
+	err := ic.restartService(instance)
+	if btrzaws.IsHostKeyRejected(err) {
+		return
+	}
 	if err != nil {
 		if instance.ShouldTerminateOnFault() {
-			logging.RecordLogLine("Server %s is marked for termination. Terminating")
-			instance.TerminateInstance()
+			logging.RecordLogLine(fmt.Sprintf("Server %s is marked for termination. Terminating", instance.GetQualifiedID()))
+			ic.terminateInstance(instance)
 			return
 		}
 		logging.RecordLogLine(fmt.Sprintf("fatal: error %v while restarting the service on %s (%s). Performing full restart!",
-			err, instance.InstanceID, instance.Repository))
-		instance.RestartServer()
+			err, instance.GetQualifiedID(), instance.Repository))
+		if err = ic.restartServer(instance); err != nil {
+			logging.RecordLogLine(fmt.Sprintf("error: %v while restarting server %s", err, instance.GetQualifiedID()))
+		}
 		ic.setInstanceRestartCounter(instance)
 	} else {
 		logging.RecordLogLine(fmt.Sprintf("info: service %s (on %s) restarted.",
 			instance.Repository,
-			instance.InstanceID))
-		ic.restartingInstances[instance.InstanceID] = restartCounter{
-			countingPoint:     1,
-			restartCheckpoint: time.Now().Add(SoftRestartDuration),
+			instance.GetQualifiedID()))
+		ic.restartingInstances.set(instance.InstanceID, 1, ic.clock.Now().Add(ic.config().SoftRestartDuration))
+	}
+}
+
+// restartService - restart the instance service after collecting its diagnostics, the result is kept with the incident.
+// remediation is blocked when the host key doesn't match or can't be verified
+func (ic *InstancesChecker) restartService(instance *btrzaws.BetterezInstance) error {
+	err := ic.collectDiagnostics(instance)
+	if !btrzaws.IsHostKeyRejected(err) {
+		var result *btrzaws.CommandResult
+		result, err = ic.serviceRestarter(instance)
+		if result != nil {
+			ic.incidents.recordCommand(instance, *result)
 		}
 	}
+	if btrzaws.IsHostKeyRejected(err) {
+		ic.blockRemediation(instance, err)
+	} else if err != nil {
+		ic.incidents.recordAction(instance, fmt.Sprintf("service restart failed: %v", err))
+	} else {
+		ic.incidents.recordAction(instance, "service restarted")
+	}
+	return err
+}
+
+// restartServer - stop and start the instance, followed as a restart job kept with the incident
+func (ic *InstancesChecker) restartServer(instance *btrzaws.BetterezInstance) error {
+	job, err := ic.restartJobs.start(instance)
+	if err != nil {
+		ic.incidents.recordAction(instance, fmt.Sprintf("server restart failed: %v", err))
+		return err
+	}
+	ic.incidents.recordAction(instance, fmt.Sprintf("server restart %s started", job.ID))
+	return nil
+}
+
+// collectDiagnostics - save the diagnostics bundle of the instance with its incident, when enabled.
+// the restart goes on without diagnostics unless the host key was rejected
+func (ic *InstancesChecker) collectDiagnostics(instance *btrzaws.BetterezInstance) error {
+	settings := ic.config().Diagnostics
+	if !settings.Enabled {
+		return nil
+	}
+	bundle, err := ic.diagnosticsCollector(instance)
+	if bundle == nil {
+		logging.RecordLogLine(fmt.Sprintf("warning: %v while collecting the diagnostics of %s", err, instance.GetQualifiedID()))
+		return err
+	}
+	if err = btrzaws.SaveDiagnosticsBundle(bundle, settings.Directory, settings.BundlesKept); err != nil {
+		logging.RecordLogLine(fmt.Sprintf("error: %v while saving the diagnostics of %s", err, instance.GetQualifiedID()))
+		return nil
+	}
+	ic.incidents.recordDiagnostics(instance, bundle)
+	return nil
+}
+
+// blockRemediation - the ssh host key of the instance mismatched or couldn't be verified,
+// it's left alone and an alert is sent once
+func (ic *InstancesChecker) blockRemediation(instance *btrzaws.BetterezInstance, err error) {
+	logging.RecordLogLine(fmt.Sprintf("fatal: %v, remediation of %s (%s) blocked", err, instance.GetQualifiedID(), instance.Repository))
+	instance.ServiceStatusErrorCode = err.Error()
+	ic.incidents.recordEvent(instance, EventAction, fmt.Sprintf("remediation blocked: %v", err))
+	if ic.hostKeyMismatches.set(instance.InstanceID) && !ic.dryRunRecorded(instance, NotifyHostKeyMismatch, err.Error()) {
+		notifyHostKeyMismatch(instance, ic.notifications)
+		ic.incidents.recordNotification(instance, "host key rejected alert sent")
+	}
+}
+
+// escalateRestart - the server restart didn't complete in time, notify
+func (ic *InstancesChecker) escalateRestart(job RestartJob, instance *btrzaws.BetterezInstance) {
+	logging.RecordLogLine(fmt.Sprintf("fatal: server %s (%s) restart escalated, %s", job.QualifiedID, job.Repository, job.Error))
+	instance.ServiceStatusErrorCode = job.Error
+	ic.incidents.recordAction(instance, fmt.Sprintf("server restart %s escalated: %s", job.ID, job.Error))
+	if !ic.dryRunRecorded(instance, btrzaws.ActionNotify, "restart escalated") {
+		notifyInstaneFailureStatus(instance, ic.notifications)
+		ic.incidents.recordNotification(instance, "failure notice sent, server restart escalated")
+	}
+}
+
+// restartFinished - the restart is kept with the instance incident,
+// a healthy server is checked again without waiting for the hard restart window
+func (ic *InstancesChecker) restartFinished(job RestartJob) {
+	ic.incidents.recordRestart(job)
+	if job.State == RestartJobHealthy {
+		ic.restartingInstances.set(job.InstanceID, 0, ic.clock.Now())
+	}
+}
+
+// GetIncidents - the open and recently resolved incidents, of the instances and correlated
+func (ic *InstancesChecker) GetIncidents() IncidentsResponse {
+	response := ic.incidents.getIncidents()
+	response.Correlated, response.CorrelatedResolved = ic.correlations.getIncidents()
+	return response
+}
+
+// GetIncident - the open or recently resolved incident with its timeline
+func (ic *InstancesChecker) GetIncident(id string) (*Incident, bool) {
+	return ic.incidents.getIncident(id)
+}
+
+// AcknowledgeIncident - mark the open incident as taken, the note is added to its timeline
+func (ic *InstancesChecker) AcknowledgeIncident(id, note string) (*Incident, error) {
+	incident, err := ic.incidents.acknowledge(id, note)
+	if err == nil {
+		logging.RecordLogLine(fmt.Sprintf("info: incident %s on %s acknowledged  note = %q", incident.ID, incident.QualifiedID, note))
+	}
+	return incident, err
+}
+
+// GetDiagnosticsBundle - the json of a saved diagnostics bundle
+func (ic *InstancesChecker) GetDiagnosticsBundle(id string) ([]byte, error) {
+	return btrzaws.LoadDiagnosticsBundle(ic.config().Diagnostics.Directory, id)
+}
+
+// replaceInstance - mark the instance unhealthy so its auto scaling group replaces it, terminate it when that fails
+func (ic *InstancesChecker) replaceInstance(instance *btrzaws.BetterezInstance) {
+	if ic.dryRunRecorded(instance, btrzaws.ActionMarkUnhealthy, "default escalation") {
+		return
+	}
+	replacement, err := ic.groupReplacements.start(instance)
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("error: %v while marking %s unhealthy, terminating", err, instance.GetQualifiedID()))
+		ic.incidents.recordAction(instance, fmt.Sprintf("marking unhealthy failed: %v", err))
+		ic.terminateInstance(instance)
+		return
+	}
+	ic.incidents.recordAction(instance, fmt.Sprintf("marked unhealthy in auto scaling group %s", replacement.Group))
+}
+
+// alertGroupUnderCapacity - the group didn't get back to its desired capacity in time, notify
+func (ic *InstancesChecker) alertGroupUnderCapacity(replacement GroupReplacement, instance *btrzaws.BetterezInstance) {
+	if !ic.dryRunRecorded(instance, NotifyUnderCapacity,
+		fmt.Sprintf("%d healthy instances of %d", replacement.Healthy, replacement.Desired)) {
+		notifyGroupUnderCapacity(instance, replacement.Healthy, replacement.Desired, ic.notifications)
+		ic.incidents.recordGroupNotification(instance.GetLocation(), replacement.Group, instance.Repository,
+			fmt.Sprintf("under capacity alert sent, %d healthy instances of %d after marking %s unhealthy",
+				replacement.Healthy, replacement.Desired, replacement.QualifiedID))
+	}
+}
+
+// groupReplacementFinished - the group incident, if the replacement opened one, is closed
+func (ic *InstancesChecker) groupReplacementFinished(replacement GroupReplacement, instance *btrzaws.BetterezInstance) {
+	ic.incidents.resolve(groupIncidentKey(instance.GetLocation(), replacement.Group),
+		fmt.Sprintf("replacement of %s ended %s, %d healthy instances of %d", replacement.QualifiedID, replacement.State,
+			replacement.Healthy, replacement.Desired))
+}
+
+// GetGroupReplacements - the followed and recently completed auto scaling group replacements
+func (ic *InstancesChecker) GetGroupReplacements() GroupReplacementsResponse {
+	return ic.groupReplacements.getReplacements()
+}
+
+// GetRestartJobs - the in flight and recently completed server restarts
+func (ic *InstancesChecker) GetRestartJobs() RestartJobsResponse {
+	return ic.restartJobs.getJobs()
+}
+
+// terminateInstance - terminate the instance, the outcome is kept with the incident
+func (ic *InstancesChecker) terminateInstance(instance *btrzaws.BetterezInstance) error {
+	if ic.dryRunRecorded(instance, btrzaws.ActionTerminate, "default escalation") {
+		return nil
+	}
+	if err := instance.TerminateInstance(); err != nil {
+		logging.RecordLogLine(fmt.Sprintf("error: %v while terminating %s", err, instance.GetQualifiedID()))
+		ic.incidents.recordAction(instance, fmt.Sprintf("termination failed: %v", err))
+		return err
+	}
+	ic.incidents.recordAction(instance, "terminated")
+	return nil
 }
 
 func (ic *InstancesChecker) handleFaultyInstance(instance *btrzaws.BetterezInstance) {
+	ic.degradedInstances.clear(instance.InstanceID)
 	ic.increaseInstanceFaultCount(instance)
 	ic.recordFailureWarning(instance)
-	if ic.faultyInstances[instance.InstanceID] > RestartThreshold {
+	ic.incidents.recordCheck(instance, strings.TrimSuffix("healthcheck failed: "+instance.ServiceStatusErrorCode, ": "))
+}
+
+// remediateFailingInstances - once every instance of the cycle was checked, the failures are correlated
+// and the instances failing on their own are remediated in the background
+func (ic *InstancesChecker) remediateFailingInstances(failing []*btrzaws.BetterezInstance) {
+	for _, instance := range failing {
+		if ic.correlatedFailure(instance) {
+			continue
+		}
+		if ic.hostKeyMismatches.isSet(instance.InstanceID) {
+			logging.RecordLogLine(fmt.Sprintf("info: remediation of %s blocked by a rejected ssh host key", instance.GetQualifiedID()))
+			continue
+		}
+		// the scan publishes the instance, the remediation works on its own copy
+		instanceCopy := *instance
+		ic.remediations.start(instance.InstanceID, func() {
+			ic.remediate(&instanceCopy)
+		})
+	}
+}
+
+// remediate - apply the instance remediation policy, or the default escalation, in the background
+func (ic *InstancesChecker) remediate(instance *btrzaws.BetterezInstance) {
+	configurations := ic.config()
+	policy, err := btrzaws.SelectRemediationPolicy(configurations.RemediationPolicies, instance)
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("warning: %v on %s, using the default escalation", err, instance.GetQualifiedID()))
+	}
+	if policy != nil {
+		ic.applyRemediationPolicy(instance, policy)
+		return
+	}
+	if ic.faultyInstances.get(instance.InstanceID) > configurations.RestartThreshold {
+		if !ic.remediationAllowed(instance, "restart") {
+			return
+		}
+		restartsCount := ic.restartedServicesCounterMap.get(instance.InstanceID).countingPoint
 		logging.RecordLogLine(fmt.Sprintf("info: %d restarts out of %d before notifying",
-			ic.restartedServicesCounterMap[instance.InstanceID].countingPoint, ReportingThreshold))
-		if ic.restartedServicesCounterMap[instance.InstanceID].countingPoint >= ReportingThreshold {
+			restartsCount, configurations.ReportingThreshold))
+		if restartsCount >= configurations.ReportingThreshold {
 			if instance.IsInstanceOnAutoScalingGroup() {
-				logging.RecordLogLine(fmt.Sprintf("Terminating %s. it's on a scaling group. no notification will be sent", instance.InstanceID))
-				instance.TerminateInstance()
-			} else {
-				notifyInstaneFailureStatus(instance, ic.sess)
+				if configurations.MarkASGUnhealthy {
+					logging.RecordLogLine(fmt.Sprintf("Marking %s unhealthy. it's on a scaling group. no notification will be sent", instance.GetQualifiedID()))
+					ic.replaceInstance(instance)
+					return
+				}
+				logging.RecordLogLine(fmt.Sprintf("Terminating %s. it's on a scaling group. no notification will be sent", instance.GetQualifiedID()))
+				ic.terminateInstance(instance)
+			} else if !ic.dryRunRecorded(instance, btrzaws.ActionNotify, "reporting threshold reached") {
+				notifyInstaneFailureStatus(instance, ic.notifications)
+				ic.incidents.recordNotification(instance, "failure notice sent")
 			}
 		}
 		ic.increaseInstanceRestartCounter(instance)
 		ic.restartInstance(instance)
 	}
 }
+
+// remediationAllowed - count the action against the guardrails. a blocked instance is left to notifications,
+// with a single alert until it's healthy again. dry run actions are checked but not counted,
+// they don't take the slots and the budget of the real remediations
+func (ic *InstancesChecker) remediationAllowed(instance *btrzaws.BetterezInstance, action string) bool {
+	configurations := ic.config()
+	var err error
+	if ic.isDryRun(instance) {
+		err = ic.guardrails.check(instance, configurations.Guardrails, ic.isInstanceHealthy)
+	} else {
+		err = ic.guardrails.admit(instance, configurations.Guardrails, configurations.HardRestartDuration, ic.isInstanceHealthy)
+	}
+	if err == nil {
+		ic.guardrailBlocks.clear(instance.InstanceID)
+		return true
+	}
+	logging.RecordLogLine(fmt.Sprintf("fatal: guardrail: %v, %s of %s (%s) blocked, notify only",
+		err, action, instance.GetQualifiedID(), instance.Repository))
+	ic.incidents.recordEvent(instance, EventAction, fmt.Sprintf("%s blocked by a guardrail, notify only: %v", action, err))
+	if ic.guardrailBlocks.set(instance.InstanceID) && !ic.dryRunRecorded(instance, NotifyRemediationBlocked, err.Error()) {
+		notifyRemediationBlocked(instance, err.Error(), ic.notifications)
+		ic.incidents.recordNotification(instance, "remediation blocked alert sent")
+	}
+	return false
+}
+
+// isInstanceHealthy - the instance passed its last healthcheck and isn't restarting or being replaced
+func (ic *InstancesChecker) isInstanceHealthy(instanceID string) bool {
+	return ic.faultyInstances.get(instanceID) == 0 && !ic.restartJobs.isRestarting(instanceID) &&
+		!ic.groupReplacements.isReplacing(instanceID) &&
+		!isThisInstanceStillStarting(instanceID, ic.restartingInstances, ic.clock.Now())
+}
+
+// isInstanceFailing - the instance failed its last healthcheck
+func (ic *InstancesChecker) isInstanceFailing(instanceID string) bool {
+	return ic.faultyInstances.get(instanceID) > 0
+}
+
+// correlatedFailure - true when the instance fails together with enough dependents of one of its dependencies.
+// a single alert is sent for the correlated incident, and the instance isn't remediated while it's open
+func (ic *InstancesChecker) correlatedFailure(instance *btrzaws.BetterezInstance) bool {
+	incident, opened := ic.correlations.correlate(instance.InstanceID, ic.config().Correlation, ic.isInstanceFailing)
+	if incident == nil {
+		return false
+	}
+	if opened {
+		logging.RecordLogLine(fmt.Sprintf("fatal: %d of %d instances depending on %s are failing (%s), likely root cause %s, remediation suppressed",
+			len(incident.Failing), incident.Dependents, incident.Dependency, strings.Join(incident.Repositories, ", "), incident.Dependency))
+		if !ic.dryRunRecorded(instance, NotifyCorrelatedFailure, incident.Dependency) {
+			notifyCorrelatedFailure(incident, ic.notifications)
+			ic.incidents.recordNotification(instance, fmt.Sprintf("correlated failure alert sent for %s", incident.Dependency))
+		}
+	}
+	ic.incidents.recordCheck(instance, fmt.Sprintf("failure correlated with %s, remediation suppressed", incident.Dependency))
+	logging.RecordLogLine(fmt.Sprintf("info: failure of %s correlated with %s, remediation suppressed",
+		instance.GetQualifiedID(), incident.Dependency))
+	return true
+}
+
+// resolveCorrelatedIncidents - close the correlated incidents without enough failing dependents anymore
+func (ic *InstancesChecker) resolveCorrelatedIncidents() {
+	for _, incident := range ic.correlations.resolve(ic.config().Correlation, ic.isInstanceFailing) {
+		logging.RecordLogLine(fmt.Sprintf("info: correlated incident %s resolved, %d instances depending on %s still failing",
+			incident.ID, len(incident.Failing), incident.Dependency))
+	}
+}
@@ -0,0 +1,231 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func createFleetInstance(t *testing.T, instanceID, serverAddress string) *btrzaws.BetterezInstance {
+	host, portValue, err := net.SplitHostPort(serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portValue)
+	return &btrzaws.BetterezInstance{
+		InstanceID:       instanceID,
+		Repository:       "fleet-api",
+		PrivateIPAddress: host,
+		PathName:         "/",
+		HealthcheckPath:  "healthcheck",
+		HelthcheckPort:   port,
+		AwsInstance: &ec2.Instance{
+			InstanceId: aws.String(instanceID),
+			LaunchTime: aws.Time(time.Now().Add(-time.Hour)),
+		},
+	}
+}
+
+func TestConcurrentScan(t *testing.T) {
+	const checkDuration = 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(checkDuration)
+	}))
+	defer server.Close()
+	checker := &InstancesChecker{}
+	checker.Configurations.MaxConcurrentChecks = 8
+	checker.initChecker(nil)
+	for index := 0; index < 16; index++ {
+		checker.tempCheckedInstances = append(checker.tempCheckedInstances,
+			createFleetInstance(t, fmt.Sprintf("i-%d", index), server.Listener.Addr().String()))
+	}
+	checker.scanInstances()
+	stats := checker.lastScanStatistics
+	if stats.InstancesChecked != 16 || stats.InstancesQueued != 16 || stats.Workers != 8 {
+		t.Fatalf("bad statistics %+v", stats)
+	}
+	if stats.Duration >= 16*checkDuration/2 {
+		t.Fatalf("scan was not concurrent, took %v", stats.Duration)
+	}
+}
+
+func TestScanDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	checker := &InstancesChecker{}
+	checker.Configurations.MaxConcurrentChecks = 1
+	checker.Configurations.ScanCycleDeadline = 150 * time.Millisecond
+	checker.initChecker(nil)
+	for index := 0; index < 5; index++ {
+		checker.tempCheckedInstances = append(checker.tempCheckedInstances,
+			createFleetInstance(t, fmt.Sprintf("i-%d", index), server.Listener.Addr().String()))
+	}
+	checker.scanInstances()
+	stats := checker.lastScanStatistics
+	if stats.InstancesExpired == 0 || stats.InstancesChecked+stats.InstancesExpired != 5 {
+		t.Fatalf("bad statistics %+v", stats)
+	}
+}
+
+func createTaggedInstance(instanceID string, tags map[string]string) *ec2.Instance {
+	instance := &ec2.Instance{InstanceId: aws.String(instanceID), LaunchTime: aws.Time(time.Now().Add(-time.Hour))}
+	for key, value := range tags {
+		instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return instance
+}
+
+func TestSelectInstances(t *testing.T) {
+	selector := &btrzaws.DiscoverySelector{
+		Name:    "workers",
+		Filters: map[string][]string{"tag:Service-Type": {"worker"}},
+		Exclude: map[string][]string{"Repository": {"btrz-legacy-worker"}},
+	}
+	reservations := []*ec2.Reservation{
+		{Instances: []*ec2.Instance{
+			createTaggedInstance("i-worker", map[string]string{"Repository": "btrz-worker-loader"}),
+			createTaggedInstance("i-legacy", map[string]string{"Repository": "btrz-legacy-worker"}),
+			createTaggedInstance("i-opted-out", map[string]string{"Repository": "btrz-worker-loader", "Monitor": "no"}),
+		}},
+		{Instances: []*ec2.Instance{
+			createTaggedInstance("i-seen", map[string]string{"Repository": "btrz-api-sales"}),
+		}},
+	}
+	seenInstances := map[string]bool{"i-seen": true}
+	instances := selectInstances(selector, reservations, seenInstances, btrzaws.DefaultHealthcheckRoutes())
+	if len(instances) != 1 || instances[0].InstanceID != "i-worker" {
+		t.Fatalf("expected only i-worker, got %d instances", len(instances))
+	}
+	if !seenInstances["i-worker"] {
+		t.Fatal("selected instances should be marked as seen")
+	}
+	if instances[0].HealthcheckEndpoint == nil {
+		t.Fatal("healthcheck endpoint was not resolved")
+	}
+	tags := selector.GetTags("sandbox")
+	if len(tags) != 3 || tags[0].TagValues[0] != "sandbox" || tags[2].TagName != "tag:Service-Type" {
+		t.Fatal("bad selector tags")
+	}
+}
+
+const describeInstancesResponse = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+<reservationSet><item><instancesSet><item>
+<instanceId>i-canada</instanceId>
+<tagSet><item><key>Repository</key><value>btrz-api-sales</value></item></tagSet>
+</item></instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`
+
+// createLocalTarget - an account region target served by a local ec2 endpoint
+func createLocalTarget(t *testing.T, account *btrzaws.AccountProfile, region, endpoint string,
+	stsClient stscreds.AssumeRoler) *btrzaws.MonitoringTarget {
+	target, err := btrzaws.CreateMonitoringTarget(account, region, stsClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Session.Config.Endpoint = aws.String(endpoint)
+	target.Session.Config.MaxRetries = aws.Int(0)
+	if account.RoleARN == "" {
+		target.Session.Config.Credentials = credentials.NewStaticCredentials("id", "secret", "")
+	}
+	target.Clients = btrzaws.NewAWSClients(target.Session)
+	return target
+}
+
+func TestLoadInstancesFromRegions(t *testing.T) {
+	workingRegion := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, describeInstancesResponse)
+	}))
+	defer workingRegion.Close()
+	failingRegion := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingRegion.Close()
+
+	checker := &InstancesChecker{}
+	checker.Configurations.Regions = []string{"us-east-1", "ca-central-1"}
+	checker.initChecker(nil)
+	account := checker.Configurations.Accounts[0]
+	checker.targets["default/us-east-1"] = createLocalTarget(t, account, "us-east-1", failingRegion.URL, nil)
+	checker.targets["default/ca-central-1"] = createLocalTarget(t, account, "ca-central-1", workingRegion.URL, nil)
+	instances, err := checker.loadInstancesFromAWS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].GetQualifiedID() != "default/ca-central-1/i-canada" {
+		t.Fatalf("expected only default/ca-central-1/i-canada, got %d instances", len(instances))
+	}
+	if instances[0].Target != checker.targets["default/ca-central-1"] {
+		t.Fatal("instance should keep the target it was discovered in")
+	}
+
+	checker.targets["default/ca-central-1"] = createLocalTarget(t, account, "ca-central-1", failingRegion.URL, nil)
+	if _, err = checker.loadInstancesFromAWS(); err == nil {
+		t.Fatal("expected an error when all the regions fail")
+	}
+}
+
+// fakeSTS - hands out credentials named after the assumed role
+type fakeSTS struct {
+	calls int32
+}
+
+func (client *fakeSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	atomic.AddInt32(&client.calls, 1)
+	roleName := aws.StringValue(input.RoleArn)
+	roleName = roleName[strings.LastIndex(roleName, "/")+1:]
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("KEY-" + roleName),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestLoadInstancesFromAccounts(t *testing.T) {
+	// the fake ec2 answers only the staging role credentials
+	ec2Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=KEY-monitor-staging/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, describeInstancesResponse)
+	}))
+	defer ec2Server.Close()
+
+	stsClient := &fakeSTS{}
+	checker := &InstancesChecker{stsClient: stsClient}
+	checker.Configurations.Accounts = []*btrzaws.AccountProfile{
+		{Name: "sandbox", RoleARN: "arn:aws:iam::111111111111:role/monitor-sandbox"},
+		{Name: "staging", RoleARN: "arn:aws:iam::222222222222:role/monitor-staging", Regions: []string{"ca-central-1"}},
+	}
+	checker.initChecker(nil)
+	for _, account := range checker.Configurations.Accounts {
+		region := account.GetRegions(checker.Configurations.Regions)[0]
+		checker.targets[btrzaws.GetTargetKey(account.Name, region)] = createLocalTarget(t, account, region, ec2Server.URL, stsClient)
+	}
+	instances, err := checker.loadInstancesFromAWS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Account != "staging" || instances[0].Region != "ca-central-1" {
+		t.Fatalf("expected one staging instance, got %d instances", len(instances))
+	}
+	if atomic.LoadInt32(&stsClient.calls) != 2 {
+		t.Fatalf("expected a role assumed per account, got %d", stsClient.calls)
+	}
+}
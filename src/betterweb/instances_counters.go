@@ -0,0 +1,103 @@
+package betterweb
+
+import (
+	"sync"
+	"time"
+)
+
+// faultsCounter - fault count per instance id, safe for concurrent use
+type faultsCounter struct {
+	lock     sync.Mutex
+	counters map[string]int
+}
+
+func newFaultsCounter() *faultsCounter {
+	return &faultsCounter{counters: make(map[string]int)}
+}
+
+func (fc *faultsCounter) get(instanceID string) int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.counters[instanceID]
+}
+
+func (fc *faultsCounter) increase(instanceID string) int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.counters[instanceID]++
+	return fc.counters[instanceID]
+}
+
+func (fc *faultsCounter) reset(instanceID string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.counters[instanceID] = 0
+}
+
+// instanceFlags - set of instance ids, safe for concurrent use
+type instanceFlags struct {
+	lock  sync.Mutex
+	flags map[string]bool
+}
+
+func newInstanceFlags() *instanceFlags {
+	return &instanceFlags{flags: make(map[string]bool)}
+}
+
+func (flags *instanceFlags) isSet(instanceID string) bool {
+	flags.lock.Lock()
+	defer flags.lock.Unlock()
+	return flags.flags[instanceID]
+}
+
+// set - set the flag, returns false if it was already set
+func (flags *instanceFlags) set(instanceID string) bool {
+	flags.lock.Lock()
+	defer flags.lock.Unlock()
+	if flags.flags[instanceID] {
+		return false
+	}
+	flags.flags[instanceID] = true
+	return true
+}
+
+func (flags *instanceFlags) clear(instanceID string) {
+	flags.lock.Lock()
+	defer flags.lock.Unlock()
+	delete(flags.flags, instanceID)
+}
+
+// restartCounters - restart counters per instance id, safe for concurrent use
+type restartCounters struct {
+	lock     sync.Mutex
+	counters map[string]restartCounter
+}
+
+func newRestartCounters() *restartCounters {
+	return &restartCounters{counters: make(map[string]restartCounter)}
+}
+
+func (rc *restartCounters) get(instanceID string) restartCounter {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.counters[instanceID]
+}
+
+func (rc *restartCounters) set(instanceID string, countingPoint int, restartCheckpoint time.Time) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.counters[instanceID] = restartCounter{
+		countingPoint:     countingPoint,
+		restartCheckpoint: restartCheckpoint,
+	}
+}
+
+// increase - add one to the counting point and move the checkpoint
+func (rc *restartCounters) increase(instanceID string, restartCheckpoint time.Time) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.counters[instanceID] = restartCounter{
+		countingPoint:     rc.counters[instanceID].countingPoint + 1,
+		restartCheckpoint: restartCheckpoint,
+	}
+}
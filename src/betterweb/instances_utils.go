@@ -1,23 +1,24 @@
 package betterweb
 
 import (
+	"betterconfig"
 	"btrzaws"
 	"fmt"
 	"logging"
+	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 const (
-	ReportingThreshold              = 3
-	RestartThreshold                = 3
+	ReportingThreshold              = betterconfig.DefaultReportingThreshold
+	RestartThreshold                = betterconfig.DefaultRestartThreshold
 	TestDuration                    = 8 * time.Second
-	SoftRestartDuration             = time.Second * 45
-	HardRestartDuration             = time.Minute * 7
-	NotificationResetDuration       = time.Hour * 1
+	SoftRestartDuration             = betterconfig.DefaultSoftRestartDuration
+	HardRestartDuration             = betterconfig.DefaultHardRestartDuration
+	NotificationResetDuration       = betterconfig.DefaultNotificationResetDuration
 	ServerAliveDurationNotification = time.Minute * 10
 	InitializationDuration          = HardRestartDuration
+	ClientResponseVersion           = "1.0.0.4"
 )
 
 type restartCounter struct {
@@ -25,22 +26,49 @@ type restartCounter struct {
 	countingPoint     int
 }
 
-func notifyInstaneFailureStatus(faultyInstance *btrzaws.BetterezInstance, sess *session.Session) {
-	logging.RecordLogLine(fmt.Sprintf("instance %s failure notice was sent. repo: %s", faultyInstance.InstanceID, faultyInstance.Repository))
-	btrzaws.Notify(faultyInstance, sess)
+func notifyInstaneFailureStatus(faultyInstance *btrzaws.BetterezInstance, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("instance %s failure notice was sent. repo: %s", faultyInstance.GetQualifiedID(), faultyInstance.Repository))
+	btrzaws.Notify(faultyInstance, notifications)
+}
+
+func notifyInstanceDegradedStatus(degradedInstance *btrzaws.BetterezInstance, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("instance %s degraded notice was sent. repo: %s", degradedInstance.GetQualifiedID(), degradedInstance.Repository))
+	btrzaws.NotifyDegraded(degradedInstance, notifications)
+}
+
+func notifyHostKeyMismatch(instance *btrzaws.BetterezInstance, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("instance %s host key rejected notice was sent. repo: %s", instance.GetQualifiedID(), instance.Repository))
+	btrzaws.NotifyHostKeyMismatch(instance, notifications)
+}
+
+func notifyGroupUnderCapacity(instance *btrzaws.BetterezInstance, healthy, desired int, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("group %s under capacity notice was sent. repo: %s", instance.AutoScalingGroupName, instance.Repository))
+	btrzaws.NotifyGroupUnderCapacity(instance, healthy, desired, notifications)
+}
+
+func notifyRemediationBlocked(instance *btrzaws.BetterezInstance, reason string, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("instance %s remediation blocked notice was sent. repo: %s", instance.GetQualifiedID(), instance.Repository))
+	btrzaws.NotifyRemediationBlocked(instance, reason, notifications)
+}
+
+func notifyCorrelatedFailure(incident *CorrelatedIncident, notifications btrzaws.SNSAPI) {
+	logging.RecordLogLine(fmt.Sprintf("dependency %s correlated failure notice was sent. repos: %s",
+		incident.Dependency, strings.Join(incident.Repositories, ", ")))
+	btrzaws.NotifyCorrelatedFailure(incident.Dependency, len(incident.Failing), incident.Dependents, incident.Repositories, notifications)
 }
 
-func isThisInstanceStillStarting(instanceID string, listing *map[string]restartCounter) bool {
-	if (*listing)[instanceID].countingPoint != 0 {
-		if time.Now().Before((*listing)[instanceID].restartCheckpoint) {
+func isThisInstanceStillStarting(instanceID string, listing *restartCounters, now time.Time) bool {
+	counter := listing.get(instanceID)
+	if counter.countingPoint != 0 {
+		if now.Before(counter.restartCheckpoint) {
 			return true
 		}
 	}
 	return false
 }
 
-func isThisInstanceJustCreated(instance *btrzaws.BetterezInstance) bool {
-	if (instance.AwsInstance.LaunchTime.Add(InitializationDuration)).After(time.Now()) {
+func isThisInstanceJustCreated(instance *btrzaws.BetterezInstance, initializationDuration time.Duration, now time.Time) bool {
+	if (instance.AwsInstance.LaunchTime.Add(initializationDuration)).After(now) {
 		return true
 	}
 	return false
@@ -0,0 +1,145 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"clock"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RemediationGuardrails - fleet wide limits of the remediation actions, a zero limit is not enforced
+type RemediationGuardrails struct {
+	// MaxConcurrent, MaxConcurrentPerRepository - instances under remediation at the same time, globally and per repository
+	MaxConcurrent              int
+	MaxConcurrentPerRepository int
+	// MinHealthyInstances - the failing instances of a service with fewer other healthy instances are not remediated
+	MinHealthyInstances int
+	// ActionBudget - remediation actions allowed in every ActionBudgetWindow
+	ActionBudget       int
+	ActionBudgetWindow time.Duration
+}
+
+// activeRemediation - an instance under remediation, it's counted until healthy or until the hold passed
+type activeRemediation struct {
+	repository string
+	until      time.Time
+}
+
+// remediationGuardrails - the remediations in progress and the recent actions, safe for concurrent use
+type remediationGuardrails struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	active  map[string]activeRemediation
+	actions []time.Time
+	// members - instance ids per repository, from the last discovery
+	members map[string][]string
+}
+
+func newRemediationGuardrails(guardrailsClock clock.Clock) *remediationGuardrails {
+	return &remediationGuardrails{
+		clock:   guardrailsClock,
+		active:  make(map[string]activeRemediation),
+		members: make(map[string][]string),
+	}
+}
+
+// setMembers - the discovered instances of every repository, instances that are gone aren't under remediation anymore
+func (guardrails *remediationGuardrails) setMembers(instances []*btrzaws.BetterezInstance) {
+	guardrails.lock.Lock()
+	defer guardrails.lock.Unlock()
+	guardrails.members = make(map[string][]string)
+	discovered := map[string]bool{}
+	for _, instance := range instances {
+		guardrails.members[instance.Repository] = append(guardrails.members[instance.Repository], instance.InstanceID)
+		discovered[instance.InstanceID] = true
+	}
+	for instanceID := range guardrails.active {
+		if !discovered[instanceID] {
+			delete(guardrails.active, instanceID)
+		}
+	}
+}
+
+// admit - count an action on the instance, held for the hold duration, or the guardrail that blocks it.
+// isHealthy tells whether another instance of the service is healthy
+func (guardrails *remediationGuardrails) admit(instance *btrzaws.BetterezInstance, limits RemediationGuardrails,
+	hold time.Duration, isHealthy func(instanceID string) bool) error {
+	guardrails.lock.Lock()
+	defer guardrails.lock.Unlock()
+	now := guardrails.clock.Now()
+	if err := guardrails.evaluate(now, instance, limits, isHealthy); err != nil {
+		return err
+	}
+	guardrails.active[instance.InstanceID] = activeRemediation{repository: instance.Repository, until: now.Add(hold)}
+	guardrails.actions = append(guardrails.actions, now)
+	return nil
+}
+
+// check - the guardrail that would block an action on the instance, the action isn't counted
+func (guardrails *remediationGuardrails) check(instance *btrzaws.BetterezInstance, limits RemediationGuardrails,
+	isHealthy func(instanceID string) bool) error {
+	guardrails.lock.Lock()
+	defer guardrails.lock.Unlock()
+	return guardrails.evaluate(guardrails.clock.Now(), instance, limits, isHealthy)
+}
+
+func (guardrails *remediationGuardrails) evaluate(now time.Time, instance *btrzaws.BetterezInstance,
+	limits RemediationGuardrails, isHealthy func(instanceID string) bool) error {
+	guardrails.prune(now, limits.ActionBudgetWindow)
+	_, remediating := guardrails.active[instance.InstanceID]
+	if !remediating {
+		repositoryCount := 0
+		for _, remediation := range guardrails.active {
+			if remediation.repository == instance.Repository {
+				repositoryCount++
+			}
+		}
+		if limits.MaxConcurrent > 0 && len(guardrails.active) >= limits.MaxConcurrent {
+			return fmt.Errorf("%d instances already under remediation, the limit is %d", len(guardrails.active), limits.MaxConcurrent)
+		}
+		if limits.MaxConcurrentPerRepository > 0 && repositoryCount >= limits.MaxConcurrentPerRepository {
+			return fmt.Errorf("%d %s instances already under remediation, the limit is %d",
+				repositoryCount, instance.Repository, limits.MaxConcurrentPerRepository)
+		}
+	}
+	if limits.MinHealthyInstances > 0 {
+		healthy := 0
+		for _, instanceID := range guardrails.members[instance.Repository] {
+			if _, found := guardrails.active[instanceID]; !found && instanceID != instance.InstanceID && isHealthy(instanceID) {
+				healthy++
+			}
+		}
+		if healthy < limits.MinHealthyInstances {
+			return fmt.Errorf("%d other healthy %s instances, the minimum is %d",
+				healthy, instance.Repository, limits.MinHealthyInstances)
+		}
+	}
+	if limits.ActionBudget > 0 && len(guardrails.actions) >= limits.ActionBudget {
+		return fmt.Errorf("the budget of %d remediation actions per %v is spent", limits.ActionBudget, limits.ActionBudgetWindow)
+	}
+	return nil
+}
+
+// prune - drop the remediations past their hold and the actions out of the budget window
+func (guardrails *remediationGuardrails) prune(now time.Time, window time.Duration) {
+	for instanceID, remediation := range guardrails.active {
+		if !now.Before(remediation.until) {
+			delete(guardrails.active, instanceID)
+		}
+	}
+	kept := guardrails.actions[:0]
+	for _, action := range guardrails.actions {
+		if now.Sub(action) < window {
+			kept = append(kept, action)
+		}
+	}
+	guardrails.actions = kept
+}
+
+// release - the instance is healthy, it's not under remediation anymore
+func (guardrails *remediationGuardrails) release(instanceID string) {
+	guardrails.lock.Lock()
+	defer guardrails.lock.Unlock()
+	delete(guardrails.active, instanceID)
+}
@@ -0,0 +1,141 @@
+package betterweb
+
+import (
+	"btrzaws"
+	"fmt"
+	"logging"
+	"strings"
+	"sync"
+)
+
+// policyProgress - the current step of an instance remediation policy, and the times it ran
+type policyProgress struct {
+	Policy   string
+	Step     int
+	Attempts int
+}
+
+// policiesProgress - remediation policy progress per instance id, safe for concurrent use
+type policiesProgress struct {
+	lock     sync.Mutex
+	progress map[string]policyProgress
+}
+
+func newPoliciesProgress() *policiesProgress {
+	return &policiesProgress{progress: make(map[string]policyProgress)}
+}
+
+// get - the instance progress in the policy, from the first step when it was using another policy
+func (progresses *policiesProgress) get(instanceID, policyName string) policyProgress {
+	progresses.lock.Lock()
+	defer progresses.lock.Unlock()
+	progress, found := progresses.progress[instanceID]
+	if !found || progress.Policy != policyName {
+		return policyProgress{Policy: policyName}
+	}
+	return progress
+}
+
+func (progresses *policiesProgress) set(instanceID string, progress policyProgress) {
+	progresses.lock.Lock()
+	defer progresses.lock.Unlock()
+	progresses.progress[instanceID] = progress
+}
+
+func (progresses *policiesProgress) clear(instanceID string) {
+	progresses.lock.Lock()
+	defer progresses.lock.Unlock()
+	delete(progresses.progress, instanceID)
+}
+
+// applyRemediationPolicy - run the current step of the policy once the instance failed enough checks.
+// a step is used for its attempts then the next one takes over, right away when the step failed
+func (ic *InstancesChecker) applyRemediationPolicy(instance *btrzaws.BetterezInstance, policy *btrzaws.RemediationPolicy) {
+	faults := ic.faultyInstances.get(instance.InstanceID)
+	progress := ic.policiesProgress.get(instance.InstanceID, policy.Name)
+	defer func() {
+		ic.policiesProgress.set(instance.InstanceID, progress)
+	}()
+	for progress.Step < len(policy.Steps) {
+		step := policy.Steps[progress.Step]
+		if progress.Attempts >= step.GetAttempts() {
+			progress.Step++
+			progress.Attempts = 0
+			continue
+		}
+		if faults < step.Threshold {
+			return
+		}
+		if step.Action != btrzaws.ActionNotify && !ic.remediationAllowed(instance, step.Action) {
+			return
+		}
+		progress.Attempts++
+		logging.RecordLogLine(fmt.Sprintf("fatal: server %s (%s) is out, remediation policy %s step %d: %s, attempt %d of %d",
+			instance.GetQualifiedID(), instance.Repository, policy.Name, progress.Step+1, step.Action,
+			progress.Attempts, step.GetAttempts()))
+		var err error
+		detail := strings.TrimSpace(fmt.Sprintf("policy %s step %d %s", policy.Name, progress.Step+1, step.Command))
+		if !ic.dryRunRecorded(instance, step.Action, detail) {
+			err = ic.runRemediationStep(instance, step)
+			ic.recordPolicyStep(instance, detail, step.Action, err)
+		}
+		if btrzaws.IsHostKeyRejected(err) {
+			return
+		}
+		if err == nil {
+			if step.Cooldown > 0 {
+				ic.restartingInstances.set(instance.InstanceID, 1, ic.clock.Now().Add(step.Cooldown))
+			}
+			return
+		}
+		logging.RecordLogLine(fmt.Sprintf("error: %v while running %s on %s, moving to the next step of %s",
+			err, step.Action, instance.GetQualifiedID(), policy.Name))
+		progress.Step++
+		progress.Attempts = 0
+	}
+	logging.RecordLogLine(fmt.Sprintf("warning: remediation policy %s exhausted on %s (%s), the instance is left failing",
+		policy.Name, instance.GetQualifiedID(), instance.Repository))
+}
+
+// runRemediationStep - run the step action on the instance
+func (ic *InstancesChecker) runRemediationStep(instance *btrzaws.BetterezInstance, step *btrzaws.RemediationStep) error {
+	switch step.Action {
+	case btrzaws.ActionRunCommand:
+		result, err := ic.executors.Run(instance, step.Command)
+		if result != nil {
+			ic.incidents.recordCommand(instance, *result)
+		}
+		if btrzaws.IsHostKeyRejected(err) {
+			ic.blockRemediation(instance, err)
+		}
+		return err
+	case btrzaws.ActionRestartService:
+		return ic.restartService(instance)
+	case btrzaws.ActionReboot:
+		return instance.RebootServer()
+	case btrzaws.ActionStopStart:
+		return ic.restartServer(instance)
+	case btrzaws.ActionTerminate:
+		return ic.terminateInstance(instance)
+	case btrzaws.ActionMarkUnhealthy:
+		_, err := ic.groupReplacements.start(instance)
+		return err
+	case btrzaws.ActionNotify:
+		notifyInstaneFailureStatus(instance, ic.notifications)
+		return nil
+	}
+	return fmt.Errorf("unknown remediation action %s", step.Action)
+}
+
+// recordPolicyStep - add the step outcome to the instance incident, a notify step is a notification
+func (ic *InstancesChecker) recordPolicyStep(instance *btrzaws.BetterezInstance, detail, action string, err error) {
+	if action == btrzaws.ActionNotify {
+		ic.incidents.recordNotification(instance, fmt.Sprintf("failure notice sent, %s", detail))
+		return
+	}
+	message := fmt.Sprintf("%s: %s", detail, action)
+	if err != nil {
+		message = fmt.Sprintf("%s failed: %v", message, err)
+	}
+	ic.incidents.recordAction(instance, message)
+}
@@ -0,0 +1,1160 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"clock"
+	"encoding/json"
+	"errors"
+	"fakeaws"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sshconnector"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createFakeFleet - a fleet whose instances healthcheck against the server
+func createFakeFleet(t *testing.T, server *httptest.Server, instances map[string]map[string]string) *fakeaws.Fleet {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet := fakeaws.NewFleet()
+	for instanceID, extraTags := range instances {
+		tags := map[string]string{
+			"Environment":         "production",
+			"Service-Type":        "http",
+			"Online":              "yes",
+			"Nginx-Configuration": "api",
+			"Repository":          "btrz-api-sales",
+			"Path-Name":           "/",
+			"Healtcheck-Path":     "healthcheck",
+			"Healtcheck-Port":     port,
+		}
+		for key, value := range extraTags {
+			tags[key] = value
+		}
+		fleet.AddInstance(instanceID, host, tags)
+	}
+	return fleet
+}
+
+func createFakeChecker(fleet *fakeaws.Fleet) *InstancesChecker {
+	checker := &InstancesChecker{
+		targetFactory: fleet.TargetFactory(),
+		notifications: fleet.Clients().SNS,
+		clock:         clock.NewFake(time.Now()),
+	}
+	checker.Configurations.RestartThreshold = 1
+	checker.Configurations.ReportingThreshold = 1
+	checker.initChecker(nil)
+	return checker
+}
+
+func runScanCycles(t *testing.T, checker *InstancesChecker, cycles int) {
+	for cycle := 0; cycle < cycles; cycle++ {
+		if err := checker.runScanCycle(); err != nil {
+			t.Fatal(err)
+		}
+		checker.remediations.wait()
+	}
+}
+
+func waitForCondition(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func createFailingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+}
+
+// followRestarts - advance the fake clock through the restart jobs polls until the condition holds
+func followRestarts(t *testing.T, checker *InstancesChecker, description string, condition func() bool) {
+	fakeClock := checker.clock.(*clock.Fake)
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", description)
+		}
+		if fakeClock.Sleepers() > 0 {
+			fakeClock.Advance(RestartPollInitialInterval)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// getRestartJob - the in flight job of the instance, or its latest completed one
+func getRestartJob(checker *InstancesChecker, instanceID string) *RestartJob {
+	jobs := checker.GetRestartJobs()
+	var latest *RestartJob
+	for index := range jobs.Completed {
+		if jobs.Completed[index].InstanceID == instanceID {
+			latest = &jobs.Completed[index]
+		}
+	}
+	for index := range jobs.InFlight {
+		if jobs.InFlight[index].InstanceID == instanceID {
+			latest = &jobs.InFlight[index]
+		}
+	}
+	return latest
+}
+
+func hasRestartState(checker *InstancesChecker, instanceID, state string) bool {
+	job := getRestartJob(checker, instanceID)
+	return job != nil && job.State == state
+}
+
+func TestFullRestartFlow(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	checker := createFakeChecker(fleet)
+
+	runScanCycles(t, checker, 2)
+	if fleet.CountCalls("StopInstances") != 1 || !checker.restartJobs.isRestarting("i-api") {
+		t.Fatalf("expected the server to be stopped, calls %v", fleet.GetCalls())
+	}
+	followRestarts(t, checker, "running server", func() bool { return hasRestartState(checker, "i-api", RestartJobRunning) })
+	runScanCycles(t, checker, 1)
+	if fleet.CountCalls("StopInstances") != 1 || checker.lastScanStatistics.InstancesSkipped != 1 {
+		t.Fatal("restarting servers should not be checked")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	followRestarts(t, checker, "healthy server", func() bool { return hasRestartState(checker, "i-api", RestartJobHealthy) })
+	states := []string{}
+	for _, transition := range getRestartJob(checker, "i-api").Transitions {
+		states = append(states, transition.State)
+	}
+	if strings.Join(states, ",") != "stopping,stopped,starting,running,healthy" {
+		t.Fatalf("bad transitions %v", states)
+	}
+	if fleet.CountCalls("StartInstances") != 1 {
+		t.Fatal("expected a single start")
+	}
+	runScanCycles(t, checker, 1)
+	if checker.lastScanStatistics.InstancesChecked != 1 || checker.faultyInstances.get("i-api") != 0 {
+		t.Fatal("a healthy restarted server should be checked again")
+	}
+	incidents := checker.GetIncidents()
+	if len(incidents.Open) != 0 || len(incidents.Resolved) != 1 || len(incidents.Resolved[0].Restarts) != 1 ||
+		incidents.Resolved[0].Restarts[0].State != RestartJobHealthy {
+		t.Fatalf("expected the restart in the resolved incident, got %+v", incidents)
+	}
+}
+
+func TestRestartWithNewPublicIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	fleet.SetPublicIPAddresses("i-api", "127.0.0.2", "127.0.0.1")
+	checker := createFakeChecker(fleet)
+
+	runScanCycles(t, checker, 2)
+	if fleet.CountCalls("StopInstances") != 1 {
+		t.Fatalf("the old public ip doesn't answer, expected a server restart, calls %v", fleet.GetCalls())
+	}
+	followRestarts(t, checker, "finished restart", func() bool { return !checker.restartJobs.isRestarting("i-api") })
+	if job := getRestartJob(checker, "i-api"); job.State != RestartJobHealthy || job.Escalated {
+		t.Fatalf("the restarted server answers on its new public ip, got %s %s", job.State, job.Error)
+	}
+	if len(fleet.GetMessages()) != 0 {
+		t.Fatalf("a healthy restart should not be escalated, got %v", fleet.GetMessages())
+	}
+}
+
+func TestRestartEscalation(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	checker := createFakeChecker(fleet)
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+
+	runScanCycles(t, checker, 2)
+	response := getRestartJobsResponse(t, webServer.URL, getToken(t, webServer.URL))
+	if len(response.InFlight) != 1 || response.InFlight[0].State != RestartJobStopping {
+		t.Fatalf("expected the restart in flight, got %+v", response)
+	}
+	followRestarts(t, checker, "restart timeout", func() bool { return !checker.restartJobs.isRestarting("i-api") })
+	job := getRestartJob(checker, "i-api")
+	if job.State != RestartJobTimedOut || !job.Escalated {
+		t.Fatalf("expected an escalated restart, got %s", job.State)
+	}
+	if job.Finished.Sub(job.Started) < betterconfig.DefaultRestartJobDeadline ||
+		job.Finished.Sub(job.Started) > betterconfig.DefaultRestartJobDeadline+RestartPollMaxInterval {
+		t.Fatalf("restart timed out after %v", job.Finished.Sub(job.Started))
+	}
+	if len(fleet.GetMessages()) != 1 {
+		t.Fatalf("expected an escalation message, got %v", fleet.GetMessages())
+	}
+	response = getRestartJobsResponse(t, webServer.URL, getToken(t, webServer.URL))
+	if len(response.InFlight) != 0 || len(response.Completed) != 1 {
+		t.Fatalf("expected the restart completed, got %+v", response)
+	}
+}
+
+func getRestartJobsResponse(t *testing.T, serverURL, token string) *RestartJobsResponse {
+	resp, err := http.Get(serverURL + "/restarts?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("restarts returned %d", resp.StatusCode)
+	}
+	response := &RestartJobsResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestTerminateOnFaultFlow(t *testing.T) {
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"Terminate on fault": "yes"}})
+	checker := createFakeChecker(fleet)
+
+	runScanCycles(t, checker, 2)
+	if fleet.GetState("i-api") != "shutting-down" || fleet.CountCalls("StopInstances") != 0 {
+		t.Fatalf("expected the instance to be terminated, calls %v", fleet.GetCalls())
+	}
+}
+
+func TestAutoScalingGroupReplacement(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-scaled": {"aws:autoscaling:groupName": "api-group"}})
+	fleet.SetDesiredCapacity("api-group", 1)
+	checker := createFakeChecker(fleet)
+	checker.Configurations.MarkASGUnhealthy = true
+	checker.Configurations.ASGReplacementDeadline = time.Minute
+	checker.restartedServicesCounterMap.set("i-scaled", 1, checker.clock.Now().Add(time.Hour))
+
+	runScanCycles(t, checker, 2)
+	if fleet.GetHealthStatus("i-scaled") != "Unhealthy" || fleet.CountCalls("TerminateInstances") != 0 ||
+		fleet.CountCalls("StopInstances") != 0 || !checker.groupReplacements.isReplacing("i-scaled") {
+		t.Fatalf("expected the instance marked unhealthy, calls %v", fleet.GetCalls())
+	}
+	runScanCycles(t, checker, 1)
+	if fleet.CountCalls("SetInstanceHealth") != 1 {
+		t.Fatalf("instances being replaced should not be remediated again, calls %v", fleet.GetCalls())
+	}
+	followRestarts(t, checker, "group under capacity", func() bool {
+		replacements := checker.GetGroupReplacements().InFlight
+		return len(replacements) == 1 && replacements[0].State == ReplacementUnderCapacity
+	})
+	if messages := fleet.GetMessages(); len(messages) != 1 || !strings.Contains(messages[0].Message, "0 healthy instances of 1") {
+		t.Fatalf("expected an under capacity alert, got %v", messages)
+	}
+	groupIncident := findIncident(checker.GetIncidents().Open, func(incident Incident) bool { return incident.Group == "api-group" })
+	if groupIncident == nil || groupIncident.InstanceID != "" ||
+		groupIncident.Timeline[len(groupIncident.Timeline)-1].Kind != EventNotification {
+		t.Fatalf("expected the alert on the group incident, got %+v", checker.GetIncidents().Open)
+	}
+	fleet.AddInstance("i-replacement", "10.0.0.9", map[string]string{"aws:autoscaling:groupName": "api-group"})
+	followRestarts(t, checker, "group replacement", func() bool { return len(checker.GetGroupReplacements().Completed) == 1 })
+	replacement := checker.GetGroupReplacements().Completed[0]
+	if replacement.State != ReplacementCompleted || replacement.Healthy != 1 || len(fleet.GetMessages()) != 1 {
+		t.Fatalf("bad replacement %+v", replacement)
+	}
+	if incident, _ := checker.GetIncident(groupIncident.ID); incident.State != IncidentResolved {
+		t.Fatalf("the group incident should be resolved with its replacement, got %+v", incident)
+	}
+}
+
+func findIncident(incidentsList []Incident, match func(incident Incident) bool) *Incident {
+	for index := range incidentsList {
+		if match(incidentsList[index]) {
+			return &incidentsList[index]
+		}
+	}
+	return nil
+}
+
+func TestAutoScalingGroupReplacementEnds(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	startReplacement := func(deadline time.Duration) (*fakeaws.Fleet, *InstancesChecker) {
+		fleet := createFakeFleet(t, server, map[string]map[string]string{"i-scaled": {"aws:autoscaling:groupName": "api-group"}})
+		fleet.SetDesiredCapacity("api-group", 1)
+		checker := createFakeChecker(fleet)
+		checker.Configurations.MarkASGUnhealthy = true
+		checker.Configurations.ASGReplacementDeadline = deadline
+		checker.restartedServicesCounterMap.set("i-scaled", 1, checker.clock.Now().Add(time.Hour))
+		runScanCycles(t, checker, 2)
+		if !checker.groupReplacements.isReplacing("i-scaled") {
+			t.Fatalf("expected the instance marked unhealthy, calls %v", fleet.GetCalls())
+		}
+		return fleet, checker
+	}
+
+	fleet, checker := startReplacement(time.Minute)
+	followRestarts(t, checker, "replacement given up", func() bool { return len(checker.GetGroupReplacements().Completed) == 1 })
+	checker.groupReplacements.replacementsGroup.Wait()
+	replacement := checker.GetGroupReplacements().Completed[0]
+	if replacement.State != ReplacementUnderCapacity || checker.groupReplacements.isReplacing("i-scaled") ||
+		replacement.Finished.Sub(replacement.Started) < ReplacementFollowedDeadlines*time.Minute {
+		t.Fatalf("expected the replacement to end under capacity after %d deadlines, got %+v", ReplacementFollowedDeadlines, replacement)
+	}
+	if messages := fleet.GetMessages(); len(messages) != 1 || !strings.Contains(messages[0].Message, "0 healthy instances of 1") {
+		t.Fatalf("expected a single under capacity alert, got %v", messages)
+	}
+
+	fleet, checker = startReplacement(time.Hour)
+	fleet.FailOperation("DescribeAutoScalingGroups", errors.New("auto scaling group not found"))
+	followRestarts(t, checker, "failed replacement", func() bool { return len(checker.GetGroupReplacements().Completed) == 1 })
+	checker.groupReplacements.replacementsGroup.Wait()
+	replacement = checker.GetGroupReplacements().Completed[0]
+	if replacement.State != ReplacementFailed || replacement.Errors != ReplacementMaxErrors ||
+		checker.groupReplacements.isReplacing("i-scaled") || len(fleet.GetMessages()) != 0 {
+		t.Fatalf("expected the replacement to fail after %d errors, got %+v", ReplacementMaxErrors, replacement)
+	}
+}
+
+func TestEscalationFlow(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-api":    nil,
+		"i-scaled": {"aws:autoscaling:groupName": "api-group"},
+	})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.ReportingThreshold = 2
+
+	runScanCycles(t, checker, 2)
+	followRestarts(t, checker, "servers running", func() bool {
+		return hasRestartState(checker, "i-api", RestartJobRunning) && hasRestartState(checker, "i-scaled", RestartJobRunning)
+	})
+	// the service stays down, the restarts time out and the hard restart window is over
+	followRestarts(t, checker, "restarts timeout", func() bool { return len(checker.GetRestartJobs().InFlight) == 0 })
+	if len(fleet.GetMessages()) != 2 {
+		t.Fatalf("expected the restarts escalation, got %v", fleet.GetMessages())
+	}
+	runScanCycles(t, checker, 1)
+	if fleet.CountCalls("StopInstances") != 4 {
+		t.Fatalf("expected second restarts, calls %v", fleet.GetCalls())
+	}
+	followRestarts(t, checker, "restarts timeout", func() bool { return len(checker.GetRestartJobs().InFlight) == 0 })
+	runScanCycles(t, checker, 1)
+	messages := fleet.GetMessages()
+	if len(messages) != 5 || messages[0].PhoneNumber != "+1000" {
+		t.Fatalf("expected four escalations and one failure message, got %v", messages)
+	}
+	if fleet.CountCalls("TerminateInstances i-scaled") != 1 || fleet.CountCalls("TerminateInstances i-api") != 0 {
+		t.Fatalf("only the auto scaled instance should be terminated, calls %v", fleet.GetCalls())
+	}
+}
+
+func TestRemediationAPIErrors(t *testing.T) {
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	fleet.FailOperation("StopInstances", errors.New("UnauthorizedOperation"))
+	checker := createFakeChecker(fleet)
+
+	runScanCycles(t, checker, 2)
+	if fleet.GetState("i-api") != "running" || fleet.CountCalls("StartInstances") != 0 {
+		t.Fatal("a failed stop should leave the instance alone")
+	}
+	fleet.FailOperation("DescribeInstances", errors.New("RequestLimitExceeded"))
+	if err := checker.runScanCycle(); err == nil {
+		t.Fatal("discovery errors should fail the scan cycle")
+	}
+}
+
+// advanceSleepers - keep advancing the fake clock while something sleeps on it, until stopped
+func advanceSleepers(fakeClock *clock.Fake, step time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if fakeClock.Sleepers() > 0 {
+				fakeClock.Advance(step)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestSSMServiceRestart(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-api":    {"Remediation-Executor": "ssm"},
+		"i-failed": {"Remediation-Executor": "SSM"},
+	})
+	fleet.SetCommandOutcome("i-api", fakeaws.CommandOutcome{Status: "Success", Output: "restarted"})
+	fleet.SetCommandOutcome("i-failed", fakeaws.CommandOutcome{Status: "Failed", ExitCode: 3, Stderr: "unknown service"})
+	checker := createFakeChecker(fleet)
+	stop := advanceSleepers(checker.clock.(*clock.Fake), btrzaws.SSMPollInterval)
+	runScanCycles(t, checker, 2)
+	stop()
+
+	commands := fleet.GetSentCommands()
+	if len(commands) != 2 || commands[0].Commands[0] != "sudo service btrz-api-sales restart" {
+		t.Fatalf("expected the restarts sent with ssm, got %v", commands)
+	}
+	if fleet.CountCalls("StopInstances i-api") != 0 || fleet.CountCalls("StopInstances i-failed") != 1 {
+		t.Fatalf("only the failed command should restart the server, calls %v", fleet.GetCalls())
+	}
+	incidents := checker.GetIncidents()
+	if len(incidents.Open) != 2 {
+		t.Fatalf("expected two open incidents, got %+v", incidents)
+	}
+	for _, incident := range incidents.Open {
+		result := incident.Commands[0]
+		switch incident.InstanceID {
+		case "i-api":
+			if result.Executor != "ssm" || result.Status != btrzaws.CommandStatusSuccess || result.ExitCode != 0 || result.Output != "restarted" {
+				t.Fatalf("bad command result %+v", result)
+			}
+		case "i-failed":
+			if result.Status != btrzaws.CommandStatusFailed || result.ExitCode != 3 || result.Stderr != "unknown service" {
+				t.Fatalf("bad command result %+v", result)
+			}
+		}
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	checker.clock.(*clock.Fake).Advance(SoftRestartDuration)
+	runScanCycles(t, checker, 1)
+	incidents = checker.GetIncidents()
+	if len(incidents.Open) != 1 || len(incidents.Resolved) != 1 || incidents.Resolved[0].InstanceID != "i-api" {
+		t.Fatalf("the restarted service incident should be resolved, got %+v", incidents)
+	}
+}
+
+func TestRemediationOutsideScanWorkers(t *testing.T) {
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil, "i-api-2": nil})
+	release := make(chan struct{})
+	var restarts int32
+	checker := &InstancesChecker{
+		targetFactory: fleet.TargetFactory(),
+		notifications: fleet.Clients().SNS,
+		clock:         clock.NewFake(time.Now()),
+		serviceRestarter: func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+			atomic.AddInt32(&restarts, 1)
+			<-release
+			return nil, nil
+		},
+	}
+	checker.Configurations.RestartThreshold = 1
+	checker.Configurations.ReportingThreshold = 5
+	checker.Configurations.MaxConcurrentChecks = 1
+	checker.initChecker(nil)
+
+	// the first failures don't reach the restart threshold, their remediations end right away
+	runScanCycles(t, checker, 1)
+	if err := checker.runScanCycle(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCondition(t, "both service restarts", func() bool { return atomic.LoadInt32(&restarts) == 2 })
+	if err := checker.runScanCycle(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := checker.lastScanStatistics; stats.InstancesSkipped != 2 || stats.InstancesExpired != 0 {
+		t.Fatalf("the instances under remediation should be skipped, got %+v", stats)
+	}
+	close(release)
+	checker.remediations.wait()
+	if checker.remediations.isRunning("i-api") || atomic.LoadInt32(&restarts) != 2 {
+		t.Fatal("expected a single restart per instance")
+	}
+}
+
+func TestDiagnosticsBeforeRestart(t *testing.T) {
+	directory, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"Remediation-Executor": "ssm"}})
+	fleet.SetCommandOutcome("i-api", fakeaws.CommandOutcome{Status: "Success", Output: "collected"})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.Diagnostics.Enabled = true
+	checker.Configurations.Diagnostics.Directory = directory
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+	stop := advanceSleepers(checker.clock.(*clock.Fake), btrzaws.SSMPollInterval)
+	runScanCycles(t, checker, 2)
+	stop()
+
+	commands := fleet.GetSentCommands()
+	if len(commands) != 6 || commands[0].Commands[0] != "sudo journalctl -u btrz-api-sales -n 200 --no-pager" ||
+		commands[5].Commands[0] != "sudo service btrz-api-sales restart" {
+		t.Fatalf("expected the diagnostics before the restart, got %v", commands)
+	}
+	incidents := checker.GetIncidents()
+	if len(incidents.Open) != 1 || len(incidents.Open[0].Diagnostics) != 1 || len(incidents.Open[0].Diagnostics[0].Sections) != 5 {
+		t.Fatalf("expected the diagnostics in the incident, got %+v", incidents)
+	}
+	token := getToken(t, webServer.URL)
+	resp, err := http.Get(webServer.URL + "/incidents/diagnostics?id=" + incidents.Open[0].Diagnostics[0].ID + "&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bundle := &btrzaws.DiagnosticsBundle{}
+	if err = json.NewDecoder(resp.Body).Decode(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(bundle.Sections) != 5 || bundle.Sections[0].Name != "journal" ||
+		bundle.Sections[0].Output != "collected" {
+		t.Fatalf("bad diagnostics bundle %d %+v", resp.StatusCode, bundle)
+	}
+	resp, err = http.PostForm(webServer.URL+"/incidents/diagnostics",
+		url.Values{"id": {incidents.Open[0].Diagnostics[0].ID}, "token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("the bundle id should be read from the form too, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(webServer.URL + "/incidents/diagnostics?id=../monitor&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown bundles to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestRemediationPolicy(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"Remediation-Executor": "ssm"}})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.RemediationPolicies = []*btrzaws.RemediationPolicy{{
+		Name:         "api",
+		Repositories: []string{"btrz-api-sales"},
+		Steps: []*btrzaws.RemediationStep{
+			{Action: btrzaws.ActionRunCommand, Command: "sudo systemctl reset-failed", Threshold: 1, Cooldown: time.Minute},
+			{Action: btrzaws.ActionRestartService, Threshold: 2, Cooldown: time.Minute},
+			{Action: btrzaws.ActionReboot, Threshold: 2, Cooldown: time.Minute},
+			{Action: btrzaws.ActionNotify, Threshold: 3, Attempts: 2},
+		},
+	}}
+	restarts := 0
+	checker.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+		restarts++
+		return nil, errors.New("service restart failed")
+	}
+	stop := advanceSleepers(checker.clock.(*clock.Fake), btrzaws.SSMPollInterval)
+	defer stop()
+
+	runScanCycles(t, checker, 1)
+	if commands := fleet.GetSentCommands(); len(commands) != 1 || commands[0].Commands[0] != "sudo systemctl reset-failed" {
+		t.Fatalf("expected the policy command on the first failure, got %v", commands)
+	}
+	runScanCycles(t, checker, 1)
+	if len(fleet.GetSentCommands()) != 1 || restarts != 0 {
+		t.Fatalf("the instance should not be checked during the step cooldown, calls %v", fleet.GetCalls())
+	}
+	checker.clock.(*clock.Fake).Advance(time.Minute)
+	runScanCycles(t, checker, 1)
+	if restarts != 1 || fleet.CountCalls("RebootInstances i-api") != 1 {
+		t.Fatalf("the failed restart should hand over to the reboot, calls %v", fleet.GetCalls())
+	}
+	for cycle := 0; cycle < 3; cycle++ {
+		checker.clock.(*clock.Fake).Advance(time.Minute)
+		runScanCycles(t, checker, 1)
+	}
+	if len(fleet.GetSentCommands()) != 1 || restarts != 1 || fleet.CountCalls("RebootInstances i-api") != 1 ||
+		fleet.CountCalls("StopInstances i-api") != 0 {
+		t.Fatalf("every step should run for its attempts only, calls %v", fleet.GetCalls())
+	}
+	if len(fleet.GetMessages()) != 2 {
+		t.Fatalf("expected two notifications, got %v", fleet.GetMessages())
+	}
+	checker.setInstanceAsHealthy(checker.tempCheckedInstances[0])
+	runScanCycles(t, checker, 1)
+	if len(fleet.GetSentCommands()) != 2 {
+		t.Fatal("a healthy instance should start the policy over")
+	}
+}
+
+func TestRemediationPolicyTerminateStep(t *testing.T) {
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.RemediationPolicies = []*btrzaws.RemediationPolicy{{
+		Name:         "api",
+		Repositories: []string{"btrz-api-sales"},
+		Steps:        []*btrzaws.RemediationStep{{Action: btrzaws.ActionTerminate, Threshold: 1, Cooldown: time.Minute}},
+	}}
+	if err := btrzaws.ValidateRemediationPolicies(checker.Configurations.RemediationPolicies); err != nil {
+		t.Fatal(err)
+	}
+
+	runScanCycles(t, checker, 2)
+	if fleet.CountCalls("TerminateInstances i-api") != 1 {
+		t.Fatalf("expected a single termination during the cooldown, calls %v", fleet.GetCalls())
+	}
+	incidents := checker.GetIncidents()
+	if len(incidents.Resolved) != 1 {
+		t.Fatalf("the terminated instance isn't discovered anymore, expected its incident resolved, got %+v", incidents)
+	}
+	incident := incidents.Resolved[0]
+	messages := []string{}
+	for _, event := range incident.Timeline {
+		messages = append(messages, event.Message)
+	}
+	if !strings.Contains(strings.Join(messages, "\n"), "\nterminated\n") {
+		t.Fatalf("the termination should be kept with the incident, got %v", messages)
+	}
+}
+
+func TestRemediationGuardrails(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api-1": nil, "i-api-2": nil, "i-api-3": nil})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.Guardrails.MaxConcurrentPerRepository = 1
+	restarts := int32(0)
+	checker.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+		atomic.AddInt32(&restarts, 1)
+		return nil, nil
+	}
+
+	runScanCycles(t, checker, 2)
+	if atomic.LoadInt32(&restarts) != 1 {
+		t.Fatalf("a single instance of the repository should be restarted, got %d", restarts)
+	}
+	messages := fleet.GetMessages()
+	if len(messages) != 2 || !strings.Contains(messages[0].Message, "notify only") {
+		t.Fatalf("expected the blocked instances alerts, got %v", messages)
+	}
+	runScanCycles(t, checker, 3)
+	if atomic.LoadInt32(&restarts) != 1 || len(fleet.GetMessages()) != 2 {
+		t.Fatal("blocked instances should be alerted on once")
+	}
+
+	checker.Configurations.Guardrails = RemediationGuardrails{MinHealthyInstances: 1}
+	for _, instance := range checker.tempCheckedInstances {
+		checker.setInstanceAsHealthy(instance)
+	}
+	runScanCycles(t, checker, 2)
+	if atomic.LoadInt32(&restarts) != 1 {
+		t.Fatal("a service without healthy instances should not be remediated")
+	}
+
+	checker.Configurations.Guardrails = RemediationGuardrails{ActionBudget: 2, ActionBudgetWindow: time.Hour}
+	checker.guardrails = newRemediationGuardrails(checker.clock)
+	checker.restartingInstances = newRestartCounters()
+	checker.guardrailBlocks = newInstanceFlags()
+	alerts := len(fleet.GetMessages())
+	runScanCycles(t, checker, 2)
+	if atomic.LoadInt32(&restarts) != 3 || len(fleet.GetMessages()) != alerts+1 {
+		t.Fatalf("expected the action budget to be spent, got %d restarts", restarts)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-api":    nil,
+		"i-worker": {"Repository": "btrz-worker", "aws:autoscaling:groupName": "worker-group"},
+	})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.DryRunRepositories = []string{"btrz-worker"}
+	checker.restartedServicesCounterMap.set("i-worker", 1, checker.clock.Now().Add(time.Hour))
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+
+	runScanCycles(t, checker, 2)
+	if fleet.CountCalls("StopInstances i-api") != 1 {
+		t.Fatalf("instances out of dry run should be remediated, calls %v", fleet.GetCalls())
+	}
+	if fleet.CountCalls("i-worker") != 0 {
+		t.Fatalf("nothing should run on the dry run instance, calls %v", fleet.GetCalls())
+	}
+	resp, err := http.Get(webServer.URL + "/dryrun?token=" + getToken(t, webServer.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	response := DryRunResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.DryRun || len(response.Decisions) != 2 || response.Decisions[0].Action != btrzaws.ActionTerminate ||
+		response.Decisions[1].Action != btrzaws.ActionRestartService {
+		t.Fatalf("expected the termination and restart decisions, got %+v", response)
+	}
+	if decision := response.Decisions[0]; decision.InstanceID != "i-worker" || decision.Group != "worker-group" ||
+		decision.Failures != 2 || decision.Restarts != 1 || decision.Status == "" {
+		t.Fatalf("the decision should have the instance context, got %+v", decision)
+	}
+
+	checker.Configurations.DryRun = true
+	checker.Configurations.DryRunRepositories = nil
+	checker.Configurations.RemediationPolicies = []*btrzaws.RemediationPolicy{{
+		Name:         "notify",
+		Repositories: []string{"btrz-worker"},
+		Steps:        []*btrzaws.RemediationStep{{Action: btrzaws.ActionNotify, Threshold: 1}},
+	}}
+	checker.restartingInstances = newRestartCounters()
+	runScanCycles(t, checker, 1)
+	if len(fleet.GetMessages()) != 0 {
+		t.Fatalf("notifications should be recorded only, got %v", fleet.GetMessages())
+	}
+	decisions := checker.GetDryRunDecisions().Decisions
+	if last := decisions[len(decisions)-1]; last.Action != btrzaws.ActionNotify || last.Detail != "policy notify step 1" {
+		t.Fatalf("expected the policy notification decision, got %+v", last)
+	}
+}
+
+func TestDryRunGuardrails(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-api":      nil,
+		"i-worker-1": {"Repository": "btrz-worker"},
+		"i-worker-2": {"Repository": "btrz-worker"},
+	})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.DryRunRepositories = []string{"btrz-worker"}
+	checker.Configurations.Guardrails = RemediationGuardrails{MaxConcurrentPerRepository: 1}
+	restarts := int32(0)
+	checker.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+		atomic.AddInt32(&restarts, 1)
+		return nil, nil
+	}
+
+	runScanCycles(t, checker, 2)
+	if atomic.LoadInt32(&restarts) != 1 || fleet.CountCalls("i-worker") != 0 {
+		t.Fatalf("the live instance should be restarted, got %d restarts, calls %v", restarts, fleet.GetCalls())
+	}
+	checker.guardrails.lock.Lock()
+	_, live := checker.guardrails.active["i-api"]
+	active := len(checker.guardrails.active)
+	checker.guardrails.lock.Unlock()
+	if !live || active != 1 {
+		t.Fatalf("only the live instance should be under remediation, got %d", active)
+	}
+	restarted := map[string]bool{}
+	for _, decision := range checker.GetDryRunDecisions().Decisions {
+		if decision.Action == NotifyRemediationBlocked {
+			t.Fatalf("the dry run instances shouldn't take the guardrails slots, got %+v", decision)
+		}
+		restarted[decision.InstanceID] = decision.Action == btrzaws.ActionRestartService
+	}
+	if !restarted["i-worker-1"] || !restarted["i-worker-2"] {
+		t.Fatalf("expected the restart decisions of both dry run instances, got %v", restarted)
+	}
+	for _, incident := range checker.GetIncidents().Open {
+		for _, event := range incident.Timeline {
+			if strings.Contains(event.Message, "blocked by a guardrail") {
+				t.Fatalf("nothing should be blocked, got %s on %s", event.Message, incident.InstanceID)
+			}
+		}
+	}
+}
+
+func TestCorrelatedFailures(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	var recovered int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&recovered) == 0 || r.URL.Path == "/api-1" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-api-1":    {"Healtcheck-Path": "api-1"},
+		"i-api-2":    {"Healtcheck-Path": "api-2"},
+		"i-worker-1": {"Healtcheck-Path": "worker-1", "Repository": "btrz-worker", btrzaws.DependsOnTag: "mongo"},
+		"i-worker-2": {"Healtcheck-Path": "worker-2", "Repository": "btrz-worker", btrzaws.DependsOnTag: "mongo"},
+	})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.Dependencies = map[string][]string{"btrz-api-sales": {"mongo"}}
+	checker.Configurations.Correlation = CorrelationSettings{MinFailing: 3, MinRatio: 0.5}
+
+	runScanCycles(t, checker, 3)
+	if fleet.CountCalls("StopInstances") != 0 || fleet.CountCalls("SendCommand") != 0 {
+		t.Fatalf("correlated failures should not be remediated, calls %v", fleet.GetCalls())
+	}
+	messages := fleet.GetMessages()
+	if len(messages) != 1 || !strings.Contains(messages[0].Message, "mongo likely down") {
+		t.Fatalf("expected a single correlated alert, got %v", messages)
+	}
+	correlated := checker.GetIncidents().Correlated
+	if len(correlated) != 1 || correlated[0].Dependency != "mongo" || len(correlated[0].Failing) != 4 ||
+		len(correlated[0].Repositories) != 2 {
+		t.Fatalf("expected the mongo incident, got %+v", correlated)
+	}
+
+	atomic.StoreInt32(&recovered, 1)
+	runScanCycles(t, checker, 1)
+	incidents := checker.GetIncidents()
+	if len(incidents.Correlated) != 0 || len(incidents.CorrelatedResolved) != 1 {
+		t.Fatalf("the incident should be resolved with a single failing dependent, got %+v", incidents)
+	}
+	runScanCycles(t, checker, 1)
+	if fleet.CountCalls("StopInstances i-api-1") != 1 || fleet.CountCalls("StopInstances") != 1 {
+		t.Fatalf("the instance still failing should be remediated, calls %v", fleet.GetCalls())
+	}
+}
+
+func TestCorrelationBeforeRemediation(t *testing.T) {
+	var outage int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/worker-1" {
+			// the other dependents are checked after the first one failed
+			time.Sleep(50 * time.Millisecond)
+			if atomic.LoadInt32(&outage) == 0 {
+				return
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{
+		"i-worker-1": {"Healtcheck-Path": "worker-1", btrzaws.DependsOnTag: "mongo"},
+		"i-worker-2": {"Healtcheck-Path": "worker-2", btrzaws.DependsOnTag: "mongo"},
+		"i-worker-3": {"Healtcheck-Path": "worker-3", btrzaws.DependsOnTag: "mongo"},
+	})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.Correlation = CorrelationSettings{MinFailing: 3, MinRatio: 0.5}
+	checker.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+		t.Errorf("%s restarted during a correlated outage", instance.InstanceID)
+		return nil, nil
+	}
+
+	runScanCycles(t, checker, 1)
+	atomic.StoreInt32(&outage, 1)
+	runScanCycles(t, checker, 1)
+	if fleet.CountCalls("StopInstances") != 0 || fleet.CountCalls("SendCommand") != 0 {
+		t.Fatalf("correlated failures should not be remediated, calls %v", fleet.GetCalls())
+	}
+	if correlated := checker.GetIncidents().Correlated; len(correlated) != 1 || len(correlated[0].Failing) != 3 {
+		t.Fatalf("expected the mongo incident, got %+v", correlated)
+	}
+}
+
+func TestCorrelationResolvedBelowRatio(t *testing.T) {
+	store := newCorrelations(clock.NewFake(time.Now()))
+	settings := CorrelationSettings{MinFailing: 2, MinRatio: 0.5}
+	dependencies := map[string][]string{"btrz-worker": {"mongo"}}
+	instances := []*btrzaws.BetterezInstance{}
+	for index := 1; index <= 8; index++ {
+		instances = append(instances, &btrzaws.BetterezInstance{InstanceID: fmt.Sprintf("i-worker-%d", index),
+			Repository: "btrz-worker"})
+	}
+	isFailing := func(instanceID string) bool {
+		return instanceID == "i-worker-1" || instanceID == "i-worker-2"
+	}
+
+	store.setInstances(instances[:4], dependencies)
+	if incident, opened := store.correlate("i-worker-1", settings, isFailing); incident == nil || !opened {
+		t.Fatal("2 failing dependents out of 4 should open an incident")
+	}
+	if resolved := store.resolve(settings, isFailing); len(resolved) != 0 {
+		t.Fatalf("the incident should stay open, got %+v", resolved)
+	}
+	store.setInstances(instances, dependencies)
+	resolved := store.resolve(settings, isFailing)
+	if len(resolved) != 1 || resolved[0].Dependents != 8 || len(resolved[0].Failing) != 2 {
+		t.Fatalf("2 failing dependents out of 8 are below the ratio, expected the incident resolved, got %+v", resolved)
+	}
+	if incident, _ := store.correlate("i-worker-1", settings, isFailing); incident != nil {
+		t.Fatalf("the failures aren't correlated anymore, got %+v", incident)
+	}
+}
+
+func getIncidentDetail(t *testing.T, serverURL, token, id string) *Incident {
+	resp, err := http.Get(serverURL + "/incidents/detail?id=" + id + "&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("incident detail returned %d", resp.StatusCode)
+	}
+	incident := &Incident{}
+	if err = json.NewDecoder(resp.Body).Decode(incident); err != nil {
+		t.Fatal(err)
+	}
+	return incident
+}
+
+func TestIncidentLifecycle(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	checker := createFakeChecker(fleet)
+	checker.restartedServicesCounterMap.set("i-api", 1, checker.clock.Now().Add(time.Hour))
+	checker.serviceRestarter = func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+		return nil, nil
+	}
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+	token := getToken(t, webServer.URL)
+
+	runScanCycles(t, checker, 1)
+	incidents := checker.GetIncidents()
+	if len(incidents.Open) != 1 || incidents.Open[0].State != IncidentOpen || incidents.Open[0].Timeline[0].Kind != EventCheck {
+		t.Fatalf("the first failed check should open an incident, got %+v", incidents)
+	}
+	id := incidents.Open[0].ID
+	runScanCycles(t, checker, 1)
+	resp, err := http.Get(webServer.URL + "/incidents?state=remediating&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := IncidentsListResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list.Open) != 1 || list.Open[0].ID != id || list.Open[0].LastEvent.Message != IncidentRemediating {
+		t.Fatalf("expected the remediating incident, got %+v %v", list, err)
+	}
+
+	resp, err = http.PostForm(webServer.URL+"/incidents/acknowledge", url.Values{"id": {id}, "note": {"on it"}, "token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("acknowledging requires the admin level, got %d", resp.StatusCode)
+	}
+	adminToken := getUserToken(t, webServer.URL, "admin", "654321")
+	resp, err = http.PostForm(webServer.URL+"/incidents/acknowledge", url.Values{"id": {id}, "note": {"on it"}, "token": {adminToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if incident, _ := checker.GetIncident(id); resp.StatusCode != http.StatusOK || incident.State != IncidentAcknowledged {
+		t.Fatalf("expected the incident acknowledged, got %d %+v", resp.StatusCode, incident)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	checker.clock.(*clock.Fake).Advance(SoftRestartDuration)
+	runScanCycles(t, checker, 1)
+	incident := getIncidentDetail(t, webServer.URL, token, id)
+	events := []string{}
+	for _, event := range incident.Timeline {
+		events = append(events, event.Kind+" "+event.Message)
+	}
+	expected := []string{
+		"check healthcheck failed: healthcheck returned status 500",
+		"notification failure notice sent",
+		"action service restarted",
+		"state remediating",
+		"state acknowledged: on it",
+		"check healthcheck passed",
+		"state resolved",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") || incident.Timeline[0].Repeated != 1 {
+		t.Fatalf("bad timeline %v", events)
+	}
+	if incident.State != IncidentResolved || incident.Acknowledged.IsZero() || incident.Resolved.Before(incident.Acknowledged) {
+		t.Fatalf("bad resolved incident %+v", incident)
+	}
+	resp, err = http.Get(webServer.URL + "/incidents/detail?id=missing&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("an unknown incident returned %d", resp.StatusCode)
+	}
+}
+
+func TestDegradedIncident(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	var slow int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-slow": nil})
+	checker := createFakeChecker(fleet)
+	checker.Configurations.LatencyWarnThreshold = 5 * time.Millisecond
+	checker.Configurations.LatencyCriticalThreshold = 10 * time.Millisecond
+
+	runScanCycles(t, checker, 2)
+	incidents := checker.GetIncidents()
+	if len(incidents.Open) != 1 || len(fleet.GetMessages()) != 1 {
+		t.Fatalf("expected one degraded alert on an open incident, got %+v, messages %v", incidents, fleet.GetMessages())
+	}
+	events := []string{}
+	for _, event := range incidents.Open[0].Timeline {
+		events = append(events, event.Kind+" "+event.Message)
+	}
+	expected := []string{
+		"check response time above critical threshold 10ms",
+		"notification degraded alert sent",
+		"check response time above critical threshold 10ms",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad timeline %v", events)
+	}
+	atomic.StoreInt32(&slow, 0)
+	runScanCycles(t, checker, 1)
+	if incidents = checker.GetIncidents(); len(incidents.Open) != 0 || len(incidents.Resolved) != 1 {
+		t.Fatalf("the incident should be resolved once the latency is back to normal, got %+v", incidents)
+	}
+}
+
+func TestIncidentRecordsKept(t *testing.T) {
+	store := newIncidents(clock.NewFake(time.Now()))
+	instance := &btrzaws.BetterezInstance{InstanceID: "i-api", Repository: "api"}
+	for command := 0; command < incidentRecordsKept+5; command++ {
+		store.recordCommand(instance, btrzaws.CommandResult{Command: fmt.Sprintf("command %d", command)})
+		store.recordDiagnostics(instance, &btrzaws.DiagnosticsBundle{})
+	}
+	incident := store.getIncidents().Open[0]
+	if len(incident.Commands) != incidentRecordsKept || len(incident.Diagnostics) != incidentRecordsKept ||
+		incident.RecordsDropped != 10 || incident.Commands[0].Command != "command 5" {
+		t.Fatalf("bad records kept, %d commands, %d diagnostics, %d dropped", len(incident.Commands), len(incident.Diagnostics), incident.RecordsDropped)
+	}
+}
+
+func TestSSMFallbackToSSH(t *testing.T) {
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"Remediation-Executor": "ssm"}})
+	fleet.FailOperation("SendCommand", errors.New("InvalidInstanceId"))
+	checker := createFakeChecker(fleet)
+
+	runScanCycles(t, checker, 2)
+	if fleet.CountCalls("SendCommand") != 1 || fleet.CountCalls("GetCommandInvocation") != 0 {
+		t.Fatalf("expected a single ssm attempt, calls %v", fleet.GetCalls())
+	}
+	// without the key file the ssh fallback fails too, and the server is restarted
+	if incidents := checker.GetIncidents().Open; fleet.CountCalls("StopInstances") != 1 || len(incidents) != 1 ||
+		len(incidents[0].Commands) != 0 {
+		t.Fatalf("expected a server restart without command results, calls %v", fleet.GetCalls())
+	}
+}
+
+func TestHostKeyMismatchBlocksRemediation(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"aws:autoscaling:groupName": "api-group"}})
+	checker := &InstancesChecker{
+		targetFactory: fleet.TargetFactory(),
+		notifications: fleet.Clients().SNS,
+		clock:         clock.NewFake(time.Now()),
+		serviceRestarter: func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+			return nil, &sshconnector.HostKeyMismatchError{HostID: instance.InstanceID, Expected: []string{"SHA256:a"}, Received: "SHA256:b"}
+		},
+	}
+	checker.Configurations.RestartThreshold = 1
+	checker.Configurations.ReportingThreshold = 1
+	checker.initChecker(nil)
+
+	runScanCycles(t, checker, 5)
+	if fleet.CountCalls("StopInstances") != 0 || fleet.CountCalls("TerminateInstances") != 0 {
+		t.Fatalf("remediation should be blocked, calls %v", fleet.GetCalls())
+	}
+	messages := fleet.GetMessages()
+	if len(messages) != 1 || !strings.Contains(messages[0].Message, "host key mismatch") {
+		t.Fatalf("expected a single host key alert, got %v", messages)
+	}
+}
+
+func TestUnknownHostKeyBlocksRemediation(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	server := createFailingServer()
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": {"Terminate on fault": "yes"}})
+	checker := &InstancesChecker{
+		targetFactory: fleet.TargetFactory(),
+		notifications: fleet.Clients().SNS,
+		clock:         clock.NewFake(time.Now()),
+		serviceRestarter: func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+			return nil, &sshconnector.UnknownHostKeyError{HostID: instance.InstanceID, Received: "SHA256:b"}
+		},
+	}
+	checker.Configurations.RestartThreshold = 1
+	checker.Configurations.ReportingThreshold = 1
+	checker.initChecker(nil)
+
+	runScanCycles(t, checker, 5)
+	if fleet.CountCalls("StopInstances") != 0 || fleet.CountCalls("TerminateInstances") != 0 {
+		t.Fatalf("an unverified host key should block the escalation, calls %v", fleet.GetCalls())
+	}
+	messages := fleet.GetMessages()
+	if len(messages) != 1 || !strings.Contains(messages[0].Message, "unknown host key") {
+		t.Fatalf("expected a single host key alert, got %v", messages)
+	}
+}
@@ -0,0 +1,53 @@
+package betterweb
+
+import (
+	"sync"
+)
+
+// remediations - the remediations running in the background, at most one per instance, safe for concurrent use.
+// commands and diagnostics may wait on ssh or ssm for minutes, so they don't hold the scan workers
+type remediations struct {
+	lock    sync.Mutex
+	running map[string]bool
+	// remediationsGroup - running remediations, for tests
+	remediationsGroup sync.WaitGroup
+}
+
+func newRemediations() *remediations {
+	return &remediations{running: make(map[string]bool)}
+}
+
+// start - run the remediation of the instance in the background, false when one is already running
+func (runs *remediations) start(instanceID string, remediate func()) bool {
+	runs.lock.Lock()
+	defer runs.lock.Unlock()
+	if runs.running[instanceID] {
+		return false
+	}
+	runs.running[instanceID] = true
+	runs.remediationsGroup.Add(1)
+	go func() {
+		defer runs.remediationsGroup.Done()
+		defer runs.finish(instanceID)
+		remediate()
+	}()
+	return true
+}
+
+func (runs *remediations) finish(instanceID string) {
+	runs.lock.Lock()
+	defer runs.lock.Unlock()
+	delete(runs.running, instanceID)
+}
+
+// isRunning - true while the instance has a remediation running
+func (runs *remediations) isRunning(instanceID string) bool {
+	runs.lock.Lock()
+	defer runs.lock.Unlock()
+	return runs.running[instanceID]
+}
+
+// wait - until the running remediations are done
+func (runs *remediations) wait() {
+	runs.remediationsGroup.Wait()
+}
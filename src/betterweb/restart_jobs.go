@@ -0,0 +1,259 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"clock"
+	"fmt"
+	"logging"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// RestartJobStopping - stop requested, waiting for the instance to stop
+	RestartJobStopping = "stopping"
+	// RestartJobStopped - the instance stopped
+	RestartJobStopped = "stopped"
+	// RestartJobStarting - start requested, waiting for the instance to run
+	RestartJobStarting = "starting"
+	// RestartJobRunning - the instance runs, waiting for its healthcheck to pass
+	RestartJobRunning = "running"
+	// RestartJobHealthy - the healthcheck passed, the restart is complete
+	RestartJobHealthy = "healthy"
+	// RestartJobFailed - an ec2 call failed or the instance went away
+	RestartJobFailed = "failed"
+	// RestartJobTimedOut - the restart didn't complete before the deadline and was escalated
+	RestartJobTimedOut = "timed-out"
+)
+
+const (
+	// RestartPollInitialInterval - first wait between instance state checks
+	RestartPollInitialInterval = 5 * time.Second
+	// RestartPollMaxInterval - the wait doubles up to this interval
+	RestartPollMaxInterval = 40 * time.Second
+	// completedRestartJobsKept - finished jobs kept for the restarts endpoint
+	completedRestartJobsKept = 20
+)
+
+// RestartTransition - a restart job state change
+type RestartTransition struct {
+	State   string
+	Time    time.Time
+	Message string `json:",omitempty"`
+}
+
+// RestartJob - a full server restart, stop then start, followed until the healthcheck passes
+type RestartJob struct {
+	ID          string
+	InstanceID  string
+	QualifiedID string
+	Repository  string
+	State       string
+	Started     time.Time
+	Deadline    time.Time
+	Finished    time.Time
+	Transitions []RestartTransition
+	Error       string `json:",omitempty"`
+	Escalated   bool
+	instance    *btrzaws.BetterezInstance
+}
+
+// RestartJobsResponse - the restarts endpoint response
+type RestartJobsResponse struct {
+	InFlight  []RestartJob
+	Completed []RestartJob
+}
+
+// restartJobs - in flight and recently completed restart jobs, safe for concurrent use
+type restartJobs struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	inFlight  map[string]*RestartJob
+	completed []*RestartJob
+	// deadline - returns the current restart deadline, read when a job starts
+	deadline func() time.Duration
+	// escalate - called once when a job times out
+	escalate func(job RestartJob, instance *btrzaws.BetterezInstance)
+	// finished - called when a job completes, in any final state
+	finished func(job RestartJob)
+	// jobsGroup - running pollers, for tests
+	jobsGroup sync.WaitGroup
+}
+
+func newRestartJobs(jobsClock clock.Clock) *restartJobs {
+	return &restartJobs{
+		clock:    jobsClock,
+		inFlight: make(map[string]*RestartJob),
+		deadline: func() time.Duration { return betterconfig.DefaultRestartJobDeadline },
+		escalate: func(job RestartJob, instance *btrzaws.BetterezInstance) {},
+		finished: func(job RestartJob) {},
+	}
+}
+
+// isRestarting - true while the instance has a job in flight
+func (jobs *restartJobs) isRestarting(instanceID string) bool {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	_, found := jobs.inFlight[instanceID]
+	return found
+}
+
+// start - stop the instance and follow its restart in the background.
+// an instance has at most one job in flight, its addresses are read again once it runs
+func (jobs *restartJobs) start(instance *btrzaws.BetterezInstance) (*RestartJob, error) {
+	jobs.lock.Lock()
+	if _, found := jobs.inFlight[instance.InstanceID]; found {
+		jobs.lock.Unlock()
+		return nil, fmt.Errorf("instance %s is already restarting", instance.GetQualifiedID())
+	}
+	now := jobs.clock.Now()
+	instanceCopy := *instance
+	job := &RestartJob{
+		ID:          fmt.Sprintf("%s-%d", instance.InstanceID, now.Unix()),
+		InstanceID:  instance.InstanceID,
+		QualifiedID: instance.GetQualifiedID(),
+		Repository:  instance.Repository,
+		Started:     now,
+		Deadline:    now.Add(jobs.deadline()),
+		instance:    &instanceCopy,
+	}
+	jobs.inFlight[instance.InstanceID] = job
+	jobs.lock.Unlock()
+
+	if err := job.instance.StopServer(); err != nil {
+		jobs.finish(job, RestartJobFailed, err)
+		return nil, err
+	}
+	jobs.transition(job, RestartJobStopping, "")
+	jobs.jobsGroup.Add(1)
+	go jobs.follow(job)
+	return job, nil
+}
+
+// follow - poll the instance with a growing interval until it's healthy or the deadline passed
+func (jobs *restartJobs) follow(job *RestartJob) {
+	defer jobs.jobsGroup.Done()
+	pollInterval := RestartPollInitialInterval
+	for {
+		<-jobs.clock.After(pollInterval)
+		if pollInterval *= 2; pollInterval > RestartPollMaxInterval {
+			pollInterval = RestartPollMaxInterval
+		}
+		done, err := jobs.poll(job)
+		if done {
+			return
+		}
+		if err != nil {
+			logging.RecordLogLine(fmt.Sprintf("warning: %v while following the restart of %s", err, job.QualifiedID))
+		}
+		if !jobs.clock.Now().Before(job.Deadline) {
+			jobs.finish(job, RestartJobTimedOut, fmt.Errorf("restart didn't complete in %v, last state %s",
+				job.Deadline.Sub(job.Started), jobs.getState(job)))
+			return
+		}
+	}
+}
+
+// poll - move the job forward, returns true when the job is finished
+func (jobs *restartJobs) poll(job *RestartJob) (bool, error) {
+	if jobs.getState(job) == RestartJobRunning {
+		if ok, err := job.instance.CheckInstanceHealth(); !ok || err != nil {
+			return false, nil
+		}
+		jobs.finish(job, RestartJobHealthy, nil)
+		return true, nil
+	}
+	state, err := job.instance.GetServerState()
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case ec2.InstanceStateNameStopped:
+		if jobs.getState(job) != RestartJobStopping {
+			return false, nil
+		}
+		jobs.transition(job, RestartJobStopped, "")
+		if err = job.instance.StartServer(); err != nil {
+			jobs.finish(job, RestartJobFailed, err)
+			return true, nil
+		}
+		jobs.transition(job, RestartJobStarting, "")
+	case ec2.InstanceStateNameRunning:
+		if jobs.getState(job) != RestartJobStarting {
+			return false, nil
+		}
+		if err = job.instance.RefreshAddresses(); err != nil {
+			return false, err
+		}
+		jobs.transition(job, RestartJobRunning, "")
+	case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+		jobs.finish(job, RestartJobFailed, fmt.Errorf("instance is %s", state))
+		return true, nil
+	}
+	return false, nil
+}
+
+func (jobs *restartJobs) getState(job *RestartJob) string {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	return job.State
+}
+
+func (jobs *restartJobs) transition(job *RestartJob, state, message string) {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	job.State = state
+	job.Transitions = append(job.Transitions, RestartTransition{State: state, Time: jobs.clock.Now(), Message: message})
+	logging.RecordLogLine(fmt.Sprintf("info: restart of %s is %s", job.QualifiedID, state))
+}
+
+// finish - move the job to its final state and out of the in flight jobs
+func (jobs *restartJobs) finish(job *RestartJob, state string, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	jobs.transition(job, state, message)
+	jobs.lock.Lock()
+	job.Finished = jobs.clock.Now()
+	if err != nil {
+		job.Error = message
+	}
+	job.Escalated = state == RestartJobTimedOut
+	delete(jobs.inFlight, job.InstanceID)
+	jobs.completed = append(jobs.completed, job)
+	if len(jobs.completed) > completedRestartJobsKept {
+		jobs.completed = jobs.completed[len(jobs.completed)-completedRestartJobsKept:]
+	}
+	jobCopy := *job
+	jobs.lock.Unlock()
+	if job.Escalated {
+		jobs.escalate(jobCopy, job.instance)
+	}
+	jobs.finished(jobCopy)
+}
+
+// getJobs - copies of the in flight and completed jobs
+func (jobs *restartJobs) getJobs() RestartJobsResponse {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	response := RestartJobsResponse{InFlight: []RestartJob{}, Completed: []RestartJob{}}
+	for _, job := range jobs.inFlight {
+		jobCopy := *job
+		jobCopy.Transitions = append([]RestartTransition{}, job.Transitions...)
+		response.InFlight = append(response.InFlight, jobCopy)
+	}
+	sort.Slice(response.InFlight, func(i, j int) bool {
+		return response.InFlight[i].Started.Before(response.InFlight[j].Started)
+	})
+	for _, job := range jobs.completed {
+		jobCopy := *job
+		jobCopy.Transitions = append([]RestartTransition{}, job.Transitions...)
+		response.Completed = append(response.Completed, jobCopy)
+	}
+	return response
+}
@@ -0,0 +1,147 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"clock"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// escalationScenario - one instance walked through the restart ladder with a fake clock
+type escalationScenario struct {
+	t               *testing.T
+	checker         *InstancesChecker
+	clock           *clock.Fake
+	healthy         int32
+	serviceRestarts int
+	serviceFailure  error
+}
+
+func (scenario *escalationScenario) advance(duration time.Duration) {
+	scenario.clock.Advance(duration)
+	if err := scenario.checker.runScanCycle(); err != nil {
+		scenario.t.Fatal(err)
+	}
+	scenario.checker.remediations.wait()
+}
+
+func (scenario *escalationScenario) expectFaults(step string, faults int) {
+	if count := scenario.checker.faultyInstances.get("i-api"); count != faults {
+		scenario.t.Fatalf("%s: expected %d faults, got %d", step, faults, count)
+	}
+}
+
+func TestEscalationScenario(t *testing.T) {
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{PhoneNumber: "+1000"})
+	defer btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{})
+	scenario := &escalationScenario{t: t, clock: clock.NewFake(time.Now())}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&scenario.healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	fleet := createFakeFleet(t, server, map[string]map[string]string{"i-api": nil})
+	scenario.checker = &InstancesChecker{
+		targetFactory: fleet.TargetFactory(),
+		notifications: fleet.Clients().SNS,
+		clock:         scenario.clock,
+		serviceRestarter: func(instance *btrzaws.BetterezInstance) (*btrzaws.CommandResult, error) {
+			scenario.serviceRestarts++
+			return nil, scenario.serviceFailure
+		},
+	}
+	scenario.checker.Configurations.RestartThreshold = 1
+	scenario.checker.Configurations.ReportingThreshold = 2
+	scenario.checker.initChecker(nil)
+
+	// fault, then the service is restarted over ssh
+	scenario.advance(0)
+	scenario.expectFaults("first fault", 1)
+	scenario.advance(betterconfig.DefaultScanInterval)
+	if scenario.serviceRestarts != 1 || fleet.CountCalls("StopInstances") != 0 {
+		t.Fatal("expected a service restart")
+	}
+	scenario.advance(betterconfig.DefaultScanInterval)
+	scenario.expectFaults("soft restart window", 2)
+
+	// still failing after the soft restart window, the service restart fails and the server is restarted
+	scenario.serviceFailure = errors.New("ssh: handshake failed")
+	scenario.advance(SoftRestartDuration)
+	scenario.expectFaults("hard restart", 3)
+	if scenario.serviceRestarts != 2 || fleet.CountCalls("StopInstances") != 1 {
+		t.Fatal("expected a full server restart")
+	}
+	followRestarts(t, scenario.checker, "server restart", func() bool {
+		return hasRestartState(scenario.checker, "i-api", RestartJobRunning)
+	})
+	scenario.advance(SoftRestartDuration)
+	scenario.expectFaults("hard restart window", 3)
+
+	// the server restart never becomes healthy and is escalated
+	followRestarts(t, scenario.checker, "restart timeout", func() bool {
+		return hasRestartState(scenario.checker, "i-api", RestartJobTimedOut)
+	})
+	if len(fleet.GetMessages()) != 1 {
+		t.Fatalf("expected an escalation notification, got %v", fleet.GetMessages())
+	}
+
+	// failing after the hard restart window, the reporting threshold is reached
+	scenario.advance(0)
+	scenario.expectFaults("reporting threshold", 4)
+	if len(fleet.GetMessages()) != 2 || fleet.CountCalls("StopInstances") != 2 {
+		t.Fatalf("expected a failure notification and a restart, got %v", fleet.GetMessages())
+	}
+
+	// recovery, the notification counter is cleared only after the reset duration
+	atomic.StoreInt32(&scenario.healthy, 1)
+	followRestarts(t, scenario.checker, "healthy server", func() bool {
+		return hasRestartState(scenario.checker, "i-api", RestartJobHealthy)
+	})
+	scenario.advance(0)
+	scenario.expectFaults("recovery", 0)
+	if scenario.checker.restartedServicesCounterMap.get("i-api").countingPoint != 3 {
+		t.Fatal("restart counter should be kept until the reset duration")
+	}
+	scenario.advance(NotificationResetDuration)
+	if scenario.checker.restartedServicesCounterMap.get("i-api").countingPoint != 0 {
+		t.Fatal("restart counter should be cleared after the reset duration")
+	}
+
+	// a new failure starts the ladder over without notifying
+	atomic.StoreInt32(&scenario.healthy, 0)
+	scenario.serviceFailure = nil
+	scenario.advance(betterconfig.DefaultScanInterval)
+	scenario.advance(betterconfig.DefaultScanInterval)
+	if scenario.serviceRestarts != 4 || len(fleet.GetMessages()) != 2 {
+		t.Fatalf("expected a service restart without notification, %d restarts %d messages",
+			scenario.serviceRestarts, len(fleet.GetMessages()))
+	}
+}
+
+func TestWaitForNextCycle(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	checker := &InstancesChecker{clock: fakeClock}
+	checker.initChecker(nil)
+	cycleStart := fakeClock.Now()
+	fakeClock.Advance(2 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		checker.waitForNextCycle(cycleStart)
+		close(done)
+	}()
+	waitForCondition(t, "sleeping checker", func() bool { return fakeClock.Sleepers() == 1 })
+	fakeClock.Advance(betterconfig.DefaultScanInterval - 2*time.Second - time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("woke up before the scan interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fakeClock.Advance(time.Millisecond)
+	<-done
+}
@@ -2,11 +2,13 @@ package betterweb
 
 import (
 	"betterauth"
+	"betterconfig"
 	"btrzaws"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -27,6 +29,18 @@ type ClientResponse struct {
 	Instances []*btrzaws.BetterezInstance
 	Messages  []InstanceMessage
 	Version   string
+	// ScanStatistics - statistics of the last scan cycle
+	ScanStatistics ScanStatistics
+}
+
+// InstanceRoute - the healthcheck route resolved for an instance
+type InstanceRoute struct {
+	InstanceID  string
+	Repository  string
+	PathName    string
+	Route       string
+	Protocol    string
+	Healthcheck string
 }
 
 // HealthCheckServer - server to healthcheck instances
@@ -37,23 +51,31 @@ type HealthCheckServer struct {
 	awsSession       *session.Session
 	serverStatus     string
 	usersTokens      map[string]int
+	tokensLock       sync.RWMutex
 	authenticator    betterauth.Authenticator
 	instancesChecker *InstancesChecker
+	configuration    *betterconfig.Configuration
+	configLock       sync.Mutex
+	// targetFactory, notifications - aws clients given to the checker, the aws sdk ones when nil
+	targetFactory btrzaws.TargetFactory
+	notifications btrzaws.SNSAPI
 }
 
 // CreateHealthCheckServer - create the server
-func CreateHealthCheckServer() (*HealthCheckServer, error) {
+func CreateHealthCheckServer(config *betterconfig.Configuration) (*HealthCheckServer, error) {
 	result := &HealthCheckServer{
-		serverPort:    3000,
+		serverPort:    config.ListeningPort,
 		ServerVersion: "0.5.0.1",
 		serverStatus:  "Idle",
 		usersTokens:   make(map[string]int),
+		configuration: config,
 	}
-	authenticator, err := betterauth.GetSQLiteAuthenticator("secrets/users.sqlite")
+	authenticator, err := betterauth.GetSQLiteAuthenticator(config.UsersDatabase)
 	if err != nil {
 		return nil, err
 	}
 	result.authenticator = authenticator
+	applyGlobalConfiguration(config)
 	return result, nil
 }
 
@@ -65,12 +87,20 @@ func (server *HealthCheckServer) SetSession(awsSession *session.Session) {
 	server.awsSession = awsSession
 }
 
+// SetAWSClients - replace the aws clients the checker uses, before calling Start
+func (server *HealthCheckServer) SetAWSClients(targetFactory btrzaws.TargetFactory, notifications btrzaws.SNSAPI) {
+	server.targetFactory = targetFactory
+	server.notifications = notifications
+}
+
 func (server *HealthCheckServer) SetListeningPort(port int) {
 	server.serverPort = port
 }
 
 func (server *HealthCheckServer) insertUserWithLevel(level int) string {
 	token := betterauth.RandStringRunes(40)
+	server.tokensLock.Lock()
+	defer server.tokensLock.Unlock()
 	server.usersTokens[token] = level
 	return token
 }
@@ -109,18 +139,143 @@ func (server *HealthCheckServer) handleAuthentication() {
 
 func (server *HealthCheckServer) handleChecks() {
 	server.serverMux.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
-		userAuth, err := server.getUserCreds(r)
-		if err != nil {
-			http.Error(w, "Server error", http.StatusInternalServerError)
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(server.instancesChecker.GetClientResponse())
+	})
+}
+
+func (server *HealthCheckServer) handleRoutes() {
+	server.serverMux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
 			return
 		}
-		if userAuth < 1 {
-			http.Error(w, "Not authenticated", http.StatusForbidden)
+		routes := []InstanceRoute{}
+		for _, instance := range server.instancesChecker.GetClientResponse().Instances {
+			endpoint := instance.GetHealthcheckEndpoint()
+			healthcheck := instance.GetHealthCheckString()
+			if endpoint.Protocol == btrzaws.ProtocolTCP || endpoint.Protocol == btrzaws.ProtocolGRPC {
+				healthcheck = instance.GetHealthCheckAddress()
+			}
+			routes = append(routes, InstanceRoute{
+				InstanceID:  instance.InstanceID,
+				Repository:  instance.Repository,
+				PathName:    instance.PathName,
+				Route:       endpoint.Route,
+				Protocol:    endpoint.Protocol,
+				Healthcheck: healthcheck,
+			})
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(routes)
+	})
+}
+
+func (server *HealthCheckServer) handleRestarts() {
+	server.serverMux.HandleFunc("/restarts", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
 			return
 		}
 		encoder := json.NewEncoder(w)
 		w.Header().Set("Content-Type", "text/json")
-		encoder.Encode(server.instancesChecker.clientResponse)
+		encoder.Encode(server.instancesChecker.GetRestartJobs())
+	})
+}
+
+func (server *HealthCheckServer) handleReplacements() {
+	server.serverMux.HandleFunc("/replacements", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(server.instancesChecker.GetGroupReplacements())
+	})
+}
+
+func (server *HealthCheckServer) handleDryRun() {
+	server.serverMux.HandleFunc("/dryrun", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(server.instancesChecker.GetDryRunDecisions())
+	})
+}
+
+func (server *HealthCheckServer) handleIncidents() {
+	server.serverMux.HandleFunc("/incidents", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		state := r.FormValue("state")
+		incidents := server.instancesChecker.GetIncidents()
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(IncidentsListResponse{
+			Open:               summarizeIncidents(incidents.Open, state),
+			Resolved:           summarizeIncidents(incidents.Resolved, state),
+			Correlated:         incidents.Correlated,
+			CorrelatedResolved: incidents.CorrelatedResolved,
+		})
+	})
+}
+
+func (server *HealthCheckServer) handleIncidentDetail() {
+	server.serverMux.HandleFunc("/incidents/detail", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		incident, found := server.instancesChecker.GetIncident(r.FormValue("id"))
+		if !found {
+			http.Error(w, "Incident not found", http.StatusNotFound)
+			return
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(incident)
+	})
+}
+
+func (server *HealthCheckServer) handleIncidentAcknowledge() {
+	server.serverMux.HandleFunc("/incidents/acknowledge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if !server.requireUserLevel(w, r, AdminUserLevel) {
+			return
+		}
+		incident, err := server.instancesChecker.AcknowledgeIncident(r.FormValue("id"), r.FormValue("note"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		encoder := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "text/json")
+		encoder.Encode(incident)
+	})
+}
+
+func (server *HealthCheckServer) handleDiagnostics() {
+	server.serverMux.HandleFunc("/incidents/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		if !server.requireUserLevel(w, r, 1) {
+			return
+		}
+		id := r.FormValue("id")
+		bundle, err := server.instancesChecker.GetDiagnosticsBundle(id)
+		if err != nil {
+			http.Error(w, "Diagnostics not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", id))
+		w.Write(bundle)
 	})
 }
 
@@ -132,18 +287,67 @@ func (server *HealthCheckServer) handleDefaultPath() {
 }
 
 func (server *HealthCheckServer) Start() error {
-	if server.awsSession == nil {
+	if server.awsSession == nil && (server.targetFactory == nil || server.notifications == nil) {
 		return errors.New("No aws session")
 	}
-	server.instancesChecker = &InstancesChecker{}
-	server.instancesChecker.CheckInstances(server.awsSession)
+	server.startInstancesChecker().CheckInstances(server.awsSession)
+	server.setupHandlers()
+	server.serverStatus = "running"
+	return http.ListenAndServe(fmt.Sprintf(":%d", server.serverPort), server.serverMux)
+}
+
+// startInstancesChecker - create and initialize the checker under the configuration lock,
+// a reload may run at the same time
+func (server *HealthCheckServer) startInstancesChecker() *InstancesChecker {
+	server.configLock.Lock()
+	defer server.configLock.Unlock()
+	server.instancesChecker = server.createInstancesChecker()
+	return server.instancesChecker
+}
+
+func (server *HealthCheckServer) createInstancesChecker() *InstancesChecker {
+	checker := &InstancesChecker{
+		Configurations: NewCheckerConfiguration(server.configuration),
+		targetFactory:  server.targetFactory,
+		notifications:  server.notifications,
+	}
+	checker.init(server.awsSession)
+	return checker
+}
+
+func (server *HealthCheckServer) setupHandlers() {
 	server.serverMux = http.NewServeMux()
 	server.handleDefaultPath()
 	server.handleHealthcheck()
 	server.handleAuthentication()
 	server.handleChecks()
-	server.serverStatus = "running"
-	return http.ListenAndServe(fmt.Sprintf(":%d", server.serverPort), server.serverMux)
+	server.handleRoutes()
+	server.handleRestarts()
+	server.handleReplacements()
+	server.handleDryRun()
+	server.handleIncidents()
+	server.handleIncidentDetail()
+	server.handleIncidentAcknowledge()
+	server.handleDiagnostics()
+	server.handleAdmin()
+}
+
+// requireUserLevel - true when the request token has the user level, otherwise the error response is written
+func (server *HealthCheckServer) requireUserLevel(w http.ResponseWriter, r *http.Request, level int) bool {
+	userAuth, err := server.getUserCreds(r)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if userAuth < 1 {
+		http.Error(w, "Not authenticated", http.StatusForbidden)
+		return false
+	}
+	if userAuth < level {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 func (server *HealthCheckServer) getUserCreds(r *http.Request) (int, error) {
@@ -155,6 +359,8 @@ func (server *HealthCheckServer) getUserCreds(r *http.Request) (int, error) {
 	if userToken == "" {
 		return 0, nil
 	}
+	server.tokensLock.RLock()
+	defer server.tokensLock.RUnlock()
 	value, found := server.usersTokens[userToken]
 	if !found {
 		return 0, nil
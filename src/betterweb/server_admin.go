@@ -0,0 +1,74 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"fmt"
+	"logging"
+	"net/http"
+	"sshconnector"
+)
+
+// AdminUserLevel - minimal user level for the admin endpoints
+const AdminUserLevel = 2
+
+// applyGlobalConfiguration - settings used outside of the checker
+func applyGlobalConfiguration(config *betterconfig.Configuration) {
+	logging.SetLogEntriesToken(config.LogEntriesToken)
+	btrzaws.SetKeysPath(config.SSHKeysLocation)
+	btrzaws.SetSSHSettings(btrzaws.SSHSettings{
+		Bastions:     config.SSHBastions,
+		UseAgent:     config.SSHUseAgent,
+		ForwardAgent: config.SSHForwardAgent,
+	})
+	knownHosts, err := sshconnector.LoadKnownHosts(config.SSHKnownHostsFile, config.SSHTrustOnFirstUse)
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("error: %v while loading the ssh known hosts, keeping the previous ones", err))
+	} else {
+		btrzaws.SetKnownHosts(knownHosts)
+	}
+	btrzaws.SetNotificationSettings(btrzaws.NotificationSettings{
+		PhoneNumber:      config.Notifications.PhoneNumber,
+		FirebaseAuthCode: config.Notifications.FirebaseAuthCode,
+	})
+}
+
+// ReloadConfiguration - load the configuration file again. an invalid file is rejected
+// and the running configuration stays in place
+func (server *HealthCheckServer) ReloadConfiguration() error {
+	server.configLock.Lock()
+	defer server.configLock.Unlock()
+	config, err := betterconfig.Load(server.configuration.FileName)
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("error: configuration reload rejected, %v", err))
+		return err
+	}
+	if config.ListeningPort != server.configuration.ListeningPort ||
+		config.UsersDatabase != server.configuration.UsersDatabase {
+		logging.RecordLogLine("warning: listening port and users database changes require a restart")
+	}
+	applyGlobalConfiguration(config)
+	if server.instancesChecker != nil {
+		server.instancesChecker.UpdateConfigurations(NewCheckerConfiguration(config))
+	}
+	server.configuration = config
+	logging.RecordLogLine(fmt.Sprintf("info: configuration reloaded from %s", config.FileName))
+	return nil
+}
+
+func (server *HealthCheckServer) handleAdmin() {
+	server.serverMux.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if !server.requireUserLevel(w, r, AdminUserLevel) {
+			return
+		}
+		if err := server.ReloadConfiguration(); err != nil {
+			http.Error(w, fmt.Sprintf("configuration rejected - %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "configuration reloaded")
+	})
+}
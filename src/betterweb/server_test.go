@@ -0,0 +1,266 @@
+package betterweb
+
+import (
+	"betterconfig"
+	"btrzaws"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testAuthenticator struct{}
+
+func (auth *testAuthenticator) GetUserLevel(username, password string) (int, error) {
+	if username == "tal" && password == "123456" {
+		return 1, nil
+	}
+	if username == "admin" && password == "654321" {
+		return AdminUserLevel, nil
+	}
+	return 0, nil
+}
+
+// simulatedFleet - healthy, slow and flapping services behind local http servers
+type simulatedFleet struct {
+	servers      []*httptest.Server
+	flappingHits int32
+}
+
+func createSimulatedFleet() *simulatedFleet {
+	fleet := &simulatedFleet{}
+	fleet.servers = []*httptest.Server{
+		httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(30 * time.Millisecond)
+		})),
+		httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&fleet.flappingHits, 1)%2 == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})),
+	}
+	return fleet
+}
+
+func (fleet *simulatedFleet) close() {
+	for _, server := range fleet.servers {
+		server.Close()
+	}
+}
+
+func (fleet *simulatedFleet) loader(t *testing.T) func() ([]*btrzaws.BetterezInstance, error) {
+	return func() ([]*btrzaws.BetterezInstance, error) {
+		return []*btrzaws.BetterezInstance{
+			createFleetInstance(t, "i-healthy", fleet.servers[0].Listener.Addr().String()),
+			createFleetInstance(t, "i-slow", fleet.servers[1].Listener.Addr().String()),
+			createFleetInstance(t, "i-flapping", fleet.servers[2].Listener.Addr().String()),
+		}, nil
+	}
+}
+
+func createTestServer(checker *InstancesChecker) *HealthCheckServer {
+	server := &HealthCheckServer{
+		ServerVersion:    "test",
+		usersTokens:      make(map[string]int),
+		authenticator:    &testAuthenticator{},
+		instancesChecker: checker,
+	}
+	server.setupHandlers()
+	return server
+}
+
+func getToken(t *testing.T, serverURL string) string {
+	return getUserToken(t, serverURL, "tal", "123456")
+}
+
+func getUserToken(t *testing.T, serverURL, username, password string) string {
+	resp, err := http.PostForm(serverURL+"/auth", url.Values{"username": {username}, "password": {password}})
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer resp.Body.Close()
+	authResponse := struct {
+		AuthCode string `json:"auth_code"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&authResponse); err != nil {
+		t.Error(err)
+	}
+	return authResponse.AuthCode
+}
+
+func getCheckResponse(t *testing.T, serverURL, token string) *ClientResponse {
+	resp, err := http.Get(serverURL + "/check?token=" + token)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("check returned %d", resp.StatusCode)
+		return nil
+	}
+	response := &ClientResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Error(err)
+	}
+	return response
+}
+
+// run with -race, scans and handlers share the checker state
+func TestScannerAndHandlersRace(t *testing.T) {
+	const scanCycles = 20
+	fleet := createSimulatedFleet()
+	defer fleet.close()
+	checker := &InstancesChecker{instancesLoader: fleet.loader(t)}
+	checker.Configurations.LatencyWarnThreshold = 20 * time.Millisecond
+	checker.Configurations.LatencyCriticalThreshold = time.Minute
+	checker.initChecker(nil)
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for cycle := 0; cycle < scanCycles; cycle++ {
+			if err := checker.runScanCycle(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var readers sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				token := getToken(t, webServer.URL)
+				response := getCheckResponse(t, webServer.URL, token)
+				if response != nil && len(response.Instances) != 0 && len(response.Instances) != 3 {
+					t.Errorf("partial snapshot with %d instances", len(response.Instances))
+				}
+			}
+		}()
+	}
+	<-done
+	readers.Wait()
+
+	response := getCheckResponse(t, webServer.URL, getToken(t, webServer.URL))
+	if response == nil || len(response.Instances) != 3 {
+		t.Fatal("bad final snapshot")
+	}
+	statuses := map[string]string{}
+	for _, instance := range response.Instances {
+		statuses[instance.InstanceID] = instance.ServiceStatus
+	}
+	if statuses["i-healthy"] != btrzaws.ServiceStatusOnline || statuses["i-slow"] != btrzaws.ServiceStatusDegraded {
+		t.Fatalf("bad statuses %v", statuses)
+	}
+	if response.ScanStatistics.InstancesChecked != 3 {
+		t.Fatalf("bad statistics %+v", response.ScanStatistics)
+	}
+	if checker.faultyInstances.get("i-flapping") > 1 {
+		t.Fatal("flapping instance should never accumulate faults")
+	}
+}
+
+func TestCheckRequiresToken(t *testing.T) {
+	checker := &InstancesChecker{instancesLoader: func() ([]*btrzaws.BetterezInstance, error) { return nil, nil }}
+	checker.initChecker(nil)
+	webServer := httptest.NewServer(createTestServer(checker).serverMux)
+	defer webServer.Close()
+	resp, err := http.Get(webServer.URL + "/check?token=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", resp.StatusCode)
+	}
+}
+
+func TestConfigurationReload(t *testing.T) {
+	directory, err := ioutil.TempDir("", "monitor-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "monitor.json")
+	ioutil.WriteFile(fileName, []byte(`{"checker":{"restart_threshold":3}}`), 0600)
+	config, err := betterconfig.Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &InstancesChecker{Configurations: NewCheckerConfiguration(config)}
+	checker.initChecker(nil)
+	server := createTestServer(checker)
+	server.configuration = config
+	checker.faultyInstances.increase("i-faulty")
+
+	ioutil.WriteFile(fileName, []byte(`{"checker":{"restart_threshold":5}}`), 0600)
+	if err = server.ReloadConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if checker.config().RestartThreshold != 5 {
+		t.Fatalf("restart threshold was not reloaded, %d", checker.config().RestartThreshold)
+	}
+	ioutil.WriteFile(fileName, []byte(`{"checker":{"restart_threshold":-1}}`), 0600)
+	if err = server.ReloadConfiguration(); err == nil {
+		t.Fatal("invalid configuration should be rejected")
+	}
+	if checker.config().RestartThreshold != 5 {
+		t.Fatal("rejected configuration should keep the running one")
+	}
+	if checker.faultyInstances.get("i-faulty") != 1 {
+		t.Fatal("fault counters should survive a reload")
+	}
+}
+
+func TestConfigurationReloadDuringStart(t *testing.T) {
+	directory, err := ioutil.TempDir("", "monitor-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "monitor.json")
+	ioutil.WriteFile(fileName, []byte(`{"checker":{"restart_threshold":3}}`), 0600)
+	config, err := betterconfig.Load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &HealthCheckServer{configuration: config}
+	ioutil.WriteFile(fileName, []byte(`{"checker":{"restart_threshold":5}}`), 0600)
+	reloaded := make(chan error)
+	go func() {
+		for reload := 0; reload < 20; reload++ {
+			if err := server.ReloadConfiguration(); err != nil {
+				reloaded <- err
+				return
+			}
+		}
+		reloaded <- nil
+	}()
+	checker := server.startInstancesChecker()
+	// what CheckInstances runs before the scan cycles
+	checker.init(nil)
+	if err = <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if checker.config().RestartThreshold != 5 {
+		t.Fatalf("the reload was lost, restart threshold %d", checker.config().RestartThreshold)
+	}
+}
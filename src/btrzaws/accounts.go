@@ -0,0 +1,91 @@
+package btrzaws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+)
+
+const (
+	// DefaultAccountName - the account of the monitor own credentials
+	DefaultAccountName = "default"
+	// DefaultRoleSessionName - sts session name when the profile has none
+	DefaultRoleSessionName = "btrz-aws-monitor"
+	// AssumedRoleExpiryWindow - assumed credentials are refreshed this long before they expire
+	AssumedRoleExpiryWindow = time.Minute
+)
+
+// AccountProfile - an aws account the monitor watches.
+// the role is assumed with sts, an empty RoleARN uses the monitor own credentials
+type AccountProfile struct {
+	Name        string `json:"name"`
+	RoleARN     string `json:"role_arn,omitempty"`
+	ExternalID  string `json:"external_id,omitempty"`
+	SessionName string `json:"session_name,omitempty"`
+	// Regions - overrides the configuration regions for this account
+	Regions []string `json:"regions,omitempty"`
+}
+
+// DefaultAccountProfiles - the monitor own account only
+func DefaultAccountProfiles() []*AccountProfile {
+	return []*AccountProfile{{Name: DefaultAccountName}}
+}
+
+// ValidateAccountProfiles - check that every profile is usable and uniquely named
+func ValidateAccountProfiles(profiles []*AccountProfile) error {
+	if len(profiles) == 0 {
+		return errors.New("no accounts")
+	}
+	names := make(map[string]bool)
+	for index, profile := range profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("account %d has no name", index)
+		}
+		if strings.Contains(profile.Name, "/") {
+			return fmt.Errorf("account %s: names can't contain /", profile.Name)
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("account %s is defined twice", profile.Name)
+		}
+		names[profile.Name] = true
+		if profile.RoleARN != "" && !strings.HasPrefix(profile.RoleARN, "arn:") {
+			return fmt.Errorf("account %s: bad role arn %s", profile.Name, profile.RoleARN)
+		}
+		if profile.RoleARN == "" && (profile.ExternalID != "" || profile.SessionName != "") {
+			return fmt.Errorf("account %s: external id and session name require a role arn", profile.Name)
+		}
+		for _, region := range profile.Regions {
+			if strings.TrimSpace(region) == "" {
+				return fmt.Errorf("account %s: empty region name", profile.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// GetRegions - the profile regions, or the given ones when the profile has none
+func (profile *AccountProfile) GetRegions(defaultRegions []string) []string {
+	if len(profile.Regions) > 0 {
+		return profile.Regions
+	}
+	return defaultRegions
+}
+
+// AssumeRoleCredentials - credentials of the profile role, assumed again shortly before they expire
+func (profile *AccountProfile) AssumeRoleCredentials(client stscreds.AssumeRoler) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(client, profile.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = profile.SessionName
+		if provider.RoleSessionName == "" {
+			provider.RoleSessionName = DefaultRoleSessionName
+		}
+		if profile.ExternalID != "" {
+			provider.ExternalID = aws.String(profile.ExternalID)
+		}
+		provider.ExpiryWindow = AssumedRoleExpiryWindow
+	})
+}
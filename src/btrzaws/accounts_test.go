@@ -0,0 +1,90 @@
+package btrzaws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type fakeSTS struct {
+	inputs     []*sts.AssumeRoleInput
+	expiration time.Duration
+}
+
+func (client *fakeSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	client.inputs = append(client.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("assumed-key"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(client.expiration)),
+	}}, nil
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	client := &fakeSTS{expiration: time.Hour}
+	profile := &AccountProfile{Name: "staging", RoleARN: "arn:aws:iam::222222222222:role/monitor", ExternalID: "btrz"}
+	credentials := profile.AssumeRoleCredentials(client)
+	value, err := credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "assumed-key" || len(client.inputs) != 1 {
+		t.Fatal("role was not assumed")
+	}
+	input := client.inputs[0]
+	if aws.StringValue(input.ExternalId) != "btrz" || aws.StringValue(input.RoleSessionName) != DefaultRoleSessionName {
+		t.Fatalf("bad assume role input %v", input)
+	}
+	credentials.Get()
+	if len(client.inputs) != 1 {
+		t.Fatal("valid credentials should be reused")
+	}
+
+	client = &fakeSTS{expiration: AssumedRoleExpiryWindow / 2}
+	credentials = profile.AssumeRoleCredentials(client)
+	credentials.Get()
+	credentials.Get()
+	if len(client.inputs) != 2 {
+		t.Fatal("credentials about to expire should be refreshed")
+	}
+}
+
+func TestValidateAccountProfiles(t *testing.T) {
+	if err := ValidateAccountProfiles(DefaultAccountProfiles()); err != nil {
+		t.Fatal(err)
+	}
+	invalidProfiles := [][]*AccountProfile{
+		{},
+		{{Name: ""}},
+		{{Name: "staging"}, {Name: "staging"}},
+		{{Name: "staging", RoleARN: "monitor"}},
+		{{Name: "staging", ExternalID: "btrz"}},
+		{{Name: "staging/ca"}},
+	}
+	for _, profiles := range invalidProfiles {
+		if ValidateAccountProfiles(profiles) == nil {
+			t.Errorf("%v should be rejected", profiles)
+		}
+	}
+}
+
+func TestQualifiedID(t *testing.T) {
+	instance := &BetterezInstance{InstanceID: "i-1"}
+	if instance.GetQualifiedID() != "i-1" {
+		t.Fatal("instances without a target should use the instance id")
+	}
+	target, err := CreateMonitoringTarget(&AccountProfile{Name: "sandbox"}, "ca-central-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.SetTarget(target)
+	if instance.GetQualifiedID() != "sandbox/ca-central-1/i-1" {
+		t.Fatalf("bad qualified id %s", instance.GetQualifiedID())
+	}
+	if _, err = CreateMonitoringTarget(&AccountProfile{Name: "staging", RoleARN: "arn:aws:iam::1:role/r"}, "", nil); err == nil {
+		t.Fatal("roles can't be assumed without an sts client")
+	}
+}
@@ -0,0 +1,84 @@
+package btrzaws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+	// HealthStatusHealthy, HealthStatusUnhealthy - auto scaling health statuses
+	HealthStatusHealthy   = "Healthy"
+	HealthStatusUnhealthy = "Unhealthy"
+)
+
+// GroupCapacity - desired capacity of an auto scaling group and its healthy in service instances
+type GroupCapacity struct {
+	Name             string
+	Desired          int
+	Healthy          int
+	HealthyInstances []string
+}
+
+// MarkUnhealthy - set the instance health to Unhealthy in its auto scaling group, the group replaces it
+// with its lifecycle hooks and connection draining
+func (instance *BetterezInstance) MarkUnhealthy() error {
+	if !instance.IsInstanceOnAutoScalingGroup() {
+		return fmt.Errorf("%s is not on an auto scaling group", instance.GetQualifiedID())
+	}
+	clients, err := instance.getClients()
+	if err != nil {
+		return err
+	}
+	_, err = clients.AutoScaling.SetInstanceHealth(&autoscaling.SetInstanceHealthInput{
+		InstanceId:               aws.String(instance.InstanceID),
+		HealthStatus:             aws.String(HealthStatusUnhealthy),
+		ShouldRespectGracePeriod: aws.Bool(false),
+	})
+	return err
+}
+
+// GetGroupCapacity - the capacity of the instance auto scaling group
+func (instance *BetterezInstance) GetGroupCapacity() (*GroupCapacity, error) {
+	if !instance.IsInstanceOnAutoScalingGroup() {
+		return nil, fmt.Errorf("%s is not on an auto scaling group", instance.GetQualifiedID())
+	}
+	clients, err := instance.getClients()
+	if err != nil {
+		return nil, err
+	}
+	output, err := clients.AutoScaling.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(instance.AutoScalingGroupName)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("auto scaling group %s not found", instance.AutoScalingGroupName)
+	}
+	group := output.AutoScalingGroups[0]
+	capacity := &GroupCapacity{
+		Name:             instance.AutoScalingGroupName,
+		Desired:          int(aws.Int64Value(group.DesiredCapacity)),
+		HealthyInstances: []string{},
+	}
+	for _, groupInstance := range group.Instances {
+		if aws.StringValue(groupInstance.HealthStatus) == HealthStatusHealthy &&
+			aws.StringValue(groupInstance.LifecycleState) == autoscaling.LifecycleStateInService {
+			capacity.HealthyInstances = append(capacity.HealthyInstances, aws.StringValue(groupInstance.InstanceId))
+		}
+	}
+	capacity.Healthy = len(capacity.HealthyInstances)
+	return capacity, nil
+}
+
+// IsHealthyMember - true when the instance is one of the healthy in service instances of the group
+func (capacity *GroupCapacity) IsHealthyMember(instanceID string) bool {
+	for _, healthyInstance := range capacity.HealthyInstances {
+		if healthyInstance == instanceID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package btrzaws
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// EC2API - the ec2 operations the monitor uses
+type EC2API interface {
+	InstancesDescriber
+	StopInstances(*ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error)
+	StartInstances(*ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error)
+	RebootInstances(*ec2.RebootInstancesInput) (*ec2.RebootInstancesOutput, error)
+	TerminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	GetConsoleOutput(*ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error)
+}
+
+// SNSAPI - the sns operations used to send text messages
+type SNSAPI interface {
+	SetSMSAttributes(*sns.SetSMSAttributesInput) (*sns.SetSMSAttributesOutput, error)
+	Publish(*sns.PublishInput) (*sns.PublishOutput, error)
+}
+
+// ELBAPI - the load balancer operations the monitor uses
+type ELBAPI interface {
+	DescribeLoadBalancers(*elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error)
+	DescribeTags(*elb.DescribeTagsInput) (*elb.DescribeTagsOutput, error)
+	DescribeInstanceHealth(*elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error)
+}
+
+// AutoScalingAPI - the auto scaling operations the monitor uses
+type AutoScalingAPI interface {
+	DescribeAutoScalingGroups(*autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	DescribeAutoScalingInstances(*autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+	SetInstanceHealth(*autoscaling.SetInstanceHealthInput) (*autoscaling.SetInstanceHealthOutput, error)
+}
+
+// SSMAPI - the systems manager operations used to run remediation commands
+type SSMAPI interface {
+	SendCommand(*ssm.SendCommandInput) (*ssm.SendCommandOutput, error)
+	GetCommandInvocation(*ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error)
+}
+
+// AWSClients - the aws clients of a monitoring target
+type AWSClients struct {
+	EC2         EC2API
+	SNS         SNSAPI
+	ELB         ELBAPI
+	AutoScaling AutoScalingAPI
+	SSM         SSMAPI
+}
+
+// NewAWSClients - the aws sdk clients of the session
+func NewAWSClients(sess *session.Session) *AWSClients {
+	return &AWSClients{
+		EC2:         ec2.New(sess),
+		SNS:         sns.New(sess),
+		ELB:         elb.New(sess),
+		AutoScaling: autoscaling.New(sess),
+		SSM:         ssm.New(sess),
+	}
+}
+
+// TargetFactory - creates the monitoring target of an account region
+type TargetFactory func(account *AccountProfile, region string) (*MonitoringTarget, error)
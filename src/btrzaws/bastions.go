@@ -0,0 +1,130 @@
+package btrzaws
+
+import (
+	"fmt"
+	"path/filepath"
+	"sshconnector"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// BastionTag - instance tag naming the bastion to reach it through, "none" to connect directly
+	BastionTag = "SSH-Bastion"
+	// NoBastion - BastionTag value of instances reached directly
+	NoBastion = "none"
+)
+
+// SSHBastion - a jump host, used for the instances of its vpcs or tagged with its name
+type SSHBastion struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+	User    string `json:"user"`
+	// KeyFile - private key file, relative to the ssh keys location
+	KeyFile  string `json:"key_file,omitempty"`
+	Password string `json:"password,omitempty"`
+	// UseAgent - authenticate with the keys of the ssh agent
+	UseAgent bool `json:"use_agent,omitempty"`
+	// Via - name of the bastion this one is reached through
+	Via  string   `json:"via,omitempty"`
+	VPCs []string `json:"vpcs,omitempty"`
+}
+
+// ValidateSSHBastions - names are unique, every bastion has an address, a user and credentials,
+// and the via chains end
+func ValidateSSHBastions(bastions []*SSHBastion) error {
+	names := map[string]*SSHBastion{}
+	for index, bastion := range bastions {
+		if bastion.Name == "" || bastion.Name == NoBastion {
+			return fmt.Errorf("bastion %d has no name", index)
+		}
+		if names[bastion.Name] != nil {
+			return fmt.Errorf("duplicate bastion %s", bastion.Name)
+		}
+		names[bastion.Name] = bastion
+		if bastion.Address == "" || bastion.User == "" {
+			return fmt.Errorf("bastion %s needs an address and a user", bastion.Name)
+		}
+		if bastion.Port < 0 || bastion.Port > 65535 {
+			return fmt.Errorf("bastion %s: bad port %d", bastion.Name, bastion.Port)
+		}
+		if bastion.KeyFile == "" && bastion.Password == "" && !bastion.UseAgent {
+			return fmt.Errorf("bastion %s has no credentials", bastion.Name)
+		}
+	}
+	for _, bastion := range bastions {
+		if _, err := GetBastionChain(bastions, bastion.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBastionChain - the bastions to go through to reach the named one, the named one last
+func GetBastionChain(bastions []*SSHBastion, name string) ([]*SSHBastion, error) {
+	chain := []*SSHBastion{}
+	for name != "" {
+		bastion := findBastion(bastions, name)
+		if bastion == nil {
+			return nil, fmt.Errorf("unknown bastion %s", name)
+		}
+		for _, previous := range chain {
+			if previous == bastion {
+				return nil, fmt.Errorf("bastion %s is reached through itself", name)
+			}
+		}
+		chain = append([]*SSHBastion{bastion}, chain...)
+		name = bastion.Via
+	}
+	return chain, nil
+}
+
+func findBastion(bastions []*SSHBastion, name string) *SSHBastion {
+	for _, bastion := range bastions {
+		if bastion.Name == name {
+			return bastion
+		}
+	}
+	return nil
+}
+
+// SelectBastions - the jump hosts of the instance, from its SSH-Bastion tag or its vpc. empty to connect directly
+func SelectBastions(bastions []*SSHBastion, instance *BetterezInstance) ([]*SSHBastion, error) {
+	if name := strings.TrimSpace(instance.GetTagValue(BastionTag)); name != "" {
+		if name == NoBastion {
+			return nil, nil
+		}
+		return GetBastionChain(bastions, name)
+	}
+	if instance.AwsInstance == nil {
+		return nil, nil
+	}
+	vpcID := aws.StringValue(instance.AwsInstance.VpcId)
+	for _, bastion := range bastions {
+		for _, vpc := range bastion.VPCs {
+			if vpc == vpcID {
+				return GetBastionChain(bastions, bastion.Name)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetHop - the bastion as a route hop, its host key is verified with the known hosts by address
+func (bastion *SSHBastion) GetHop(knownHosts *sshconnector.KnownHosts) sshconnector.Hop {
+	keyFile := bastion.KeyFile
+	if keyFile != "" && !filepath.IsAbs(keyFile) {
+		keyFile = GetKeysPath() + keyFile
+	}
+	return sshconnector.Hop{
+		Address:         bastion.Address,
+		Port:            bastion.Port,
+		User:            bastion.User,
+		KeyFile:         keyFile,
+		Password:        bastion.Password,
+		UseAgent:        bastion.UseAgent,
+		HostKeyCallback: knownHosts.HostKeyCallback(bastion.Address),
+	}
+}
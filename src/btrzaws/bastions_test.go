@@ -0,0 +1,84 @@
+package btrzaws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func createBastionInstance(vpcID, bastionTag string) *BetterezInstance {
+	instance := &ec2.Instance{InstanceId: aws.String("i-api"), VpcId: aws.String(vpcID)}
+	if bastionTag != "" {
+		instance.Tags = []*ec2.Tag{{Key: aws.String(BastionTag), Value: aws.String(bastionTag)}}
+	}
+	return &BetterezInstance{InstanceID: "i-api", AwsInstance: instance}
+}
+
+func getBastionNames(bastions []*SSHBastion) []string {
+	names := []string{}
+	for _, bastion := range bastions {
+		names = append(names, bastion.Name)
+	}
+	return names
+}
+
+func TestSelectBastions(t *testing.T) {
+	bastions := []*SSHBastion{
+		{Name: "edge", Address: "bastion.example.com", User: "jump", UseAgent: true},
+		{Name: "private", Address: "10.0.0.10", User: "ubuntu", KeyFile: "bastion.pem", Via: "edge", VPCs: []string{"vpc-private"}},
+		{Name: "staging", Address: "10.1.0.10", User: "ubuntu", Password: "secret", VPCs: []string{"vpc-staging"}},
+	}
+	if err := ValidateSSHBastions(bastions); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		vpcID      string
+		bastionTag string
+		expected   []string
+	}{
+		{"vpc-private", "", []string{"edge", "private"}},
+		{"vpc-staging", "", []string{"staging"}},
+		{"vpc-public", "", []string{}},
+		{"vpc-private", "none", []string{}},
+		{"vpc-public", "edge", []string{"edge"}},
+	}
+	for _, testCase := range cases {
+		selected, err := SelectBastions(bastions, createBastionInstance(testCase.vpcID, testCase.bastionTag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := getBastionNames(selected); len(names) != len(testCase.expected) ||
+			(len(names) > 0 && names[0] != testCase.expected[0]) {
+			t.Errorf("%s %s: expected %v, got %v", testCase.vpcID, testCase.bastionTag, testCase.expected, names)
+		}
+	}
+	if _, err := SelectBastions(bastions, createBastionInstance("vpc-public", "missing")); err == nil {
+		t.Error("an unknown bastion tag should fail")
+	}
+	hop := bastions[1].GetHop(getKnownHosts())
+	if hop.KeyFile != GetKeysPath()+"bastion.pem" || hop.GetAddress() != "10.0.0.10:22" {
+		t.Errorf("bad hop %+v", hop)
+	}
+}
+
+func TestValidateSSHBastions(t *testing.T) {
+	invalidBastions := [][]*SSHBastion{
+		{{Name: "edge", User: "jump", UseAgent: true}},
+		{{Name: "edge", Address: "10.0.0.1", User: "jump"}},
+		{{Name: "edge", Address: "10.0.0.1", User: "jump", UseAgent: true, Via: "missing"}},
+		{
+			{Name: "first", Address: "10.0.0.1", User: "jump", UseAgent: true, Via: "second"},
+			{Name: "second", Address: "10.0.0.2", User: "jump", UseAgent: true, Via: "first"},
+		},
+		{
+			{Name: "edge", Address: "10.0.0.1", User: "jump", UseAgent: true},
+			{Name: "edge", Address: "10.0.0.2", User: "jump", UseAgent: true},
+		},
+	}
+	for index, bastions := range invalidBastions {
+		if err := ValidateSSHBastions(bastions); err == nil {
+			t.Errorf("bastions %d should be rejected", index)
+		}
+	}
+}
@@ -1,12 +1,9 @@
 package btrzaws
 
 import (
-	"errors"
+	"encoding/base64"
 	"fmt"
-	"logging"
-	"net/http"
 	"os"
-	"sshconnector"
 	"strconv"
 	"strings"
 	"time"
@@ -35,6 +32,24 @@ type BetterezInstance struct {
 	HealthcheckPath        string
 	HelthcheckPort         int
 	AutoScalingGroupName   string
+	// Account, Region - where the instance runs, set from the target it was discovered in
+	Account string
+	Region  string
+	// Target - where the instance was discovered, remediation goes through its session
+	Target *MonitoringTarget `json:"-"`
+	// HealthcheckProtocol - tcp, http, https or grpc. http when empty
+	HealthcheckProtocol          string
+	HealthcheckVerifyCertificate bool
+	// HealthcheckService - service name sent with grpc healthchecks
+	HealthcheckService string
+	HealthcheckSpec    *HealthcheckSpec
+	// HealthcheckEndpoint - resolved by the checker routes, the default routes are used when nil
+	HealthcheckEndpoint *HealthcheckEndpoint
+	// ResponseTime - duration of the last healthcheck
+	ResponseTime time.Duration
+	// LatencyWarnThreshold, LatencyCriticalThreshold - tag overrides, 0 to use the checker defaults
+	LatencyWarnThreshold     time.Duration
+	LatencyCriticalThreshold time.Duration
 }
 
 const (
@@ -42,6 +57,24 @@ const (
 	StandradAPIPort   = 3000
 )
 
+const (
+	// ServiceStatusOnline - instance passed the healthcheck
+	ServiceStatusOnline = "online"
+	// ServiceStatusDegraded - instance passed the healthcheck but it's too slow
+	ServiceStatusDegraded = "degraded"
+	// ServiceStatusOffline - instance failed the healthcheck
+	ServiceStatusOffline = "offline"
+)
+
+const (
+	// LatencyNormal - response time below the warn threshold
+	LatencyNormal = iota
+	// LatencyWarning - response time above the warn threshold
+	LatencyWarning
+	// LatencyCritical - response time above the critical threshold
+	LatencyCritical
+)
+
 func LoadFromAWSInstance(instance *ec2.Instance) *BetterezInstance {
 	result := &BetterezInstance{
 		Environment:          GetTagValue(instance, "Environment"),
@@ -51,10 +84,14 @@ func LoadFromAWSInstance(instance *ec2.Instance) *BetterezInstance {
 		HealthcheckPath:      GetTagValue(instance, "Healtcheck-Path"),
 		TerminateOnFault:     GetTagValue(instance, "Terminate on fault"),
 		AutoScalingGroupName: GetTagValue(instance, "aws:autoscaling:groupName"),
-		InstanceID:           *instance.InstanceId,
-		KeyName:              *instance.KeyName,
+		HealthcheckProtocol:  strings.ToLower(GetTagValue(instance, "Healthcheck-Protocol")),
+		HealthcheckService:   GetTagValue(instance, "Healthcheck-Service"),
+		HealthcheckSpec:      LoadHealthcheckSpec(instance),
+		InstanceID:           aws.StringValue(instance.InstanceId),
+		KeyName:              aws.StringValue(instance.KeyName),
 		AwsInstance:          instance,
 	}
+	result.HealthcheckVerifyCertificate = GetTagValue(instance, "Healthcheck-Verify-Certificate") == "yes"
 
 	if instance.PublicIpAddress != nil {
 		result.PublicIPAddress = *instance.PublicIpAddress
@@ -74,9 +111,19 @@ func LoadFromAWSInstance(instance *ec2.Instance) *BetterezInstance {
 	if err != nil {
 		result.HelthcheckPort = 0
 	}
+	result.LatencyWarnThreshold = getMillisecondsTag(instance, "Healthcheck-Latency-Warn")
+	result.LatencyCriticalThreshold = getMillisecondsTag(instance, "Healthcheck-Latency-Critical")
 	return result
 }
 
+func getMillisecondsTag(instance *ec2.Instance, tagName string) time.Duration {
+	milliseconds, err := strconv.Atoi(GetTagValue(instance, tagName))
+	if err != nil || milliseconds < 0 {
+		return 0
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
 func (instance *BetterezInstance) IsInstanceOnAutoScalingGroup() bool {
 	return instance.AutoScalingGroupName != ""
 }
@@ -103,47 +150,38 @@ func (instance *BetterezInstance) IsSameInstanceAs(compInstance *BetterezInstanc
 	return true
 }
 
-func (instance *BetterezInstance) GetHealthCheckString() string {
-	port := instance.HelthcheckPort
-	if instance.HelthcheckPort == 0 {
-		port = StandradAPIPort
-	}
-	var testURL string
-	var testIPAddress string
+func (instance *BetterezInstance) getHealthCheckIPAddress() string {
 	if instance.PublicIPAddress != "" {
-		testIPAddress = instance.PublicIPAddress
-	} else {
-		testIPAddress = instance.PrivateIPAddress
+		return instance.PublicIPAddress
 	}
-	if isUsingElixir(instance.PathName) {
-		port = getElixrPort()
-	}
-	if instance.Repository == "connex2" {
-		port = getConnexPort()
-		testURL = fmt.Sprintf("http://%s:%d/healthcheck", testIPAddress, port)
-	} else if instance.PathName != "/" {
-		testURL = fmt.Sprintf("http://%s:%d/%s/healthcheck", testIPAddress, port, instance.PathName)
-	} else {
-		testURL = fmt.Sprintf("http://%s:%d/%s", testIPAddress, port, instance.HealthcheckPath)
+	return instance.PrivateIPAddress
+}
+
+// GetHealthcheckEndpoint - the resolved endpoint, or the one from the default routes
+func (instance *BetterezInstance) GetHealthcheckEndpoint() *HealthcheckEndpoint {
+	if instance.HealthcheckEndpoint != nil {
+		return instance.HealthcheckEndpoint
 	}
-	return testURL
+	return ResolveHealthcheckEndpoint(DefaultHealthcheckRoutes(), instance)
 }
 
-func getElixrPort() int {
-	return 4000
+// GetHealthCheckAddress - return host:port for tcp and grpc healthchecks
+func (instance *BetterezInstance) GetHealthCheckAddress() string {
+	return fmt.Sprintf("%s:%d", instance.getHealthCheckIPAddress(), instance.GetHealthcheckEndpoint().Port)
 }
 
-func getConnexPort() int {
-	return 22000
+func (instance *BetterezInstance) GetHealthCheckString() string {
+	endpoint := instance.GetHealthcheckEndpoint()
+	return fmt.Sprintf("%s://%s:%d%s", endpoint.Scheme, instance.getHealthCheckIPAddress(), endpoint.Port, endpoint.Path)
 }
 
-func isUsingElixir(pathName string) bool {
-	if pathName == "webhooks" || pathName == "liveseatmaps" ||
-		pathName == "loyalty" ||
-		pathName == "seatmaps" {
-		return true
+// GetHealthChecker - return the checker matching the instance protocol
+func (instance *BetterezInstance) GetHealthChecker() HealthChecker {
+	checker := GetHealthChecker(instance.GetHealthcheckEndpoint().Protocol)
+	if httpChecker, ok := checker.(*HTTPHealthChecker); ok && httpChecker.UseTLS {
+		httpChecker.VerifyCertificate = instance.HealthcheckVerifyCertificate
 	}
-	return false
+	return checker
 }
 
 // CheckInstanceHealth - checks instance health
@@ -151,30 +189,47 @@ func (instance *BetterezInstance) CheckInstanceHealth() (bool, error) {
 	if instance == nil || instance.PrivateIPAddress == "" {
 		return true, nil
 	}
-	httpClient := http.Client{
-		Timeout: ConnectionTimeout,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-	resp, err := httpClient.Get(instance.GetHealthCheckString())
+	checkStart := time.Now()
+	ok, err := instance.GetHealthChecker().Check(instance)
 	instance.StatusCheck = time.Now()
+	instance.ResponseTime = instance.StatusCheck.Sub(checkStart)
 	if err != nil {
-		instance.ServiceStatus = "offline"
+		instance.ServiceStatus = ServiceStatusOffline
 		instance.ServiceStatusErrorCode = fmt.Sprintf("%v", err)
 		//log.Printf("Error %v healthcheck instance %s", err, instance.InstanceID)
 		return false, err
 	}
-	defer resp.Body.Close()
-	//log.Print("checking ", instance.Repository, "...")
-	if resp.StatusCode > 0 && resp.StatusCode < 400 {
-		instance.ServiceStatus = "online"
+	if ok {
+		instance.ServiceStatus = ServiceStatusOnline
 		instance.ServiceStatusErrorCode = ""
 		return true, nil
 	}
 	return false, nil
 }
 
+// ApplyLatencyThresholds - mark the instance as degraded if the last check was too slow.
+// tag thresholds take precedence over the given defaults. returns the latency level
+func (instance *BetterezInstance) ApplyLatencyThresholds(defaultWarn, defaultCritical time.Duration) int {
+	warn, critical := defaultWarn, defaultCritical
+	if instance.LatencyWarnThreshold > 0 {
+		warn = instance.LatencyWarnThreshold
+	}
+	if instance.LatencyCriticalThreshold > 0 {
+		critical = instance.LatencyCriticalThreshold
+	}
+	if critical > 0 && instance.ResponseTime >= critical {
+		instance.ServiceStatus = ServiceStatusDegraded
+		instance.ServiceStatusErrorCode = fmt.Sprintf("response time %v above critical threshold %v", instance.ResponseTime, critical)
+		return LatencyCritical
+	}
+	if warn > 0 && instance.ResponseTime >= warn {
+		instance.ServiceStatus = ServiceStatusDegraded
+		instance.ServiceStatusErrorCode = fmt.Sprintf("response time %v above warn threshold %v", instance.ResponseTime, warn)
+		return LatencyWarning
+	}
+	return LatencyNormal
+}
+
 // GetTagValue - return the tag value by name or an empty string
 func (instance *BetterezInstance) GetTagValue(tagName string) string {
 	return GetTagValue(instance.AwsInstance, tagName)
@@ -182,7 +237,7 @@ func (instance *BetterezInstance) GetTagValue(tagName string) string {
 
 // GetKeysPath - return a string with the key path
 func GetKeysPath() string {
-	location := os.Getenv("SSH_KEYS_LOCATION")
+	location := getKeysLocation()
 	if !strings.HasSuffix(location, fmt.Sprintf("%c", os.PathSeparator)) {
 		location += fmt.Sprintf("%c", os.PathSeparator)
 	}
@@ -190,12 +245,11 @@ func GetKeysPath() string {
 }
 
 func (instance *BetterezInstance) TerminateInstance() error {
-	sess, err := GetAWSSession()
+	clients, err := instance.getClients()
 	if err != nil {
 		return err
 	}
-	ec2Service := ec2.New(sess)
-	_, err = ec2Service.TerminateInstances(
+	_, err = clients.EC2.TerminateInstances(
 		&ec2.TerminateInstancesInput{
 			DryRun: aws.Bool(false),
 			InstanceIds: []*string{
@@ -207,69 +261,109 @@ func (instance *BetterezInstance) TerminateInstance() error {
 	return err
 }
 
-func (instance *BetterezInstance) RestartService() error {
-	serviceName := instance.GetTagValue("Repository")
-	if serviceName == "" {
-		return errors.New("no service name found")
-	}
-	if GetKeysPath() == "" {
-		return errors.New("no keys path")
+// StopServer - ask ec2 to stop the instance
+func (instance *BetterezInstance) StopServer() error {
+	clients, err := instance.getClients()
+	if err != nil {
+		return err
 	}
+	_, err = clients.EC2.StopInstances(&ec2.StopInstancesInput{
+		DryRun: aws.Bool(false),
+		InstanceIds: []*string{
+			aws.String(instance.InstanceID),
+		},
+	})
+	return err
+}
 
-	keyFileLocation := fmt.Sprintf("%s%s.pem", GetKeysPath(), instance.KeyName)
-	if _, err := os.Stat(keyFileLocation); os.IsNotExist(err) {
-		return fmt.Errorf("%s key file doesn't exist", keyFileLocation)
-	}
-	sshConnection, err := sshconnector.CreateSSHSession(instance.PrivateIPAddress, "ubuntu", keyFileLocation, 22, sshconnector.UseKey)
+// StartServer - ask ec2 to start the stopped instance
+func (instance *BetterezInstance) StartServer() error {
+	clients, err := instance.getClients()
 	if err != nil {
 		return err
 	}
-	err = sshConnection.Run(fmt.Sprintf("sudo service %s restart", serviceName))
+	_, err = clients.EC2.StartInstances(&ec2.StartInstancesInput{
+		DryRun: aws.Bool(false),
+		InstanceIds: []*string{
+			aws.String(instance.InstanceID),
+		},
+	})
 	return err
 }
 
-func (instance *BetterezInstance) RestartServer() error {
-	session, err := GetAWSSession()
+// RebootServer - ask ec2 to reboot the instance
+func (instance *BetterezInstance) RebootServer() error {
+	clients, err := instance.getClients()
 	if err != nil {
 		return err
 	}
-	ec2Service := ec2.New(session)
-	_, err = ec2Service.StopInstances(&ec2.StopInstancesInput{
+	_, err = clients.EC2.RebootInstances(&ec2.RebootInstancesInput{
 		DryRun: aws.Bool(false),
 		InstanceIds: []*string{
 			aws.String(instance.InstanceID),
 		},
 	})
+	return err
+}
+
+// GetServerState - the current ec2 state name of the instance
+func (instance *BetterezInstance) GetServerState() (string, error) {
+	awsInstance, err := instance.describe()
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(awsInstance.State.Name), nil
+}
+
+// RefreshAddresses - take the current ip addresses of the instance, a stop and start gives it a new public ip
+func (instance *BetterezInstance) RefreshAddresses() error {
+	awsInstance, err := instance.describe()
 	if err != nil {
 		return err
 	}
-	processStatus := 0
-	go func() {
-		for {
-			time.Sleep(10)
-			output, err := ec2Service.DescribeInstances(&ec2.DescribeInstancesInput{
-				DryRun: aws.Bool(false),
-				InstanceIds: []*string{
-					aws.String(instance.InstanceID),
-				},
-			})
-			if err != nil {
-				break
-			}
-			if *output.Reservations[0].Instances[0].State.Name == "stopped" && processStatus == 0 {
-				logging.RecordLogLine(fmt.Sprintf("server %s stopped", instance.InstanceID))
-				processStatus = 1
-				ec2Service.StartInstances(&ec2.StartInstancesInput{
-					DryRun: aws.Bool(false),
-					InstanceIds: []*string{
-						aws.String(instance.InstanceID),
-					},
-				})
-			} else if processStatus == 1 && *output.Reservations[0].Instances[0].State.Name == "running" {
-				logging.RecordLogLine(fmt.Sprintf("server %s is running", instance.InstanceID))
-				break
-			}
-		}
-	}()
+	instance.PublicIPAddress = aws.StringValue(awsInstance.PublicIpAddress)
+	instance.PrivateIPAddress = aws.StringValue(awsInstance.PrivateIpAddress)
+	instance.AwsInstance = awsInstance
 	return nil
 }
+
+// describe - the current ec2 description of the instance
+func (instance *BetterezInstance) describe() (*ec2.Instance, error) {
+	clients, err := instance.getClients()
+	if err != nil {
+		return nil, err
+	}
+	output, err := clients.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
+		DryRun: aws.Bool(false),
+		InstanceIds: []*string{
+			aws.String(instance.InstanceID),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 ||
+		output.Reservations[0].Instances[0].State == nil {
+		return nil, fmt.Errorf("instance %s not found", instance.GetQualifiedID())
+	}
+	return output.Reservations[0].Instances[0], nil
+}
+
+// GetConsoleOutput - the decoded console output of the instance
+func (instance *BetterezInstance) GetConsoleOutput() (string, error) {
+	clients, err := instance.getClients()
+	if err != nil {
+		return "", err
+	}
+	output, err := clients.EC2.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instance.InstanceID),
+	})
+	if err != nil {
+		return "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(output.Output))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
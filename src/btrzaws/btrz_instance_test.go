@@ -1,6 +1,15 @@
 package btrzaws
 
-import "testing"
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 type AwsTestInstance struct {
 	BetterezInstance
@@ -25,3 +34,126 @@ func TestHealthcheck(t *testing.T) {
 		t.Fatal("failed to create a test instance")
 	}
 }
+
+func createLocalInstance(t *testing.T, serverURL string) *BetterezInstance {
+	parsedURL, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(parsedURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &BetterezInstance{
+		InstanceID:       "i-local",
+		PrivateIPAddress: parsedURL.Hostname(),
+		PathName:         "/",
+		HealthcheckPath:  "healthcheck",
+		HelthcheckPort:   port,
+	}
+}
+
+func TestHTTPHealthcheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthcheck" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	instance := createLocalInstance(t, server.URL)
+	ok, err := instance.CheckInstanceHealth()
+	if !ok || err != nil {
+		t.Fatalf("expected healthy instance, got %v %v", ok, err)
+	}
+	if instance.ServiceStatus != "online" {
+		t.Fatalf("bad status %s", instance.ServiceStatus)
+	}
+	instance.HealthcheckPath = "missing"
+	ok, _ = instance.CheckInstanceHealth()
+	if ok {
+		t.Fatal("404 should not be healthy")
+	}
+}
+
+func TestHTTPSHealthcheck(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	instance := createLocalInstance(t, server.URL)
+	instance.HealthcheckProtocol = ProtocolHTTPS
+	if !strings.HasPrefix(instance.GetHealthCheckString(), "https://") {
+		t.Fatalf("bad healthcheck url %s", instance.GetHealthCheckString())
+	}
+	ok, err := instance.CheckInstanceHealth()
+	if !ok || err != nil {
+		t.Fatalf("expected healthy instance, got %v %v", ok, err)
+	}
+	instance.HealthcheckVerifyCertificate = true
+	ok, err = instance.CheckInstanceHealth()
+	if ok || err == nil {
+		t.Fatal("self signed certificate should fail verification")
+	}
+}
+
+func TestHTTPSHealthcheckReusesConnections(t *testing.T) {
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(connection net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	instance := createLocalInstance(t, server.URL)
+	instance.HealthcheckProtocol = ProtocolHTTPS
+	for check := 0; check < 3; check++ {
+		if ok, err := instance.CheckInstanceHealth(); !ok || err != nil {
+			t.Fatalf("expected healthy instance, got %v %v", ok, err)
+		}
+	}
+	if connections != 1 {
+		t.Fatalf("expected the checks to share 1 connection, got %d", connections)
+	}
+}
+
+func TestTCPHealthcheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := createLocalInstance(t, "tcp://"+listener.Addr().String())
+	instance.HealthcheckProtocol = ProtocolTCP
+	ok, err := instance.CheckInstanceHealth()
+	if !ok || err != nil {
+		t.Fatalf("expected healthy instance, got %v %v", ok, err)
+	}
+	listener.Close()
+	ok, _ = instance.CheckInstanceHealth()
+	if ok {
+		t.Fatal("closed port should not be healthy")
+	}
+	if instance.ServiceStatus != "offline" {
+		t.Fatalf("bad status %s", instance.ServiceStatus)
+	}
+}
+
+func TestLatencyThresholds(t *testing.T) {
+	instance := &BetterezInstance{ServiceStatus: ServiceStatusOnline, ResponseTime: 300 * time.Millisecond}
+	if level := instance.ApplyLatencyThresholds(time.Second, 2*time.Second); level != LatencyNormal {
+		t.Fatalf("expected normal latency, got %d", level)
+	}
+	if instance.ServiceStatus != ServiceStatusOnline {
+		t.Fatalf("bad status %s", instance.ServiceStatus)
+	}
+	instance.LatencyWarnThreshold = 200 * time.Millisecond
+	if level := instance.ApplyLatencyThresholds(time.Second, 2*time.Second); level != LatencyWarning {
+		t.Fatalf("tag threshold should win, got %d", level)
+	}
+	if instance.ServiceStatus != ServiceStatusDegraded {
+		t.Fatalf("bad status %s", instance.ServiceStatus)
+	}
+	instance.ResponseTime = 3 * time.Second
+	if level := instance.ApplyLatencyThresholds(time.Second, 2*time.Second); level != LatencyCritical {
+		t.Fatalf("expected critical latency, got %d", level)
+	}
+}
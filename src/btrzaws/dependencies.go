@@ -0,0 +1,52 @@
+package btrzaws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DependsOnTag - instance tag listing the services it depends on, comma separated
+const DependsOnTag = "Depends-On"
+
+const (
+	// DefaultCorrelationMinFailing - failing dependents needed to correlate their failures
+	DefaultCorrelationMinFailing = 3
+	// DefaultCorrelationMinRatio - share of the dependents failing needed to correlate their failures
+	DefaultCorrelationMinRatio = 0.5
+)
+
+// GetDependencies - the services the instance depends on, from the configured repository dependencies and its Depends-On tag
+func (instance *BetterezInstance) GetDependencies(dependencies map[string][]string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	candidates := append([]string{}, dependencies[instance.Repository]...)
+	candidates = append(candidates, strings.Split(instance.GetTagValue(DependsOnTag), ",")...)
+	for _, name := range candidates {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] || name == instance.Repository {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// ValidateDependencies - services and their dependencies are named, a service doesn't depend on itself
+func ValidateDependencies(dependencies map[string][]string) error {
+	for repository, names := range dependencies {
+		if strings.TrimSpace(repository) == "" {
+			return errors.New("service dependencies need a repository name")
+		}
+		for _, name := range names {
+			if strings.TrimSpace(name) == "" {
+				return fmt.Errorf("empty dependency name for %s", repository)
+			}
+			if name == repository {
+				return fmt.Errorf("%s can't depend on itself", repository)
+			}
+		}
+	}
+	return nil
+}
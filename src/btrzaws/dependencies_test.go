@@ -0,0 +1,42 @@
+package btrzaws
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetDependencies(t *testing.T) {
+	dependencies := map[string][]string{"btrz-api-sales": {"mongo", "btrz-api-accounts"}}
+	cases := []struct {
+		repository string
+		tags       map[string]string
+		expected   string
+	}{
+		{"btrz-api-sales", nil, "mongo,btrz-api-accounts"},
+		{"btrz-api-sales", map[string]string{DependsOnTag: " redis, mongo,,"}, "mongo,btrz-api-accounts,redis"},
+		{"btrz-worker-email", map[string]string{DependsOnTag: "mongo, btrz-worker-email"}, "mongo"},
+		{"btrz-website", nil, ""},
+	}
+	for _, testCase := range cases {
+		names := createPolicyInstance(testCase.repository, testCase.tags).GetDependencies(dependencies)
+		if strings.Join(names, ",") != testCase.expected {
+			t.Errorf("%s %v: expected %q, got %v", testCase.repository, testCase.tags, testCase.expected, names)
+		}
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	if err := ValidateDependencies(map[string][]string{"btrz-api-sales": {"mongo"}}); err != nil {
+		t.Fatal(err)
+	}
+	invalidDependencies := []map[string][]string{
+		{"": {"mongo"}},
+		{"btrz-api-sales": {" "}},
+		{"btrz-api-sales": {"btrz-api-sales"}},
+	}
+	for _, dependencies := range invalidDependencies {
+		if ValidateDependencies(dependencies) == nil {
+			t.Errorf("%v should be rejected", dependencies)
+		}
+	}
+}
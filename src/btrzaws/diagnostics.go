@@ -0,0 +1,159 @@
+package btrzaws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultDiagnosticsJournalLines - service journal lines collected
+	DefaultDiagnosticsJournalLines = 200
+	// DefaultDiagnosticsDirectory - where the bundles are stored
+	DefaultDiagnosticsDirectory = "secrets/diagnostics"
+	// DefaultDiagnosticsBundlesKept - older bundles are removed from the directory
+	DefaultDiagnosticsBundlesKept = 100
+)
+
+// DiagnosticsSettings - the diagnostics bundle collected before restarting a service
+type DiagnosticsSettings struct {
+	Enabled      bool
+	JournalLines int
+	Directory    string
+	BundlesKept  int
+}
+
+// DiagnosticsCommand - a command of the bundle, its output is kept in the named section
+type DiagnosticsCommand struct {
+	Name    string
+	Command string
+}
+
+// DiagnosticsSection - a diagnostics command and its result
+type DiagnosticsSection struct {
+	Name string
+	CommandResult
+}
+
+// DiagnosticsBundle - the state of an instance before its service was restarted
+type DiagnosticsBundle struct {
+	ID          string
+	InstanceID  string
+	QualifiedID string
+	Repository  string
+	Collected   time.Time
+	Sections    []DiagnosticsSection
+	// Error - the reason some sections are missing
+	Error string `json:",omitempty"`
+}
+
+var diagnosticsBundleID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// GetDiagnosticsCommands - the journal of the service, disks, memory, connections and processes, by section name
+func GetDiagnosticsCommands(serviceName string, journalLines int) []DiagnosticsCommand {
+	if journalLines <= 0 {
+		journalLines = DefaultDiagnosticsJournalLines
+	}
+	return []DiagnosticsCommand{
+		{"journal", fmt.Sprintf("sudo journalctl -u %s -n %d --no-pager", serviceName, journalLines)},
+		{"disks", "df -h"},
+		{"memory", "free -m"},
+		{"connections", "sudo ss -tunap"},
+		{"processes", "ps aux --sort=-%cpu"},
+	}
+}
+
+// CollectDiagnostics - run the diagnostics commands with the instance executor.
+// the bundle keeps what was collected when a command couldn't be delivered
+func (instance *BetterezInstance) CollectDiagnostics(executors RemediationExecutors, settings DiagnosticsSettings,
+	collected time.Time) (*DiagnosticsBundle, error) {
+	serviceName := instance.GetTagValue("Repository")
+	if serviceName == "" {
+		return nil, errors.New("no service name found")
+	}
+	bundle := &DiagnosticsBundle{
+		ID:          fmt.Sprintf("%s-%d", instance.InstanceID, collected.Unix()),
+		InstanceID:  instance.InstanceID,
+		QualifiedID: instance.GetQualifiedID(),
+		Repository:  instance.Repository,
+		Collected:   collected,
+		Sections:    []DiagnosticsSection{},
+	}
+	diagnosticsCommands := GetDiagnosticsCommands(serviceName, settings.JournalLines)
+	commands := []string{}
+	for _, command := range diagnosticsCommands {
+		commands = append(commands, command.Command)
+	}
+	results, err := executors.RunCommands(instance, commands)
+	for index, result := range results {
+		bundle.Sections = append(bundle.Sections, DiagnosticsSection{Name: diagnosticsCommands[index].Name, CommandResult: *result})
+	}
+	if len(results) < len(commands) {
+		if err == nil {
+			err = errors.New("diagnostics commands missing")
+		}
+		bundle.Error = err.Error()
+		if len(results) == 0 {
+			return nil, err
+		}
+	}
+	// failed commands are part of the diagnostics
+	return bundle, nil
+}
+
+// SaveDiagnosticsBundle - write the bundle to the directory as <id>.json, the oldest bundles over the limit are removed
+func SaveDiagnosticsBundle(bundle *DiagnosticsBundle, directory string, bundlesKept int) error {
+	if !diagnosticsBundleID.MatchString(bundle.ID) {
+		return fmt.Errorf("bad diagnostics bundle id %s", bundle.ID)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(directory, bundle.ID+".json"), data, 0600); err != nil {
+		return err
+	}
+	return pruneDiagnosticsBundles(directory, bundlesKept)
+}
+
+// LoadDiagnosticsBundle - the raw json of a saved bundle
+func LoadDiagnosticsBundle(directory, id string) ([]byte, error) {
+	if !diagnosticsBundleID.MatchString(id) {
+		return nil, fmt.Errorf("bad diagnostics bundle id %s", id)
+	}
+	return ioutil.ReadFile(filepath.Join(directory, id+".json"))
+}
+
+func pruneDiagnosticsBundles(directory string, bundlesKept int) error {
+	if bundlesKept <= 0 {
+		bundlesKept = DefaultDiagnosticsBundlesKept
+	}
+	files, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil || len(files) <= bundlesKept {
+		return err
+	}
+	modified := map[string]time.Time{}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modified[file] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return modified[files[i]].Before(modified[files[j]])
+	})
+	for _, file := range files[:len(files)-bundlesKept] {
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package btrzaws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveDiagnosticsBundles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	collected := time.Now().Add(-time.Hour)
+	for index, id := range []string{"i-1-100", "i-1-200", "i-2-300"} {
+		if err = SaveDiagnosticsBundle(&DiagnosticsBundle{ID: id}, directory, 2); err != nil {
+			t.Fatal(err)
+		}
+		modified := collected.Add(time.Duration(index) * time.Minute)
+		os.Chtimes(filepath.Join(directory, id+".json"), modified, modified)
+	}
+	if _, err = LoadDiagnosticsBundle(directory, "i-1-100"); err == nil {
+		t.Error("the oldest bundle should be removed")
+	}
+	if data, err := LoadDiagnosticsBundle(directory, "i-2-300"); err != nil || len(data) == 0 {
+		t.Errorf("expected the latest bundle, got %v", err)
+	}
+	if err = SaveDiagnosticsBundle(&DiagnosticsBundle{ID: "../i-1"}, directory, 2); err == nil {
+		t.Error("bundle ids should not be paths")
+	}
+}
@@ -0,0 +1,92 @@
+package btrzaws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// MonitorOptOutTag - instances tagged Monitor=no are never checked
+const MonitorOptOutTag = "Monitor"
+
+// DiscoverySelector - a group of ec2 filters selecting instances to monitor.
+// the instances of all the selectors are monitored
+type DiscoverySelector struct {
+	Name string `json:"name"`
+	// Filters - ec2 filter name (tag:Name, instance-type...) to accepted values
+	Filters map[string][]string `json:"filters"`
+	// Exclude - tag name to values, matching instances are dropped. "*" matches any value
+	Exclude map[string][]string `json:"exclude,omitempty"`
+}
+
+// DefaultDiscoverySelectors - the nginx http services the monitor always checked
+func DefaultDiscoverySelectors() []*DiscoverySelector {
+	return []*DiscoverySelector{
+		{
+			Name: "nginx-http",
+			Filters: map[string][]string{
+				"tag:Service-Type":        {"http"},
+				"tag:Online":              {"yes"},
+				"tag:Nginx-Configuration": {"api", "app", "connex"},
+			},
+		},
+	}
+}
+
+// ValidateDiscoverySelectors - check that every selector is usable
+func ValidateDiscoverySelectors(selectors []*DiscoverySelector) error {
+	if len(selectors) == 0 {
+		return errors.New("no discovery selectors")
+	}
+	for index, selector := range selectors {
+		if selector.Name == "" {
+			return fmt.Errorf("selector %d has no name", index)
+		}
+		for filterName, values := range selector.Filters {
+			if len(values) == 0 {
+				return fmt.Errorf("selector %s: filter %s has no values", selector.Name, filterName)
+			}
+		}
+	}
+	return nil
+}
+
+// GetTags - the selector filters, limited to running instances of the environment
+func (selector *DiscoverySelector) GetTags(environment string) []*AwsTag {
+	tags := []*AwsTag{
+		NewWithValues("tag:Environment", environment),
+		NewWithValues("instance-state-name", "running"),
+	}
+	filterNames := []string{}
+	for filterName := range selector.Filters {
+		if filterName == "tag:Environment" || filterName == "instance-state-name" {
+			continue
+		}
+		filterNames = append(filterNames, filterName)
+	}
+	sort.Strings(filterNames)
+	for _, filterName := range filterNames {
+		tags = append(tags, &AwsTag{TagName: filterName, TagValues: selector.Filters[filterName]})
+	}
+	return tags
+}
+
+// Excludes - true if the instance matches one of the exclusion rules
+func (selector *DiscoverySelector) Excludes(instance *ec2.Instance) bool {
+	for tagName, values := range selector.Exclude {
+		instanceValue := GetTagValue(instance, tagName)
+		for _, value := range values {
+			if value == instanceValue || (value == "*" && instanceValue != "") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsMonitoringDisabled - true if the instance opted out with Monitor=no
+func IsMonitoringDisabled(instance *ec2.Instance) bool {
+	return GetTagValue(instance, MonitorOptOutTag) == "no"
+}
@@ -6,27 +6,48 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+// InstancesDescriber - the ec2 call used to discover instances, part of EC2API
+type InstancesDescriber interface {
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+}
+
 // GetInstancesWithTags - return all instances with specific tags
 func GetInstancesWithTags(awsSession *session.Session, tags []*AwsTag) ([]*ec2.Reservation, error) {
+	return DescribeInstancesWithTags(ec2.New(awsSession), tags)
+}
+
+// DescribeInstancesWithTags - return all instances with specific tags, following all the result pages
+func DescribeInstancesWithTags(client InstancesDescriber, tags []*AwsTag) ([]*ec2.Reservation, error) {
+	description := &ec2.DescribeInstancesInput{
+		Filters: createFilters(tags),
+	}
+	reservations := []*ec2.Reservation{}
+	for {
+		resp, err := client.DescribeInstances(description)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, resp.Reservations...)
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		description.NextToken = resp.NextToken
+	}
+	return reservations, nil
+}
+
+// createFilters - one filter per tag, each with its own values
+func createFilters(tags []*AwsTag) []*ec2.Filter {
 	var filters = []*ec2.Filter{}
-	tagValues := []*string{}
 	for _, tag := range tags {
+		tagValues := []*string{}
 		for _, tagValue := range tag.TagValues {
 			tagValues = append(tagValues, aws.String(tagValue))
 		}
 		filters = append(filters,
-			&ec2.Filter{Name: &tag.TagName,
+			&ec2.Filter{Name: aws.String(tag.TagName),
 				Values: tagValues,
 			})
 	}
-	svc := ec2.New(awsSession)
-	description := &ec2.DescribeInstancesInput{
-		Filters: filters,
-	}
-
-	resp, err := svc.DescribeInstances(description)
-	if err != nil {
-		return nil, err
-	}
-	return resp.Reservations, nil
+	return filters
 }
@@ -0,0 +1,118 @@
+package btrzaws
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// fakeDescriber - filters a fleet like ec2 does and returns pageSize reservations per page
+type fakeDescriber struct {
+	fleet    []*ec2.Instance
+	pageSize int
+	calls    int
+	inputs   []*ec2.DescribeInstancesInput
+}
+
+func (describer *fakeDescriber) matches(instance *ec2.Instance, filter *ec2.Filter) bool {
+	name := aws.StringValue(filter.Name)
+	value := ""
+	if strings.HasPrefix(name, "tag:") {
+		value = GetTagValue(instance, strings.TrimPrefix(name, "tag:"))
+	} else if name == "instance-state-name" {
+		value = aws.StringValue(instance.State.Name)
+	}
+	for _, filterValue := range filter.Values {
+		if aws.StringValue(filterValue) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (describer *fakeDescriber) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	describer.calls++
+	describer.inputs = append(describer.inputs, input)
+	matching := []*ec2.Reservation{}
+	for _, instance := range describer.fleet {
+		matched := true
+		for _, filter := range input.Filters {
+			matched = matched && describer.matches(instance, filter)
+		}
+		if matched {
+			matching = append(matching, &ec2.Reservation{Instances: []*ec2.Instance{instance}})
+		}
+	}
+	start := 0
+	if input.NextToken != nil {
+		var err error
+		if start, err = strconv.Atoi(*input.NextToken); err != nil {
+			return nil, errors.New("bad token")
+		}
+	}
+	end := start + describer.pageSize
+	output := &ec2.DescribeInstancesOutput{}
+	if end < len(matching) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(matching)
+	}
+	output.Reservations = matching[start:end]
+	return output, nil
+}
+
+func createFleetInstance(instanceID, environment, nginxConfiguration string) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId: aws.String(instanceID),
+		State:      &ec2.InstanceState{Name: aws.String("running")},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Environment"), Value: aws.String(environment)},
+			{Key: aws.String("Nginx-Configuration"), Value: aws.String(nginxConfiguration)},
+		},
+	}
+}
+
+func TestMultiValueFilters(t *testing.T) {
+	describer := &fakeDescriber{pageSize: 100, fleet: []*ec2.Instance{
+		createFleetInstance("i-api", "production", "api"),
+		createFleetInstance("i-app", "production", "app"),
+		createFleetInstance("i-sandbox", "sandbox", "api"),
+		createFleetInstance("i-other", "production", "other"),
+	}}
+	tags := []*AwsTag{
+		NewWithValues("tag:Environment", "production"),
+		{TagName: "tag:Nginx-Configuration", TagValues: []string{"api", "app"}},
+	}
+	reservations, err := DescribeInstancesWithTags(describer, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(reservations))
+	}
+	filters := describer.inputs[0].Filters
+	if len(filters[0].Values) != 1 || len(filters[1].Values) != 2 {
+		t.Fatal("filter values leaked between filters")
+	}
+}
+
+func TestInstancesPagination(t *testing.T) {
+	describer := &fakeDescriber{pageSize: 2}
+	for index := 0; index < 7; index++ {
+		describer.fleet = append(describer.fleet, createFleetInstance("i-"+strconv.Itoa(index), "production", "api"))
+	}
+	reservations, err := DescribeInstancesWithTags(describer, []*AwsTag{NewWithValues("tag:Environment", "production")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 7 || describer.calls != 4 {
+		t.Fatalf("expected 7 instances in 4 pages, got %d in %d", len(reservations), describer.calls)
+	}
+	if aws.StringValue(reservations[6].Instances[0].InstanceId) != "i-6" {
+		t.Fatal("last page is missing")
+	}
+}
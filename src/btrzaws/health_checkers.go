@@ -0,0 +1,148 @@
+package btrzaws
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// ProtocolTCP - healthcheck by opening a tcp connection
+	ProtocolTCP = "tcp"
+	// ProtocolHTTP - healthcheck by http get
+	ProtocolHTTP = "http"
+	// ProtocolHTTPS - healthcheck by https get
+	ProtocolHTTPS = "https"
+	// ProtocolGRPC - healthcheck using the grpc health protocol
+	ProtocolGRPC = "grpc"
+)
+
+// httpsIdleConnectionTimeout - idle keep-alive connections of the https checks are closed after it
+const httpsIdleConnectionTimeout = 90 * time.Second
+
+// verifyingTransport, insecureTransport - the https transports shared by all the checks,
+// one per certificate verification setting so keep-alive connections are reused instead of leaked
+var (
+	verifyingTransport = newHTTPSTransport(true)
+	insecureTransport  = newHTTPSTransport(false)
+)
+
+func newHTTPSTransport(verifyCertificate bool) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !verifyCertificate},
+		IdleConnTimeout: httpsIdleConnectionTimeout,
+	}
+}
+
+// HealthChecker - checks the health of a single instance
+type HealthChecker interface {
+	Check(instance *BetterezInstance) (bool, error)
+}
+
+// TCPHealthChecker - healthy when the healthcheck port accepts connections
+type TCPHealthChecker struct{}
+
+// HTTPHealthChecker - healthy when the healthcheck url returns a status below 400
+// and the body passes the instance HealthcheckSpec
+type HTTPHealthChecker struct {
+	UseTLS            bool
+	VerifyCertificate bool
+}
+
+// GRPCHealthChecker - healthy when grpc.health.v1.Health/Check returns SERVING
+type GRPCHealthChecker struct{}
+
+// GetHealthChecker - return the checker for the protocol, http for unknown protocols
+func GetHealthChecker(protocol string) HealthChecker {
+	switch strings.ToLower(protocol) {
+	case ProtocolTCP:
+		return &TCPHealthChecker{}
+	case ProtocolHTTPS:
+		return &HTTPHealthChecker{UseTLS: true}
+	case ProtocolGRPC:
+		return &GRPCHealthChecker{}
+	}
+	return &HTTPHealthChecker{}
+}
+
+// Check - open and close a tcp connection to the instance
+func (checker *TCPHealthChecker) Check(instance *BetterezInstance) (bool, error) {
+	connection, err := net.DialTimeout("tcp", instance.GetHealthCheckAddress(), ConnectionTimeout)
+	if err != nil {
+		return false, err
+	}
+	connection.Close()
+	return true, nil
+}
+
+// Check - http(s) get of the instance healthcheck url
+func (checker *HTTPHealthChecker) Check(instance *BetterezInstance) (bool, error) {
+	httpClient := http.Client{
+		Timeout: ConnectionTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if checker.UseTLS {
+		httpClient.Transport = insecureTransport
+		if checker.VerifyCertificate {
+			httpClient.Transport = verifyingTransport
+		}
+	}
+	req, err := http.NewRequest("GET", instance.GetHealthCheckString(), nil)
+	if err != nil {
+		return false, err
+	}
+	for header, value := range instance.GetHealthcheckEndpoint().Headers {
+		req.Header.Set(header, value)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode <= 0 || resp.StatusCode >= 400 {
+		return false, fmt.Errorf("healthcheck returned status %d", resp.StatusCode)
+	}
+	if instance.HealthcheckSpec == nil {
+		return true, nil
+	}
+	body, err := instance.HealthcheckSpec.ReadBody(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if err = instance.HealthcheckSpec.Verify(body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Check - call the grpc health service of the instance
+func (checker *GRPCHealthChecker) Check(instance *BetterezInstance) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+	connection, err := grpc.DialContext(ctx, instance.GetHealthCheckAddress(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+	resp, err := grpc_health_v1.NewHealthClient(connection).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: instance.HealthcheckService})
+	if err != nil {
+		return false, err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return false, fmt.Errorf("grpc service status %s", resp.Status)
+	}
+	return true, nil
+}
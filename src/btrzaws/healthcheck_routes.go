@@ -0,0 +1,161 @@
+package btrzaws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// HealthcheckRoute - routing rule, tells how to reach the healthcheck of the matching instances.
+// empty match fields match everything, the first matching rule wins
+type HealthcheckRoute struct {
+	Name       string            `json:"name"`
+	Repository string            `json:"repository,omitempty"`
+	PathNames  []string          `json:"path_names,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Scheme     string            `json:"scheme,omitempty"`
+	// Port - 0 to use the Healtcheck-Port tag or the standard api port
+	Port int `json:"port,omitempty"`
+	// Path - may use {path-name} and {healthcheck-path} placeholders
+	Path     string            `json:"path,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+}
+
+// HealthcheckEndpoint - healthcheck target of an instance, resolved from a route
+type HealthcheckEndpoint struct {
+	Route    string
+	Scheme   string
+	Port     int
+	Path     string
+	Headers  map[string]string
+	Protocol string
+}
+
+// DefaultHealthcheckRoutes - the routes the monitor always used
+func DefaultHealthcheckRoutes() []*HealthcheckRoute {
+	return []*HealthcheckRoute{
+		{Name: "connex2", Repository: "connex2", Port: 22000, Path: "/healthcheck"},
+		{Name: "elixir", PathNames: []string{"webhooks", "liveseatmaps", "loyalty", "seatmaps"}, Port: 4000, Path: "/{path-name}/healthcheck"},
+		{Name: "root-path", PathNames: []string{"/"}, Path: "/{healthcheck-path}"},
+		{Name: "default", Path: "/{path-name}/healthcheck"},
+	}
+}
+
+// LoadHealthcheckRoutes - read a json array of routes
+func LoadHealthcheckRoutes(fileName string) ([]*HealthcheckRoute, error) {
+	fileData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	routes := []*HealthcheckRoute{}
+	if err = json.Unmarshal(fileData, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if err = ValidateHealthcheckRoutes(routes); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return routes, nil
+}
+
+// ValidateHealthcheckRoutes - check that every route is usable
+func ValidateHealthcheckRoutes(routes []*HealthcheckRoute) error {
+	if len(routes) == 0 {
+		return errors.New("no healthcheck routes")
+	}
+	for index, route := range routes {
+		if route.Name == "" {
+			return fmt.Errorf("route %d has no name", index)
+		}
+		switch route.Protocol {
+		case "", ProtocolTCP, ProtocolHTTP, ProtocolHTTPS, ProtocolGRPC:
+		default:
+			return fmt.Errorf("route %s: unknown protocol %s", route.Name, route.Protocol)
+		}
+		switch route.Scheme {
+		case "", ProtocolHTTP, ProtocolHTTPS:
+		default:
+			return fmt.Errorf("route %s: unknown scheme %s", route.Name, route.Scheme)
+		}
+		if route.Port < 0 || route.Port > 65535 {
+			return fmt.Errorf("route %s: bad port %d", route.Name, route.Port)
+		}
+	}
+	return nil
+}
+
+// Matches - true if the instance matches all the route conditions
+func (route *HealthcheckRoute) Matches(instance *BetterezInstance) bool {
+	if route.Repository != "" && route.Repository != instance.Repository {
+		return false
+	}
+	if len(route.PathNames) > 0 {
+		found := false
+		for _, pathName := range route.PathNames {
+			if pathName == instance.PathName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for tagName, tagValue := range route.Tags {
+		instanceValue := instance.GetTagValue(tagName)
+		if tagValue == "*" && instanceValue != "" {
+			continue
+		}
+		if instanceValue != tagValue {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveHealthcheckEndpoint - build the endpoint of the first matching route, nil if none matches
+func ResolveHealthcheckEndpoint(routes []*HealthcheckRoute, instance *BetterezInstance) *HealthcheckEndpoint {
+	for _, route := range routes {
+		if route.Matches(instance) {
+			return route.endpointFor(instance)
+		}
+	}
+	return nil
+}
+
+func (route *HealthcheckRoute) endpointFor(instance *BetterezInstance) *HealthcheckEndpoint {
+	endpoint := &HealthcheckEndpoint{
+		Route:    route.Name,
+		Scheme:   route.Scheme,
+		Port:     route.Port,
+		Headers:  route.Headers,
+		Protocol: route.Protocol,
+	}
+	if instance.HealthcheckProtocol != "" {
+		endpoint.Protocol = instance.HealthcheckProtocol
+	}
+	if endpoint.Protocol == "" {
+		endpoint.Protocol = ProtocolHTTP
+	}
+	if endpoint.Scheme == "" {
+		endpoint.Scheme = ProtocolHTTP
+		if endpoint.Protocol == ProtocolHTTPS {
+			endpoint.Scheme = ProtocolHTTPS
+		}
+	}
+	if endpoint.Port == 0 {
+		endpoint.Port = instance.HelthcheckPort
+	}
+	if endpoint.Port == 0 {
+		endpoint.Port = StandradAPIPort
+	}
+	path := strings.Replace(route.Path, "{path-name}", instance.PathName, -1)
+	path = strings.Replace(path, "{healthcheck-path}", instance.HealthcheckPath, -1)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	endpoint.Path = path
+	return endpoint
+}
@@ -0,0 +1,67 @@
+package btrzaws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDefaultHealthcheckRoutes(t *testing.T) {
+	testCases := []struct {
+		instance    *BetterezInstance
+		route       string
+		healthcheck string
+	}{
+		{&BetterezInstance{PrivateIPAddress: "10.0.0.1", Repository: "connex2", PathName: "connex"}, "connex2", "http://10.0.0.1:22000/healthcheck"},
+		{&BetterezInstance{PrivateIPAddress: "10.0.0.1", Repository: "btrz-webhooks", PathName: "webhooks"}, "elixir", "http://10.0.0.1:4000/webhooks/healthcheck"},
+		{&BetterezInstance{PrivateIPAddress: "10.0.0.1", Repository: "btrz-app", PathName: "/", HealthcheckPath: "app/healthcheck"}, "root-path", "http://10.0.0.1:3000/app/healthcheck"},
+		{&BetterezInstance{PrivateIPAddress: "10.0.0.1", PublicIPAddress: "1.2.3.4", Repository: "btrz-api-sales", PathName: "sales", HelthcheckPort: 3030}, "default", "http://1.2.3.4:3030/sales/healthcheck"},
+	}
+	for _, testCase := range testCases {
+		if testCase.instance.GetHealthcheckEndpoint().Route != testCase.route {
+			t.Errorf("%s resolved to route %s, expected %s", testCase.instance.Repository, testCase.instance.GetHealthcheckEndpoint().Route, testCase.route)
+		}
+		if testCase.instance.GetHealthCheckString() != testCase.healthcheck {
+			t.Errorf("%s healthcheck is %s, expected %s", testCase.instance.Repository, testCase.instance.GetHealthCheckString(), testCase.healthcheck)
+		}
+	}
+}
+
+func TestTagHealthcheckRoute(t *testing.T) {
+	routes := append([]*HealthcheckRoute{
+		{Name: "grpc-services", Tags: map[string]string{"Service-Type": "grpc"}, Port: 50051, Protocol: ProtocolGRPC},
+	}, DefaultHealthcheckRoutes()...)
+	if err := ValidateHealthcheckRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	instance := &BetterezInstance{
+		PrivateIPAddress: "10.0.0.2",
+		PathName:         "inventory",
+		AwsInstance: &ec2.Instance{Tags: []*ec2.Tag{
+			{Key: aws.String("Service-Type"), Value: aws.String("grpc")},
+		}},
+	}
+	instance.HealthcheckEndpoint = ResolveHealthcheckEndpoint(routes, instance)
+	if instance.HealthcheckEndpoint.Route != "grpc-services" || instance.GetHealthCheckAddress() != "10.0.0.2:50051" {
+		t.Fatalf("bad endpoint %+v", instance.HealthcheckEndpoint)
+	}
+	if _, ok := instance.GetHealthChecker().(*GRPCHealthChecker); !ok {
+		t.Fatal("expected a grpc checker")
+	}
+	routes[0].Protocol = "smtp"
+	if err := ValidateHealthcheckRoutes(routes); err == nil {
+		t.Fatal("unknown protocol should not be valid")
+	}
+}
+
+func TestSampleRoutesMatchDefaults(t *testing.T) {
+	routes, err := LoadHealthcheckRoutes("../../samples/healthcheck_routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(routes, DefaultHealthcheckRoutes()) {
+		t.Fatal("sample routes file differs from the default routes")
+	}
+}
@@ -0,0 +1,192 @@
+package btrzaws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logging"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// DefaultMaxResponseSize - body read limit when the spec has no limit
+const DefaultMaxResponseSize = 1024 * 1024
+
+// HealthcheckSpec - assertions on the healthcheck response body
+type HealthcheckSpec struct {
+	BodyContains string
+	BodyRegex    string
+	// JSONExpectations - path to expected value, for example "$.mongo": "up"
+	JSONExpectations map[string]string
+	MaxResponseSize  int64
+	// bodyExpression - BodyRegex compiled by Validate
+	bodyExpression *regexp.Regexp
+}
+
+// LoadHealthcheckSpec - create a spec from the instance tags, nil if there are no assertions
+func LoadHealthcheckSpec(instance *ec2.Instance) *HealthcheckSpec {
+	spec := &HealthcheckSpec{
+		BodyContains:     GetTagValue(instance, "Healthcheck-Body-Contains"),
+		BodyRegex:        GetTagValue(instance, "Healthcheck-Body-Regex"),
+		JSONExpectations: ParseJSONExpectations(GetTagValue(instance, "Healthcheck-Json-Expect")),
+	}
+	spec.MaxResponseSize, _ = strconv.ParseInt(GetTagValue(instance, "Healthcheck-Max-Size"), 10, 64)
+	if err := spec.Validate(); err != nil {
+		logging.RecordLogLine(fmt.Sprintf("warning: %v in the healthcheck spec of %s, body regex ignored",
+			err, GetTagValue(instance, "Name")))
+		spec.BodyRegex = ""
+	}
+	if spec.IsEmpty() {
+		return nil
+	}
+	return spec
+}
+
+// ParseJSONExpectations - parse "status=ok;mongo=up" into path/value pairs
+func ParseJSONExpectations(value string) map[string]string {
+	result := make(map[string]string)
+	for _, expectation := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		parts := strings.SplitN(expectation, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result
+}
+
+// Validate - compile the body regex once, so checks don't fail on a bad expression
+func (spec *HealthcheckSpec) Validate() error {
+	spec.bodyExpression = nil
+	if spec.BodyRegex == "" {
+		return nil
+	}
+	expression, err := regexp.Compile(spec.BodyRegex)
+	if err != nil {
+		return fmt.Errorf("bad body regex %q: %v", spec.BodyRegex, err)
+	}
+	spec.bodyExpression = expression
+	return nil
+}
+
+// IsEmpty - true when the spec has nothing to assert
+func (spec *HealthcheckSpec) IsEmpty() bool {
+	return spec.BodyContains == "" && spec.BodyRegex == "" &&
+		len(spec.JSONExpectations) == 0 && spec.MaxResponseSize == 0
+}
+
+// ReadBody - read the response body, failing if it's bigger than the allowed size
+func (spec *HealthcheckSpec) ReadBody(reader io.Reader) ([]byte, error) {
+	limit := spec.MaxResponseSize
+	if limit <= 0 {
+		limit = DefaultMaxResponseSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("assertion failed: response size exceeds %d bytes", limit)
+	}
+	return body, nil
+}
+
+// Verify - check the body against all the assertions, the error holds the failure reason.
+// the json expectations are checked in path order, so the same body always fails with the same reason
+func (spec *HealthcheckSpec) Verify(body []byte) error {
+	if spec.BodyContains != "" && !bytes.Contains(body, []byte(spec.BodyContains)) {
+		return fmt.Errorf("assertion failed: body does not contain %q", spec.BodyContains)
+	}
+	if spec.BodyRegex != "" {
+		expression := spec.bodyExpression
+		if expression == nil {
+			var err error
+			if expression, err = regexp.Compile(spec.BodyRegex); err != nil {
+				return fmt.Errorf("assertion failed: bad regex %q: %v", spec.BodyRegex, err)
+			}
+		}
+		if !expression.Match(body) {
+			return fmt.Errorf("assertion failed: body does not match %q", spec.BodyRegex)
+		}
+	}
+	if len(spec.JSONExpectations) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("assertion failed: body is not json: %v", err)
+	}
+	paths := make([]string, 0, len(spec.JSONExpectations))
+	for path := range spec.JSONExpectations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		expected := spec.JSONExpectations[path]
+		value, found := lookupJSONPath(document, path)
+		if !found {
+			return fmt.Errorf("assertion failed: %s not found", path)
+		}
+		if value != expected {
+			return fmt.Errorf("assertion failed: %s is %q, expected %q", path, value, expected)
+		}
+	}
+	return nil
+}
+
+// lookupJSONPath - resolve paths like "$.dependencies.mongo" or "checks[0].status"
+func lookupJSONPath(document interface{}, path string) (string, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	current := document
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			continue
+		}
+		name := segment
+		indexes := []int{}
+		if bracket := strings.Index(segment, "["); bracket >= 0 {
+			name = segment[:bracket]
+			for _, index := range strings.Split(strings.Trim(segment[bracket:], "[]"), "][") {
+				value, err := strconv.Atoi(index)
+				if err != nil {
+					return "", false
+				}
+				indexes = append(indexes, value)
+			}
+		}
+		if name != "" {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if current, ok = object[name]; !ok {
+				return "", false
+			}
+		}
+		for _, index := range indexes {
+			array, ok := current.([]interface{})
+			if !ok || index < 0 || index >= len(array) {
+				return "", false
+			}
+			current = array[index]
+		}
+	}
+	switch value := current.(type) {
+	case nil:
+		return "null", true
+	case string:
+		return value, true
+	case json.Number, bool:
+		return fmt.Sprintf("%v", value), true
+	}
+	encoded, _ := json.Marshal(current)
+	return string(encoded), true
+}
@@ -0,0 +1,94 @@
+package btrzaws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const degradedBody = `{"status":"degraded","dependencies":{"mongo":"down","redis":"up"},"checks":[{"name":"queue","ok":true}],"uptime":12}`
+
+func TestJSONExpectations(t *testing.T) {
+	spec := &HealthcheckSpec{JSONExpectations: ParseJSONExpectations("$.dependencies.redis=up; checks[0].ok=true, uptime=12")}
+	if err := spec.Verify([]byte(degradedBody)); err != nil {
+		t.Fatal(err)
+	}
+	spec.JSONExpectations = ParseJSONExpectations("$.dependencies.mongo=up")
+	err := spec.Verify([]byte(degradedBody))
+	if err == nil {
+		t.Fatal("mongo is down, assertion should fail")
+	}
+	if err.Error() != `assertion failed: $.dependencies.mongo is "down", expected "up"` {
+		t.Fatalf("bad reason: %v", err)
+	}
+	spec.JSONExpectations = ParseJSONExpectations("$.dependencies.mysql=up")
+	if err = spec.Verify([]byte(degradedBody)); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("missing field should fail, got %v", err)
+	}
+	spec.JSONExpectations = ParseJSONExpectations("uptime=0; status=ok; $.dependencies.mongo=up; checks[0].ok=false")
+	for run := 0; run < 20; run++ {
+		err = spec.Verify([]byte(degradedBody))
+		if err == nil || err.Error() != `assertion failed: $.dependencies.mongo is "down", expected "up"` {
+			t.Fatalf("several failures should report the first path, got %v", err)
+		}
+	}
+}
+
+func TestBodyAssertions(t *testing.T) {
+	spec := &HealthcheckSpec{BodyContains: `"status"`, BodyRegex: `"status":"(ok|degraded)"`}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.Verify([]byte(degradedBody)); err != nil {
+		t.Fatal(err)
+	}
+	spec.BodyRegex = `"status":"ok"`
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.Verify([]byte(degradedBody)); err == nil {
+		t.Fatal("regex should not match")
+	}
+	spec.BodyRegex = `"status":"(ok`
+	if err := spec.Validate(); err == nil {
+		t.Fatal("bad regex should be rejected")
+	}
+	spec = &HealthcheckSpec{MaxResponseSize: 10}
+	if _, err := spec.ReadBody(strings.NewReader(degradedBody)); err == nil {
+		t.Fatal("body is bigger than the limit")
+	}
+}
+
+func TestHealthcheckAssertionRecorded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(degradedBody))
+	}))
+	defer server.Close()
+	instance := createLocalInstance(t, server.URL)
+	instance.HealthcheckSpec = &HealthcheckSpec{JSONExpectations: map[string]string{"status": "ok"}}
+	ok, err := instance.CheckInstanceHealth()
+	if ok || err == nil {
+		t.Fatal("degraded status should fail the check")
+	}
+	if instance.ServiceStatusErrorCode != `assertion failed: status is "degraded", expected "ok"` {
+		t.Fatalf("bad error code %s", instance.ServiceStatusErrorCode)
+	}
+}
+
+func TestLoadHealthcheckSpec(t *testing.T) {
+	tags := map[string]string{"Healthcheck-Body-Contains": "ok", "Healthcheck-Body-Regex": `"status":"(ok|degraded)"`}
+	spec := LoadHealthcheckSpec(createPolicyInstance("btrz-api-sales", tags).AwsInstance)
+	if spec == nil || spec.bodyExpression == nil {
+		t.Fatal("the body regex should be compiled when loading")
+	}
+	tags["Healthcheck-Body-Regex"] = `"status":"(ok`
+	spec = LoadHealthcheckSpec(createPolicyInstance("btrz-api-sales", tags).AwsInstance)
+	if spec == nil || spec.BodyRegex != "" || spec.BodyContains != "ok" {
+		t.Fatalf("a bad regex should be dropped, keeping the other assertions: %+v", spec)
+	}
+	delete(tags, "Healthcheck-Body-Contains")
+	if spec = LoadHealthcheckSpec(createPolicyInstance("btrz-api-sales", tags).AwsInstance); spec != nil {
+		t.Fatalf("a spec with only a bad regex should be nil, got %+v", spec)
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"logging"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 )
 
@@ -23,19 +23,101 @@ const (
 )
 
 // Notify notify error in the instance
-func Notify(instance *BetterezInstance, sess *session.Session) bool {
-	if os.Getenv("PHONE_NUMBER") != "" {
-		NotifyBySMS(instance, sess, os.Getenv("PHONE_NUMBER"))
+func Notify(instance *BetterezInstance, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		NotifyBySMS(instance, client, settings.PhoneNumber)
 	}
-	if os.Getenv("FIREBASE_AUTHCODE") != "" {
-		NotifyByPush(instance, os.Getenv("FIREBASE_AUTHCODE"))
+	if settings.FirebaseAuthCode != "" {
+		NotifyByPush(instance, settings.FirebaseAuthCode)
+	}
+	return true
+}
+
+// NotifyDegraded - notify that the instance responds, but too slowly
+func NotifyDegraded(instance *BetterezInstance, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		sendSMS(client, settings.PhoneNumber,
+			fmt.Sprintf("Production server %s (%s) degraded: %s", instance.InstanceName, instance.GetLocation(), instance.ServiceStatusErrorCode))
+	}
+	if settings.FirebaseAuthCode != "" {
+		sendPush(settings.FirebaseAuthCode, "server degraded",
+			fmt.Sprintf("%s server in %s is slow", instance.Repository, instance.GetLocation()))
+	}
+	return true
+}
+
+// NotifyHostKeyMismatch - notify that the ssh host key of the instance mismatched or couldn't be verified
+// and remediation is blocked
+func NotifyHostKeyMismatch(instance *BetterezInstance, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		sendSMS(client, settings.PhoneNumber,
+			fmt.Sprintf("Production server %s (%s) ssh host key rejected, remediation blocked: %s",
+				instance.InstanceName, instance.GetLocation(), instance.ServiceStatusErrorCode))
+	}
+	if settings.FirebaseAuthCode != "" {
+		sendPush(settings.FirebaseAuthCode, "host key rejected",
+			fmt.Sprintf("%s server in %s presented an ssh host key that couldn't be verified", instance.Repository, instance.GetLocation()))
+	}
+	return true
+}
+
+// NotifyRemediationBlocked - notify that a guardrail left the failing instance to notifications
+func NotifyRemediationBlocked(instance *BetterezInstance, reason string, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		sendSMS(client, settings.PhoneNumber,
+			fmt.Sprintf("Production server %s (%s) is failing, remediation blocked by a guardrail, notify only: %s",
+				instance.InstanceName, instance.GetLocation(), reason))
+	}
+	if settings.FirebaseAuthCode != "" {
+		sendPush(settings.FirebaseAuthCode, "remediation blocked",
+			fmt.Sprintf("%s server in %s is failing and won't be remediated: %s", instance.Repository, instance.GetLocation(), reason))
+	}
+	return true
+}
+
+// NotifyCorrelatedFailure - notify once that the dependents of a service fail together, their remediation is suppressed
+func NotifyCorrelatedFailure(dependency string, failing, dependents int, repositories []string, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		sendSMS(client, settings.PhoneNumber,
+			fmt.Sprintf("Production dependency %s likely down, %d of %d dependent instances failing (%s), remediation suppressed",
+				dependency, failing, dependents, strings.Join(repositories, ", ")))
+	}
+	if settings.FirebaseAuthCode != "" {
+		sendPush(settings.FirebaseAuthCode, "dependency down",
+			fmt.Sprintf("%d servers depending on %s are not responding", failing, dependency))
+	}
+	return true
+}
+
+// NotifyGroupUnderCapacity - notify that the auto scaling group didn't replace the unhealthy instance in time
+func NotifyGroupUnderCapacity(instance *BetterezInstance, healthy, desired int, client SNSAPI) bool {
+	settings := GetNotificationSettings()
+	if settings.PhoneNumber != "" {
+		sendSMS(client, settings.PhoneNumber, fmt.Sprintf("Production group %s (%s) has %d healthy instances of %d",
+			instance.AutoScalingGroupName, instance.GetLocation(), healthy, desired))
+	}
+	if settings.FirebaseAuthCode != "" {
+		sendPush(settings.FirebaseAuthCode, "group under capacity",
+			fmt.Sprintf("%s group in %s didn't replace %s", instance.Repository, instance.GetLocation(), instance.InstanceName))
 	}
 	return true
 }
 
 // NotifyBySMS - notify to a user by phone sms
-func NotifyBySMS(instance *BetterezInstance, sess *session.Session, phoneNumber string) {
-	notificationService := sns.New(sess)
+func NotifyBySMS(instance *BetterezInstance, client SNSAPI, phoneNumber string) {
+	sendSMS(client, phoneNumber, fmt.Sprintf("Production server %s (%s)", instance.InstanceName, instance.GetLocation()))
+}
+
+func sendSMS(notificationService SNSAPI, phoneNumber, message string) {
+	if notificationService == nil {
+		logging.RecordLogLine(fmt.Sprintf("warning: no sns client, text message to %s dropped", phoneNumber))
+		return
+	}
 	smsParams := &sns.SetSMSAttributesInput{
 		Attributes: map[string]*string{
 			"DefaultSenderID": aws.String("betterez"),
@@ -43,22 +125,26 @@ func NotifyBySMS(instance *BetterezInstance, sess *session.Session, phoneNumber
 	notificationService.SetSMSAttributes(smsParams)
 	notificationService.Publish(&sns.PublishInput{
 		PhoneNumber: aws.String(phoneNumber),
-		Message:     aws.String(fmt.Sprintf("Production server %s", instance.InstanceName)),
+		Message:     aws.String(message),
 		Subject:     aws.String("betterez"),
 	})
 }
 
 // NotifyByPush - push to firebase
 func NotifyByPush(instance *BetterezInstance, serverAuthKey string) (bool, error) {
+	return sendPush(serverAuthKey, "server down", fmt.Sprintf("%s server in %s not responding", instance.Repository, instance.GetLocation()))
+}
+
+func sendPush(serverAuthKey, title, body string) (bool, error) {
 	payload := []byte(fmt.Sprintf(`{
 		"priority":"HIGH",
 		"notification":{
-		"title"    :"server down",
-		"body":"%s server not responding",
+		"title"    :%q,
+		"body":%q,
 		"sound":"siren1"
 		},
 		"to":"/topics/alerts"
-		}`, instance.Repository))
+		}`, title, body))
 	req, err := http.NewRequest("POST", FirebaseServerURL, bytes.NewBuffer(payload))
 	if err != nil {
 		return false, err
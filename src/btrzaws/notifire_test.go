@@ -48,5 +48,5 @@ func TestSMSNotification(t *testing.T) {
 	if err != nil {
 		return
 	}
-	NotifyBySMS(instance, sess, "put full number here")
+	NotifyBySMS(instance, NewAWSClients(sess).SNS, "put full number here")
 }
@@ -0,0 +1,147 @@
+package btrzaws
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RemediationPolicyTag - instance tag naming its remediation policy, it wins over the policies selectors
+const RemediationPolicyTag = "Remediation-Policy"
+
+const (
+	// ActionRunCommand - run the step command with the instance remediation executor
+	ActionRunCommand = "run-command"
+	// ActionRestartService - restart the instance service, after collecting its diagnostics
+	ActionRestartService = "restart-service"
+	// ActionReboot - reboot the instance with ec2
+	ActionReboot = "reboot"
+	// ActionStopStart - stop then start the instance, followed as a restart job
+	ActionStopStart = "stop-start"
+	// ActionTerminate - terminate the instance
+	ActionTerminate = "terminate"
+	// ActionMarkUnhealthy - set the instance Unhealthy in its auto scaling group
+	ActionMarkUnhealthy = "mark-unhealthy"
+	// ActionNotify - send the failure notifications only
+	ActionNotify = "notify"
+)
+
+var remediationActions = []string{ActionRunCommand, ActionRestartService, ActionReboot, ActionStopStart,
+	ActionTerminate, ActionMarkUnhealthy, ActionNotify}
+
+// RemediationStep - a step of a remediation policy
+type RemediationStep struct {
+	Action string
+	// Command - the command of run-command steps
+	Command string
+	// Threshold - consecutive failed healthchecks before the step runs
+	Threshold int
+	// Attempts - times the step runs before the next step is used, 1 when 0
+	Attempts int
+	// Cooldown - the instance isn't checked for that long after the step runs, required by every action but notify
+	Cooldown time.Duration
+}
+
+// RemediationPolicy - the ordered remediation steps of the instances it's assigned to.
+// a step that fails hands over to the next one right away
+type RemediationPolicy struct {
+	Name string
+	// Repositories, Tags - the policy applies to instances of the repositories, or having one of the tag values
+	Repositories []string
+	Tags         map[string][]string
+	Steps        []*RemediationStep
+}
+
+// GetAttempts - runs of the step before the next one is used
+func (step *RemediationStep) GetAttempts() int {
+	if step.Attempts <= 0 {
+		return 1
+	}
+	return step.Attempts
+}
+
+// ActsOnInstance - true when the step runs something on the instance, every action but notify
+func (step *RemediationStep) ActsOnInstance() bool {
+	return step.Action != ActionNotify
+}
+
+// ValidateRemediationPolicies - policies have unique names and steps with known actions and thresholds,
+// the steps acting on the instance have a cooldown so they don't run again on every scan
+func ValidateRemediationPolicies(policies []*RemediationPolicy) error {
+	names := map[string]bool{}
+	for index, policy := range policies {
+		if policy.Name == "" {
+			return fmt.Errorf("remediation policy %d has no name", index)
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("duplicate remediation policy %s", policy.Name)
+		}
+		names[policy.Name] = true
+		if len(policy.Steps) == 0 {
+			return fmt.Errorf("remediation policy %s has no steps", policy.Name)
+		}
+		for stepIndex, step := range policy.Steps {
+			if !isRemediationAction(step.Action) {
+				return fmt.Errorf("remediation policy %s step %d: unknown action %s, expected one of %s",
+					policy.Name, stepIndex, step.Action, strings.Join(remediationActions, ", "))
+			}
+			if step.Action == ActionRunCommand && strings.TrimSpace(step.Command) == "" {
+				return fmt.Errorf("remediation policy %s step %d: run-command needs a command", policy.Name, stepIndex)
+			}
+			if step.Threshold < 1 || step.Attempts < 0 || step.Cooldown < 0 {
+				return fmt.Errorf("remediation policy %s step %d: threshold should be at least 1, attempts and cooldown not negative",
+					policy.Name, stepIndex)
+			}
+			if step.Cooldown == 0 && step.ActsOnInstance() {
+				return fmt.Errorf("remediation policy %s step %d: %s needs a cooldown, it would run again on every scan",
+					policy.Name, stepIndex, step.Action)
+			}
+		}
+	}
+	return nil
+}
+
+func isRemediationAction(action string) bool {
+	for _, knownAction := range remediationActions {
+		if action == knownAction {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectRemediationPolicy - the policy named by the Remediation-Policy tag, else the first one matching the
+// instance repository or tags. nil when none applies, the default escalation is used
+func SelectRemediationPolicy(policies []*RemediationPolicy, instance *BetterezInstance) (*RemediationPolicy, error) {
+	if name := strings.TrimSpace(instance.GetTagValue(RemediationPolicyTag)); name != "" {
+		for _, policy := range policies {
+			if policy.Name == name {
+				return policy, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown remediation policy %s", name)
+	}
+	for _, policy := range policies {
+		if policy.matches(instance) {
+			return policy, nil
+		}
+	}
+	return nil, nil
+}
+
+func (policy *RemediationPolicy) matches(instance *BetterezInstance) bool {
+	for _, repository := range policy.Repositories {
+		if repository == instance.Repository {
+			return true
+		}
+	}
+	for tagName, values := range policy.Tags {
+		tagValue := instance.GetTagValue(tagName)
+		for _, value := range values {
+			if tagValue != "" && tagValue == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package btrzaws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func createPolicyInstance(repository string, tags map[string]string) *BetterezInstance {
+	instance := &ec2.Instance{InstanceId: aws.String("i-api")}
+	for key, value := range tags {
+		instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return &BetterezInstance{InstanceID: "i-api", Repository: repository, AwsInstance: instance}
+}
+
+func TestSelectRemediationPolicy(t *testing.T) {
+	policies := []*RemediationPolicy{
+		{Name: "api", Repositories: []string{"btrz-api-sales"}, Steps: []*RemediationStep{{Action: ActionRestartService, Threshold: 3, Cooldown: time.Minute}}},
+		{Name: "workers", Tags: map[string][]string{"Service-Type": {"worker"}}, Steps: []*RemediationStep{{Action: ActionReboot, Threshold: 2, Cooldown: time.Minute}}},
+	}
+	if err := ValidateRemediationPolicies(policies); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		repository string
+		tags       map[string]string
+		expected   string
+	}{
+		{"btrz-api-sales", nil, "api"},
+		{"btrz-worker-email", map[string]string{"Service-Type": "worker"}, "workers"},
+		{"btrz-api-sales", map[string]string{RemediationPolicyTag: "workers"}, "workers"},
+		{"btrz-website", map[string]string{"Service-Type": "http"}, ""},
+	}
+	for _, testCase := range cases {
+		policy, err := SelectRemediationPolicy(policies, createPolicyInstance(testCase.repository, testCase.tags))
+		if err != nil || (policy == nil && testCase.expected != "") || (policy != nil && policy.Name != testCase.expected) {
+			t.Errorf("%s %v: expected %q, got %+v %v", testCase.repository, testCase.tags, testCase.expected, policy, err)
+		}
+	}
+	if _, err := SelectRemediationPolicy(policies, createPolicyInstance("btrz-api-sales", map[string]string{RemediationPolicyTag: "missing"})); err == nil {
+		t.Error("an unknown policy tag should fail")
+	}
+	invalidPolicies := [][]*RemediationPolicy{
+		{{Name: "empty"}},
+		{{Name: "bad-action", Steps: []*RemediationStep{{Action: "explode", Threshold: 1}}}},
+		{{Name: "no-command", Steps: []*RemediationStep{{Action: ActionRunCommand, Threshold: 1}}}},
+		{{Name: "no-threshold", Steps: []*RemediationStep{{Action: ActionNotify}}}},
+		{{Name: "no-cooldown", Steps: []*RemediationStep{{Action: ActionTerminate, Threshold: 1}}}},
+		{{Name: "no-command-cooldown", Steps: []*RemediationStep{{Action: ActionRunCommand, Command: "uptime", Threshold: 1}}}},
+		{{Name: "no-restart-cooldown", Steps: []*RemediationStep{{Action: ActionRestartService, Threshold: 1}}}},
+	}
+	for _, invalid := range invalidPolicies {
+		if err := ValidateRemediationPolicies(invalid); err == nil {
+			t.Errorf("policy %s should be rejected", invalid[0].Name)
+		}
+	}
+	notifyOnly := []*RemediationPolicy{{Name: "notify", Steps: []*RemediationStep{{Action: ActionNotify, Threshold: 1}}}}
+	if err := ValidateRemediationPolicies(notifyOnly); err != nil {
+		t.Errorf("notify steps don't need a cooldown, %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package btrzaws
+
+import (
+	"clock"
+	"context"
+	"errors"
+	"fmt"
+	"logging"
+	"net"
+	"os"
+	"sshconnector"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// RemediationExecutorTag - instance tag selecting how remediation commands are run, ssh when missing
+	RemediationExecutorTag = "Remediation-Executor"
+	// ExecutorSSH - run the commands over ssh with the instance key file
+	ExecutorSSH = "ssh"
+	// ExecutorSSM - run the commands with systems manager run command
+	ExecutorSSM = "ssm"
+)
+
+const (
+	// CommandStatusSuccess - the command ran and exited with 0
+	CommandStatusSuccess = "success"
+	// CommandStatusFailed - the command ran and failed
+	CommandStatusFailed = "failed"
+	// CommandStatusTimedOut - the command result wasn't available before the timeout
+	CommandStatusTimedOut = "timed-out"
+)
+
+const (
+	// SSMDocumentName - the systems manager document running the shell commands
+	SSMDocumentName = "AWS-RunShellScript"
+	// SSMPollInterval - wait between command invocation checks
+	SSMPollInterval = 2 * time.Second
+	// SSMCommandTimeout - time a command has to complete
+	SSMCommandTimeout = time.Minute
+	// SSHCommandTimeout - time a command has to complete over ssh, connecting included
+	SSHCommandTimeout = time.Minute
+	// MaxCommandOutputSize - the end of longer stdout and stderr outputs is kept
+	MaxCommandOutputSize = 16 * 1024
+)
+
+// CommandResult - outcome of a remediation command, kept with the instance incident
+type CommandResult struct {
+	Executor  string
+	Command   string
+	CommandID string `json:",omitempty"`
+	Status    string
+	// ExitCode - -1 when the command didn't report one
+	ExitCode int
+	Output   string
+	Stderr   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+}
+
+// CommandExecutor - runs a remediation command on an instance.
+// the result is nil when the command never reached the instance
+type CommandExecutor interface {
+	Run(instance *BetterezInstance, command string) (*CommandResult, error)
+}
+
+// RemediationExecutors - the command executors by name
+type RemediationExecutors map[string]CommandExecutor
+
+// NewRemediationExecutors - the ssh and ssm executors, timed with the clock
+func NewRemediationExecutors(executorsClock clock.Clock) RemediationExecutors {
+	return RemediationExecutors{
+		ExecutorSSH: &SSHExecutor{Clock: executorsClock, Timeout: SSHCommandTimeout},
+		ExecutorSSM: &SSMExecutor{Clock: executorsClock, PollInterval: SSMPollInterval, Timeout: SSMCommandTimeout},
+	}
+}
+
+// GetRemediationExecutor - the executor name from the Remediation-Executor tag, ssh by default
+func (instance *BetterezInstance) GetRemediationExecutor() string {
+	executor := strings.ToLower(strings.TrimSpace(instance.GetTagValue(RemediationExecutorTag)))
+	if executor == "" {
+		return ExecutorSSH
+	}
+	return executor
+}
+
+// Run - run the command with the instance executor.
+// ssh is used when the executor is unknown or couldn't deliver the command
+func (executors RemediationExecutors) Run(instance *BetterezInstance, command string) (*CommandResult, error) {
+	results, err := executors.RunCommands(instance, []string{command})
+	if len(results) == 0 {
+		return nil, err
+	}
+	return results[0], err
+}
+
+// RunCommands - run the commands in order with the instance executor, a failed command doesn't stop the next ones.
+// ssh is used when the executor is unknown or couldn't deliver the first command. the error is the last one
+func (executors RemediationExecutors) RunCommands(instance *BetterezInstance, commands []string) ([]*CommandResult, error) {
+	name := instance.GetRemediationExecutor()
+	executor, found := executors[name]
+	if !found {
+		logging.RecordLogLine(fmt.Sprintf("warning: unknown remediation executor %s on %s, using ssh", name, instance.GetQualifiedID()))
+		name = ExecutorSSH
+		executor = executors[name]
+	}
+	if executor == nil {
+		return nil, errors.New("no remediation executor")
+	}
+	results, err := runCommands(executor, instance, commands)
+	if len(results) > 0 || err == nil || name == ExecutorSSH || executors[ExecutorSSH] == nil {
+		return results, err
+	}
+	logging.RecordLogLine(fmt.Sprintf("warning: %v while sending the commands to %s with %s, falling back to ssh",
+		err, instance.GetQualifiedID(), name))
+	return runCommands(executors[ExecutorSSH], instance, commands)
+}
+
+// BatchExecutor - an executor running several commands at once, sharing its connection
+type BatchExecutor interface {
+	RunCommands(instance *BetterezInstance, commands []string) ([]*CommandResult, error)
+}
+
+// runCommands - run the commands one by one, until one can't be delivered
+func runCommands(executor CommandExecutor, instance *BetterezInstance, commands []string) ([]*CommandResult, error) {
+	if batchExecutor, ok := executor.(BatchExecutor); ok {
+		return batchExecutor.RunCommands(instance, commands)
+	}
+	results := []*CommandResult{}
+	var lastError error
+	for _, command := range commands {
+		result, err := executor.Run(instance, command)
+		if result == nil {
+			return results, err
+		}
+		results = append(results, result)
+		if err != nil {
+			lastError = err
+		}
+	}
+	return results, lastError
+}
+
+// RestartService - restart the instance service with its remediation executor
+func (instance *BetterezInstance) RestartService(executors RemediationExecutors) (*CommandResult, error) {
+	serviceName := instance.GetTagValue("Repository")
+	if serviceName == "" {
+		return nil, errors.New("no service name found")
+	}
+	return executors.Run(instance, fmt.Sprintf("sudo service %s restart", serviceName))
+}
+
+// SSHExecutor - runs the commands as ubuntu with the instance .pem file from the keys path
+type SSHExecutor struct {
+	Clock clock.Clock
+	// Timeout - time a command has to complete, no limit when 0
+	Timeout time.Duration
+}
+
+// Run - run the command over ssh
+func (executor *SSHExecutor) Run(instance *BetterezInstance, command string) (*CommandResult, error) {
+	results, err := executor.RunCommands(instance, []string{command})
+	if len(results) == 0 {
+		return nil, err
+	}
+	return results[0], err
+}
+
+// RunCommands - run the commands over a single ssh connection, each one with its own timeout
+func (executor *SSHExecutor) RunCommands(instance *BetterezInstance, commands []string) ([]*CommandResult, error) {
+	var rejection error
+	route, err := getSSHRoute(instance, &rejection)
+	if err != nil {
+		return nil, err
+	}
+	runner := sshconnector.NewRunner(route)
+	runner.Terminal = true
+	runner.MaxOutputSize = MaxCommandOutputSize
+	defer runner.Close()
+	results := []*CommandResult{}
+	var lastError error
+	for _, command := range commands {
+		result, err := executor.run(runner, command)
+		if rejection != nil {
+			return nil, rejection
+		}
+		if result == nil {
+			return results, err
+		}
+		results = append(results, result)
+		if err != nil {
+			lastError = err
+		}
+	}
+	return results, lastError
+}
+
+func (executor *SSHExecutor) run(runner *sshconnector.Runner, command string) (*CommandResult, error) {
+	ctx := context.Background()
+	if executor.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, executor.Timeout)
+		defer cancel()
+	}
+	started := executor.Clock.Now()
+	output, err := runner.Run(ctx, command)
+	if output == nil {
+		return nil, err
+	}
+	result := &CommandResult{
+		Executor: ExecutorSSH,
+		Command:  command,
+		Status:   CommandStatusSuccess,
+		ExitCode: output.ExitCode,
+		Output:   output.Stdout,
+		Stderr:   output.Stderr,
+		Started:  started,
+		Finished: executor.Clock.Now(),
+	}
+	if err != nil {
+		result.Status = CommandStatusFailed
+		if output.TimedOut {
+			result.Status = CommandStatusTimedOut
+		}
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// getSSHRoute - the route to the instance, through its bastions.
+// host keys of every hop that mismatched or couldn't be verified are kept in rejection
+func getSSHRoute(instance *BetterezInstance, rejection *error) (sshconnector.Route, error) {
+	settings := GetSSHSettings()
+	route := sshconnector.Route{ForwardAgent: settings.ForwardAgent}
+	keyFileLocation := fmt.Sprintf("%s%s.pem", GetKeysPath(), instance.KeyName)
+	if _, err := os.Stat(keyFileLocation); os.IsNotExist(err) {
+		if !settings.UseAgent {
+			return route, fmt.Errorf("%s key file doesn't exist", keyFileLocation)
+		}
+		keyFileLocation = ""
+	}
+	bastions, err := SelectBastions(settings.Bastions, instance)
+	if err != nil {
+		return route, err
+	}
+	knownHosts := getKnownHosts()
+	if !knownHosts.IsKnown(instance.InstanceID) {
+		loadConsoleHostKeys(instance, knownHosts)
+	}
+	route.Target = sshconnector.Hop{
+		Address:         instance.PrivateIPAddress,
+		User:            "ubuntu",
+		KeyFile:         keyFileLocation,
+		UseAgent:        settings.UseAgent,
+		HostKeyCallback: recordHostKeyRejection(knownHosts.HostKeyCallback(instance.InstanceID), rejection),
+	}
+	for _, bastion := range bastions {
+		hop := bastion.GetHop(knownHosts)
+		hop.HostKeyCallback = recordHostKeyRejection(hop.HostKeyCallback, rejection)
+		route.JumpHosts = append(route.JumpHosts, hop)
+	}
+	return route, nil
+}
+
+// recordHostKeyRejection - keep the host key mismatch or unknown key error, it's wrapped by the ssh handshake error
+func recordHostKeyRejection(callback ssh.HostKeyCallback, rejection *error) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if IsHostKeyRejected(err) {
+			*rejection = err
+		}
+		return err
+	}
+}
+
+// loadConsoleHostKeys - trust the host keys the instance printed to its console at boot
+func loadConsoleHostKeys(instance *BetterezInstance, knownHosts *sshconnector.KnownHosts) {
+	output, err := instance.GetConsoleOutput()
+	if err != nil {
+		logging.RecordLogLine(fmt.Sprintf("warning: %v while getting the console output of %s", err, instance.GetQualifiedID()))
+		return
+	}
+	keys, fingerprints := sshconnector.ParseConsoleHostKeys(output)
+	for _, key := range keys {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	if len(fingerprints) > 0 {
+		knownHosts.AddFingerprints(instance.InstanceID, fingerprints)
+	}
+}
+
+// IsHostKeyRejected - true when the ssh host key mismatched or couldn't be verified, remediation must not go on
+func IsHostKeyRejected(err error) bool {
+	switch err.(type) {
+	case *sshconnector.HostKeyMismatchError, *sshconnector.UnknownHostKeyError:
+		return true
+	}
+	return false
+}
+
+// SSMExecutor - sends the commands with systems manager and polls the invocation for the result.
+// the instance must run the ssm agent with an instance profile allowing it
+type SSMExecutor struct {
+	Clock        clock.Clock
+	PollInterval time.Duration
+	Timeout      time.Duration
+}
+
+// Run - send the command and wait for its result
+func (executor *SSMExecutor) Run(instance *BetterezInstance, command string) (*CommandResult, error) {
+	clients, err := instance.getClients()
+	if err != nil {
+		return nil, err
+	}
+	if clients.SSM == nil {
+		return nil, errors.New("no ssm client")
+	}
+	started := executor.Clock.Now()
+	timeoutSeconds := int64(executor.Timeout / time.Second)
+	output, err := clients.SSM.SendCommand(&ssm.SendCommandInput{
+		DocumentName: aws.String(SSMDocumentName),
+		InstanceIds:  []*string{aws.String(instance.InstanceID)},
+		Comment:      aws.String("btrz-aws-monitor remediation"),
+		Parameters: map[string][]*string{
+			"commands":         {aws.String(command)},
+			"executionTimeout": {aws.String(strconv.FormatInt(timeoutSeconds, 10))},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &CommandResult{
+		Executor:  ExecutorSSM,
+		Command:   command,
+		CommandID: aws.StringValue(output.Command.CommandId),
+		ExitCode:  -1,
+		Started:   started,
+	}
+	deadline := started.Add(executor.Timeout)
+	for {
+		executor.Clock.Sleep(executor.PollInterval)
+		invocation, err := clients.SSM.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(result.CommandID),
+			InstanceId: aws.String(instance.InstanceID),
+		})
+		if err != nil {
+			if awsError, ok := err.(awserr.Error); !ok || awsError.Code() != ssm.ErrCodeInvocationDoesNotExist {
+				return executor.finish(result, CommandStatusFailed, err)
+			}
+		} else if done, err := executor.readInvocation(result, invocation); done {
+			return result, err
+		}
+		if !executor.Clock.Now().Before(deadline) {
+			return executor.finish(result, CommandStatusTimedOut,
+				fmt.Errorf("ssm command %s didn't complete in %v", result.CommandID, executor.Timeout))
+		}
+	}
+}
+
+// readInvocation - copy the invocation outcome into the result, returns true once the command completed
+func (executor *SSMExecutor) readInvocation(result *CommandResult, invocation *ssm.GetCommandInvocationOutput) (bool, error) {
+	status := aws.StringValue(invocation.Status)
+	switch status {
+	case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress,
+		ssm.CommandInvocationStatusDelayed, ssm.CommandInvocationStatusCancelling:
+		return false, nil
+	}
+	result.ExitCode = int(aws.Int64Value(invocation.ResponseCode))
+	result.Output = limitCommandOutput(aws.StringValue(invocation.StandardOutputContent))
+	result.Stderr = limitCommandOutput(aws.StringValue(invocation.StandardErrorContent))
+	if status == ssm.CommandInvocationStatusSuccess {
+		_, err := executor.finish(result, CommandStatusSuccess, nil)
+		return true, err
+	}
+	_, err := executor.finish(result, CommandStatusFailed,
+		fmt.Errorf("ssm command %s %s, exit code %d", result.CommandID, aws.StringValue(invocation.StatusDetails), result.ExitCode))
+	return true, err
+}
+
+func (executor *SSMExecutor) finish(result *CommandResult, status string, err error) (*CommandResult, error) {
+	result.Status = status
+	result.Finished = executor.Clock.Now()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// limitCommandOutput - the end of the output, at most MaxCommandOutputSize bytes
+func limitCommandOutput(output string) string {
+	if len(output) <= MaxCommandOutputSize {
+		return output
+	}
+	return output[len(output)-MaxCommandOutputSize:]
+}
@@ -7,9 +7,20 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 )
 
+// DefaultRegion - region of the notifications and of instances without a region
+const DefaultRegion = "us-east-1"
+
 // GetAWSSession -  creates an aws session
 func GetAWSSession() (*session.Session, error) {
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	return GetAWSSessionForRegion(DefaultRegion)
+}
+
+// GetAWSSessionForRegion - creates an aws session for the region
+func GetAWSSessionForRegion(region string) (*session.Session, error) {
+	if region == "" {
+		region = DefaultRegion
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
 	if err != nil {
 		return nil, err
 	}
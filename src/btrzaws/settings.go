@@ -0,0 +1,98 @@
+package btrzaws
+
+import (
+	"os"
+	"sshconnector"
+	"sync"
+)
+
+// NotificationSettings - where failure notifications are sent
+type NotificationSettings struct {
+	PhoneNumber      string
+	FirebaseAuthCode string
+}
+
+var (
+	settingsLock         sync.RWMutex
+	notificationSettings *NotificationSettings
+	keysLocation         *string
+	knownHosts           *sshconnector.KnownHosts
+	sshSettings          SSHSettings
+)
+
+// SSHSettings - how the remediation ssh connections are made
+type SSHSettings struct {
+	// Bastions - jump hosts, selected by instance tag or vpc
+	Bastions []*SSHBastion
+	// UseAgent - authenticate on the instances with the ssh agent keys, the .pem file is optional
+	UseAgent bool
+	// ForwardAgent - make the ssh agent available to the remediation commands
+	ForwardAgent bool
+}
+
+// SetNotificationSettings - use these settings instead of PHONE_NUMBER and FIREBASE_AUTHCODE
+func SetNotificationSettings(settings NotificationSettings) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	notificationSettings = &settings
+}
+
+// GetNotificationSettings - the configured settings, or the environment values
+func GetNotificationSettings() NotificationSettings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	if notificationSettings != nil {
+		return *notificationSettings
+	}
+	return NotificationSettings{
+		PhoneNumber:      os.Getenv("PHONE_NUMBER"),
+		FirebaseAuthCode: os.Getenv("FIREBASE_AUTHCODE"),
+	}
+}
+
+// SetKeysPath - use this location instead of SSH_KEYS_LOCATION
+func SetKeysPath(location string) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	keysLocation = &location
+}
+
+func getKeysLocation() string {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	if keysLocation != nil {
+		return *keysLocation
+	}
+	return os.Getenv("SSH_KEYS_LOCATION")
+}
+
+// SetKnownHosts - verify the instances host keys with these known hosts
+func SetKnownHosts(hosts *sshconnector.KnownHosts) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	knownHosts = hosts
+}
+
+// getKnownHosts - the configured known hosts, strict in memory ones when not set
+func getKnownHosts() *sshconnector.KnownHosts {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	if knownHosts == nil {
+		knownHosts, _ = sshconnector.LoadKnownHosts("", false)
+	}
+	return knownHosts
+}
+
+// SetSSHSettings - use these bastions and agent settings for the ssh connections
+func SetSSHSettings(settings SSHSettings) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	sshSettings = settings
+}
+
+// GetSSHSettings - the ssh connections settings
+func GetSSHSettings() SSHSettings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return sshSettings
+}
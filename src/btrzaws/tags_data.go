@@ -25,6 +25,9 @@ func NewWithValues(name, value string) *AwsTag {
 // GetTagValue - get tag value
 func GetTagValue(instance *ec2.Instance, tagName string) string {
 	var instanceName string
+	if instance == nil {
+		return instanceName
+	}
 	for _, tag := range instance.Tags {
 		if *tag.Key == tagName {
 			instanceName = *tag.Value
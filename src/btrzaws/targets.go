@@ -0,0 +1,79 @@
+package btrzaws
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// MonitoringTarget - an account region the monitor discovers, checks and remediates instances in
+type MonitoringTarget struct {
+	Account string
+	Region  string
+	Session *session.Session
+	// Clients - discovery and remediation calls go through them
+	Clients *AWSClients
+}
+
+// CreateMonitoringTarget - create the target with a session for the account and region.
+// accounts with a role get their credentials from the sts client
+func CreateMonitoringTarget(account *AccountProfile, region string, stsClient stscreds.AssumeRoler) (*MonitoringTarget, error) {
+	if region == "" {
+		region = DefaultRegion
+	}
+	config := &aws.Config{Region: aws.String(region)}
+	if account.RoleARN != "" {
+		if stsClient == nil {
+			return nil, errors.New("an sts client is required to assume " + account.RoleARN)
+		}
+		config.Credentials = account.AssumeRoleCredentials(stsClient)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return &MonitoringTarget{Account: account.Name, Region: region, Session: sess, Clients: NewAWSClients(sess)}, nil
+}
+
+// GetTargetKey - account/region, or the region alone for targets without an account
+func GetTargetKey(account, region string) string {
+	if account == "" {
+		return region
+	}
+	return account + "/" + region
+}
+
+// SetTarget - the instance was discovered in the target
+func (instance *BetterezInstance) SetTarget(target *MonitoringTarget) {
+	instance.Target = target
+	instance.Account = target.Account
+	instance.Region = target.Region
+}
+
+// getClients - clients of the instance account and region, for remediation calls
+func (instance *BetterezInstance) getClients() (*AWSClients, error) {
+	if instance.Target != nil && instance.Target.Clients != nil {
+		return instance.Target.Clients, nil
+	}
+	sess, err := GetAWSSessionForRegion(instance.Region)
+	if err != nil {
+		return nil, err
+	}
+	return NewAWSClients(sess), nil
+}
+
+// GetLocation - account/region of the instance, for notifications
+func (instance *BetterezInstance) GetLocation() string {
+	return GetTargetKey(instance.Account, instance.Region)
+}
+
+// GetQualifiedID - account/region/instance id, for logs and notifications
+func (instance *BetterezInstance) GetQualifiedID() string {
+	location := instance.GetLocation()
+	if location == "" {
+		return instance.InstanceID
+	}
+	return location + "/" + instance.InstanceID
+}
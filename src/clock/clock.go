@@ -0,0 +1,101 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock - the time source of the monitor timing logic
+type Clock interface {
+	Now() time.Time
+	Sleep(duration time.Duration)
+	After(duration time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+// Real - the system clock
+func Real() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(duration time.Duration) {
+	time.Sleep(duration)
+}
+
+func (realClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+// Fake - manually advanced clock, sleepers wake up when Advance passes their deadline
+type Fake struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+// NewFake - fake clock set to start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Now - the fake time
+func (clock *Fake) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+// Sleep - block until the clock is advanced by duration
+func (clock *Fake) Sleep(duration time.Duration) {
+	<-clock.After(duration)
+}
+
+// After - channel receiving the fake time once the clock is advanced by duration
+func (clock *Fake) After(duration time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	channel := make(chan time.Time, 1)
+	if duration <= 0 {
+		channel <- clock.now
+		return channel
+	}
+	clock.waiters = append(clock.waiters, &waiter{deadline: clock.now.Add(duration), channel: channel})
+	return channel
+}
+
+// Advance - move the clock forward and wake up the sleepers whose deadline passed, earliest first
+func (clock *Fake) Advance(duration time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(duration)
+	sort.Slice(clock.waiters, func(i, j int) bool {
+		return clock.waiters[i].deadline.Before(clock.waiters[j].deadline)
+	})
+	waiting := []*waiter{}
+	for _, sleeper := range clock.waiters {
+		if sleeper.deadline.After(clock.now) {
+			waiting = append(waiting, sleeper)
+			continue
+		}
+		sleeper.channel <- clock.now
+	}
+	clock.waiters = waiting
+}
+
+// Sleepers - number of pending Sleep and After calls
+func (clock *Fake) Sleepers() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.waiters)
+}
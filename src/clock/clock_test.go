@@ -0,0 +1,31 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+	late := clock.After(time.Minute)
+	early := clock.After(time.Second)
+	if clock.Sleepers() != 2 {
+		t.Fatal("expected two sleepers")
+	}
+	clock.Advance(30 * time.Second)
+	select {
+	case <-late:
+		t.Fatal("woke up too early")
+	case now := <-early:
+		if !now.Equal(start.Add(30 * time.Second)) {
+			t.Fatalf("bad wake up time %v", now)
+		}
+	}
+	clock.Advance(30 * time.Second)
+	<-late
+	if clock.Sleepers() != 0 || !clock.Now().Equal(start.Add(time.Minute)) {
+		t.Fatal("bad clock state")
+	}
+	<-clock.After(0)
+}
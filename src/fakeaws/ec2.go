@@ -0,0 +1,207 @@
+package fakeaws
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2 - fake ec2 client working on a fleet
+type EC2 struct {
+	fleet *Fleet
+}
+
+// settledStates - the state a transitional state moves to
+var settledStates = map[string]string{
+	ec2.InstanceStateNamePending:      ec2.InstanceStateNameRunning,
+	ec2.InstanceStateNameStopping:     ec2.InstanceStateNameStopped,
+	ec2.InstanceStateNameShuttingDown: ec2.InstanceStateNameTerminated,
+}
+
+// DescribeInstances - instances matching the ids and the instance-id, instance-state-name,
+// tag-key and tag:Name filters, one reservation per instance
+func (client *EC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	instanceIDs := aws.StringValueSlice(input.InstanceIds)
+	if len(instanceIDs) == 0 {
+		instanceIDs = fleet.sortedInstanceIDs()
+	}
+	output := &ec2.DescribeInstancesOutput{}
+	for _, instanceID := range instanceIDs {
+		instance, err := fleet.getInstance(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		matches, err := matchesFilters(instance, input.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if !matches {
+			continue
+		}
+		instanceCopy := *instance
+		instanceCopy.State = &ec2.InstanceState{Name: aws.String(aws.StringValue(instance.State.Name))}
+		output.Reservations = append(output.Reservations, &ec2.Reservation{Instances: []*ec2.Instance{&instanceCopy}})
+		if settledState, found := settledStates[aws.StringValue(instance.State.Name)]; found {
+			instance.State.Name = aws.String(settledState)
+		}
+	}
+	return output, nil
+}
+
+// StopInstances - running instances move to stopping
+func (client *EC2) StopInstances(input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	changes, err := client.changeStates("StopInstances", input.InstanceIds, ec2.InstanceStateNameStopping,
+		ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+// StartInstances - stopped instances move to pending
+func (client *EC2) StartInstances(input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	changes, err := client.changeStates("StartInstances", input.InstanceIds, ec2.InstanceStateNamePending,
+		ec2.InstanceStateNameStopped)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+// RebootInstances - running instances stay running
+func (client *EC2) RebootInstances(input *ec2.RebootInstancesInput) (*ec2.RebootInstancesOutput, error) {
+	if _, err := client.changeStates("RebootInstances", input.InstanceIds, ec2.InstanceStateNameRunning,
+		ec2.InstanceStateNameRunning); err != nil {
+		return nil, err
+	}
+	return &ec2.RebootInstancesOutput{}, nil
+}
+
+// TerminateInstances - instances move to shutting-down
+func (client *EC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	changes, err := client.changeStates("TerminateInstances", input.InstanceIds, ec2.InstanceStateNameShuttingDown,
+		ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+}
+
+// GetConsoleOutput - the base64 encoded console output set with SetConsoleOutput
+func (client *EC2) GetConsoleOutput(input *ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instanceID := aws.StringValue(input.InstanceId)
+	if err := fleet.record("GetConsoleOutput", instanceID); err != nil {
+		return nil, err
+	}
+	if _, err := fleet.getInstance(instanceID); err != nil {
+		return nil, err
+	}
+	return &ec2.GetConsoleOutputOutput{
+		InstanceId: input.InstanceId,
+		Output:     aws.String(base64.StdEncoding.EncodeToString([]byte(fleet.consoleOutputs[instanceID]))),
+	}, nil
+}
+
+// changeStates - move the instances to the new state, all of them must be in one of the allowed states
+func (client *EC2) changeStates(operation string, instanceIDs []*string, newState string,
+	allowedStates ...string) ([]*ec2.InstanceStateChange, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record(operation, aws.StringValueSlice(instanceIDs)...); err != nil {
+		return nil, err
+	}
+	instances := []*ec2.Instance{}
+	for _, instanceID := range aws.StringValueSlice(instanceIDs) {
+		instance, err := fleet.getInstance(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if !isOneOf(aws.StringValue(instance.State.Name), allowedStates) {
+			return nil, awserr.New("IncorrectInstanceState",
+				fmt.Sprintf("The instance '%s' is not in a state from which it can be %s", instanceID, newState), nil)
+		}
+		instances = append(instances, instance)
+	}
+	changes := []*ec2.InstanceStateChange{}
+	for _, instance := range instances {
+		changes = append(changes, &ec2.InstanceStateChange{
+			InstanceId:    instance.InstanceId,
+			PreviousState: &ec2.InstanceState{Name: aws.String(aws.StringValue(instance.State.Name))},
+			CurrentState:  &ec2.InstanceState{Name: aws.String(newState)},
+		})
+		instance.State.Name = aws.String(newState)
+		fleet.changeAddresses(instance, newState)
+	}
+	return changes, nil
+}
+
+// changeAddresses - a stopping instance releases its public ip, a starting one takes the next set one.
+// called with the lock held
+func (fleet *Fleet) changeAddresses(instance *ec2.Instance, newState string) {
+	instanceID := aws.StringValue(instance.InstanceId)
+	addresses, found := fleet.startAddresses[instanceID]
+	if !found {
+		return
+	}
+	switch newState {
+	case ec2.InstanceStateNameStopping:
+		instance.PublicIpAddress = nil
+	case ec2.InstanceStateNamePending:
+		if len(addresses) > 0 {
+			instance.PublicIpAddress = aws.String(addresses[0])
+			fleet.startAddresses[instanceID] = addresses[1:]
+		}
+	}
+}
+
+func matchesFilters(instance *ec2.Instance, filters []*ec2.Filter) (bool, error) {
+	for _, filter := range filters {
+		filterName := aws.StringValue(filter.Name)
+		values := aws.StringValueSlice(filter.Values)
+		var matches bool
+		switch {
+		case filterName == "instance-id":
+			matches = isOneOf(aws.StringValue(instance.InstanceId), values)
+		case filterName == "instance-state-name":
+			matches = isOneOf(aws.StringValue(instance.State.Name), values)
+		case filterName == "tag-key":
+			for _, tag := range instance.Tags {
+				matches = matches || isOneOf(aws.StringValue(tag.Key), values)
+			}
+		case strings.HasPrefix(filterName, "tag:"):
+			tagName := strings.TrimPrefix(filterName, "tag:")
+			for _, tag := range instance.Tags {
+				matches = matches || aws.StringValue(tag.Key) == tagName && isOneOf(aws.StringValue(tag.Value), values)
+			}
+		default:
+			return false, awserr.New("InvalidParameterValue", fmt.Sprintf("The filter '%s' is invalid", filterName), nil)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, candidate := range values {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
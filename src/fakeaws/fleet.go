@@ -0,0 +1,228 @@
+package fakeaws
+
+import (
+	"btrzaws"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Fleet - in memory aws account shared by the fake clients.
+// instances go through the ec2 states: stopping, pending and shutting-down
+// settle on the following describe call
+type Fleet struct {
+	lock           sync.Mutex
+	instances      map[string]*ec2.Instance
+	loadBalancers  map[string][]string
+	healthStatus   map[string]string
+	failures       map[string]error
+	calls          []string
+	messages       []Message
+	consoleOutputs map[string]string
+	// commandOutcomes, sentCommands - ssm commands by instance
+	commandOutcomes map[string]CommandOutcome
+	sentCommands    []*SentCommand
+	// desiredCapacities - auto scaling groups desired capacity, the count of their instances when missing
+	desiredCapacities map[string]int
+	// startAddresses - the public ips the next starts of an instance assign, in order
+	startAddresses map[string][]string
+}
+
+// Message - a text message published to sns
+type Message struct {
+	PhoneNumber string
+	Message     string
+}
+
+// NewFleet - an empty fleet
+func NewFleet() *Fleet {
+	return &Fleet{
+		instances:         make(map[string]*ec2.Instance),
+		loadBalancers:     make(map[string][]string),
+		healthStatus:      make(map[string]string),
+		failures:          make(map[string]error),
+		commandOutcomes:   make(map[string]CommandOutcome),
+		consoleOutputs:    make(map[string]string),
+		desiredCapacities: make(map[string]int),
+		startAddresses:    make(map[string][]string),
+	}
+}
+
+// AddInstance - add a running instance launched an hour ago. the tags are ec2 tags,
+// aws:autoscaling:groupName places the instance in an auto scaling group
+func (fleet *Fleet) AddInstance(instanceID, ipAddress string, tags map[string]string) *ec2.Instance {
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(instanceID),
+		PrivateIpAddress: aws.String(ipAddress),
+		LaunchTime:       aws.Time(time.Now().Add(-time.Hour)),
+		State:            &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+	}
+	for key, value := range tags {
+		instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	fleet.instances[instanceID] = instance
+	return instance
+}
+
+// SetPublicIPAddresses - the instance public ip, then the ones its next starts assign in turn.
+// like an instance without an elastic ip, a stop releases the public ip
+func (fleet *Fleet) SetPublicIPAddresses(instanceID string, ipAddresses ...string) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instance, found := fleet.instances[instanceID]
+	if !found || len(ipAddresses) == 0 {
+		return
+	}
+	instance.PublicIpAddress = aws.String(ipAddresses[0])
+	fleet.startAddresses[instanceID] = ipAddresses[1:]
+}
+
+// SetDesiredCapacity - the desired capacity reported for the auto scaling group
+func (fleet *Fleet) SetDesiredCapacity(groupName string, desiredCapacity int) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	fleet.desiredCapacities[groupName] = desiredCapacity
+}
+
+// AddLoadBalancer - a classic load balancer with registered instances
+func (fleet *Fleet) AddLoadBalancer(name string, instanceIDs ...string) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	fleet.loadBalancers[name] = instanceIDs
+}
+
+// GetState - the instance state name, empty for unknown instances
+func (fleet *Fleet) GetState(instanceID string) string {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instance, found := fleet.instances[instanceID]
+	if !found {
+		return ""
+	}
+	return aws.StringValue(instance.State.Name)
+}
+
+// SetState - force the instance state
+func (fleet *Fleet) SetState(instanceID, state string) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if instance, found := fleet.instances[instanceID]; found {
+		instance.State.Name = aws.String(state)
+	}
+}
+
+// GetHealthStatus - the health reported to auto scaling, empty when never set
+func (fleet *Fleet) GetHealthStatus(instanceID string) string {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	return fleet.healthStatus[instanceID]
+}
+
+// SetConsoleOutput - the instance console output, the boot messages printed by cloud-init
+func (fleet *Fleet) SetConsoleOutput(instanceID, output string) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	fleet.consoleOutputs[instanceID] = output
+}
+
+// FailOperation - make every call of the operation (StopInstances, Publish...) fail with err.
+// a nil err makes the operation succeed again
+func (fleet *Fleet) FailOperation(operation string, err error) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err == nil {
+		delete(fleet.failures, operation)
+		return
+	}
+	fleet.failures[operation] = err
+}
+
+// GetCalls - the recorded calls, "operation instance-id" for instance operations
+func (fleet *Fleet) GetCalls() []string {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	return append([]string{}, fleet.calls...)
+}
+
+// CountCalls - number of recorded calls of the operation
+func (fleet *Fleet) CountCalls(operation string) int {
+	count := 0
+	for _, call := range fleet.GetCalls() {
+		if call == operation || strings.HasPrefix(call, operation+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+// GetMessages - the published text messages
+func (fleet *Fleet) GetMessages() []Message {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	return append([]Message{}, fleet.messages...)
+}
+
+// Clients - fake clients working on the fleet
+func (fleet *Fleet) Clients() *btrzaws.AWSClients {
+	return &btrzaws.AWSClients{
+		EC2:         &EC2{fleet: fleet},
+		SNS:         &SNS{fleet: fleet},
+		ELB:         &ELB{fleet: fleet},
+		AutoScaling: &AutoScaling{fleet: fleet},
+		SSM:         &SSM{fleet: fleet},
+	}
+}
+
+// TargetFactory - every account region is served by the fleet
+func (fleet *Fleet) TargetFactory() btrzaws.TargetFactory {
+	return func(account *btrzaws.AccountProfile, region string) (*btrzaws.MonitoringTarget, error) {
+		return &btrzaws.MonitoringTarget{Account: account.Name, Region: region, Clients: fleet.Clients()}, nil
+	}
+}
+
+// record - record the call and return the configured failure, called with the lock held
+func (fleet *Fleet) record(operation string, instanceIDs ...string) error {
+	if len(instanceIDs) == 0 {
+		fleet.calls = append(fleet.calls, operation)
+	}
+	for _, instanceID := range instanceIDs {
+		fleet.calls = append(fleet.calls, operation+" "+instanceID)
+	}
+	return fleet.failures[operation]
+}
+
+// getInstance - the instance or an ec2 not found error, called with the lock held
+func (fleet *Fleet) getInstance(instanceID string) (*ec2.Instance, error) {
+	instance, found := fleet.instances[instanceID]
+	if !found {
+		return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", instanceID), nil)
+	}
+	return instance, nil
+}
+
+// sortedInstanceIDs - instance ids in a stable order, called with the lock held
+func (fleet *Fleet) sortedInstanceIDs() []string {
+	instanceIDs := []string{}
+	for instanceID := range fleet.instances {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	sort.Strings(instanceIDs)
+	return instanceIDs
+}
+
+func getTag(instance *ec2.Instance, tagName string) string {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == tagName {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package fakeaws
+
+import (
+	"btrzaws"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func describeState(t *testing.T, client btrzaws.EC2API, instanceID string) string {
+	output, err := client.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(instanceID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(output.Reservations[0].Instances[0].State.Name)
+}
+
+func TestStateTransitions(t *testing.T) {
+	fleet := NewFleet()
+	fleet.AddInstance("i-1", "10.0.0.1", nil)
+	client := fleet.Clients().EC2
+	instanceIDs := []*string{aws.String("i-1")}
+	if _, err := client.StartInstances(&ec2.StartInstancesInput{InstanceIds: instanceIDs}); err == nil {
+		t.Fatal("running instances can't be started")
+	}
+	if _, err := client.StopInstances(&ec2.StopInstancesInput{InstanceIds: instanceIDs}); err != nil {
+		t.Fatal(err)
+	}
+	expectedStates := []string{"stopping", "stopped", "stopped"}
+	for _, expectedState := range expectedStates {
+		if state := describeState(t, client, "i-1"); state != expectedState {
+			t.Fatalf("expected %s, got %s", expectedState, state)
+		}
+	}
+	client.StartInstances(&ec2.StartInstancesInput{InstanceIds: instanceIDs})
+	if describeState(t, client, "i-1") != "pending" || describeState(t, client, "i-1") != "running" {
+		t.Fatal("started instance should go through pending to running")
+	}
+	if fleet.CountCalls("StopInstances") != 1 || fleet.CountCalls("DescribeInstances") != 5 {
+		t.Fatalf("bad calls %v", fleet.GetCalls())
+	}
+}
+
+func TestDescribeFiltersAndFailures(t *testing.T) {
+	fleet := NewFleet()
+	fleet.AddInstance("i-api", "10.0.0.1", map[string]string{"Environment": "production", "Repository": "btrz-api-sales"})
+	fleet.AddInstance("i-sandbox", "10.0.0.2", map[string]string{"Environment": "sandbox"})
+	fleet.SetState("i-sandbox", ec2.InstanceStateNameStopped)
+	tags := []*btrzaws.AwsTag{
+		{TagName: "tag:Environment", TagValues: []string{"production", "sandbox"}},
+		btrzaws.NewWithValues("instance-state-name", "running"),
+	}
+	reservations, err := btrzaws.DescribeInstancesWithTags(fleet.Clients().EC2, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 1 || aws.StringValue(reservations[0].Instances[0].InstanceId) != "i-api" {
+		t.Fatal("expected only the running instance")
+	}
+	fleet.FailOperation("DescribeInstances", errors.New("throttled"))
+	if _, err = btrzaws.DescribeInstancesWithTags(fleet.Clients().EC2, tags); err == nil {
+		t.Fatal("expected the injected failure")
+	}
+	fleet.FailOperation("DescribeInstances", nil)
+	if _, err = btrzaws.DescribeInstancesWithTags(fleet.Clients().EC2, []*btrzaws.AwsTag{btrzaws.NewWithValues("vpc-id", "x")}); err == nil {
+		t.Fatal("unknown filters should be rejected")
+	}
+}
+
+func TestAutoScalingHealth(t *testing.T) {
+	fleet := NewFleet()
+	fleet.AddInstance("i-1", "10.0.0.1", map[string]string{"aws:autoscaling:groupName": "api"})
+	fleet.AddInstance("i-2", "10.0.0.2", nil)
+	client := fleet.Clients().AutoScaling
+	_, err := client.SetInstanceHealth(&autoscaling.SetInstanceHealthInput{InstanceId: aws.String("i-2"), HealthStatus: aws.String("Unhealthy")})
+	if err == nil {
+		t.Fatal("instances outside groups have no auto scaling health")
+	}
+	client.SetInstanceHealth(&autoscaling.SetInstanceHealthInput{InstanceId: aws.String("i-1"), HealthStatus: aws.String("Unhealthy")})
+	if fleet.GetHealthStatus("i-1") != "Unhealthy" || fleet.GetState("i-1") != "shutting-down" {
+		t.Fatal("unhealthy instances should be terminated by the group")
+	}
+	output, err := client.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{})
+	if err != nil || len(output.AutoScalingGroups) != 1 || len(output.AutoScalingGroups[0].Instances) != 1 {
+		t.Fatal("expected the api group with its instance")
+	}
+}
@@ -0,0 +1,217 @@
+package fakeaws
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// autoScalingGroupTag - the tag aws sets on the instances of an auto scaling group
+const autoScalingGroupTag = "aws:autoscaling:groupName"
+
+// SNS - fake sns client, published messages are kept in the fleet
+type SNS struct {
+	fleet *Fleet
+}
+
+// SetSMSAttributes - record the call
+func (client *SNS) SetSMSAttributes(input *sns.SetSMSAttributesInput) (*sns.SetSMSAttributesOutput, error) {
+	client.fleet.lock.Lock()
+	defer client.fleet.lock.Unlock()
+	if err := client.fleet.record("SetSMSAttributes"); err != nil {
+		return nil, err
+	}
+	return &sns.SetSMSAttributesOutput{}, nil
+}
+
+// Publish - keep the message
+func (client *SNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	client.fleet.lock.Lock()
+	defer client.fleet.lock.Unlock()
+	if err := client.fleet.record("Publish"); err != nil {
+		return nil, err
+	}
+	client.fleet.messages = append(client.fleet.messages, Message{
+		PhoneNumber: aws.StringValue(input.PhoneNumber),
+		Message:     aws.StringValue(input.Message),
+	})
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("message-%d", len(client.fleet.messages)))}, nil
+}
+
+// ELB - fake classic load balancer client
+type ELB struct {
+	fleet *Fleet
+}
+
+// DescribeLoadBalancers - all the load balancers with their instances
+func (client *ELB) DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record("DescribeLoadBalancers"); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range fleet.loadBalancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output := &elb.DescribeLoadBalancersOutput{}
+	for _, name := range names {
+		description := &elb.LoadBalancerDescription{LoadBalancerName: aws.String(name)}
+		for _, instanceID := range fleet.loadBalancers[name] {
+			description.Instances = append(description.Instances, &elb.Instance{InstanceId: aws.String(instanceID)})
+		}
+		output.LoadBalancerDescriptions = append(output.LoadBalancerDescriptions, description)
+	}
+	return output, nil
+}
+
+// DescribeTags - the load balancers have no tags
+func (client *ELB) DescribeTags(input *elb.DescribeTagsInput) (*elb.DescribeTagsOutput, error) {
+	client.fleet.lock.Lock()
+	defer client.fleet.lock.Unlock()
+	if err := client.fleet.record("DescribeTags"); err != nil {
+		return nil, err
+	}
+	output := &elb.DescribeTagsOutput{}
+	for _, name := range input.LoadBalancerNames {
+		output.TagDescriptions = append(output.TagDescriptions, &elb.TagDescription{LoadBalancerName: name})
+	}
+	return output, nil
+}
+
+// DescribeInstanceHealth - running instances are InService, the others OutOfService
+func (client *ELB) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record("DescribeInstanceHealth"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(input.LoadBalancerName)
+	instanceIDs, found := fleet.loadBalancers[name]
+	if !found {
+		return nil, awserr.New("LoadBalancerNotFound", fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", name), nil)
+	}
+	output := &elb.DescribeInstanceHealthOutput{}
+	for _, instanceID := range instanceIDs {
+		state := "OutOfService"
+		if instance, found := fleet.instances[instanceID]; found &&
+			aws.StringValue(instance.State.Name) == ec2.InstanceStateNameRunning {
+			state = "InService"
+		}
+		output.InstanceStates = append(output.InstanceStates, &elb.InstanceState{
+			InstanceId: aws.String(instanceID),
+			State:      aws.String(state),
+		})
+	}
+	return output, nil
+}
+
+// AutoScaling - fake auto scaling client, groups come from the instances aws:autoscaling:groupName tag
+type AutoScaling struct {
+	fleet *Fleet
+}
+
+// DescribeAutoScalingGroups - the groups and their instances
+func (client *AutoScaling) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record("DescribeAutoScalingGroups"); err != nil {
+		return nil, err
+	}
+	groupNames := aws.StringValueSlice(input.AutoScalingGroupNames)
+	groups := map[string]*autoscaling.Group{}
+	output := &autoscaling.DescribeAutoScalingGroupsOutput{}
+	for _, instanceID := range fleet.sortedInstanceIDs() {
+		instance := fleet.instances[instanceID]
+		groupName := getTag(instance, autoScalingGroupTag)
+		if groupName == "" || (len(groupNames) > 0 && !isOneOf(groupName, groupNames)) {
+			continue
+		}
+		group, found := groups[groupName]
+		if !found {
+			group = &autoscaling.Group{AutoScalingGroupName: aws.String(groupName)}
+			groups[groupName] = group
+			output.AutoScalingGroups = append(output.AutoScalingGroups, group)
+		}
+		if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+			continue
+		}
+		lifecycleState := autoscaling.LifecycleStateInService
+		if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameRunning {
+			lifecycleState = autoscaling.LifecycleStateTerminating
+		}
+		group.Instances = append(group.Instances, &autoscaling.Instance{
+			InstanceId:     instance.InstanceId,
+			HealthStatus:   aws.String(fleet.getHealthStatus(instanceID)),
+			LifecycleState: aws.String(lifecycleState),
+		})
+		group.DesiredCapacity = aws.Int64(int64(len(group.Instances)))
+	}
+	for groupName, group := range groups {
+		if desiredCapacity, found := fleet.desiredCapacities[groupName]; found {
+			group.DesiredCapacity = aws.Int64(int64(desiredCapacity))
+		}
+	}
+	return output, nil
+}
+
+// DescribeAutoScalingInstances - the group of each instance, instances outside groups are left out
+func (client *AutoScaling) DescribeAutoScalingInstances(input *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	if err := fleet.record("DescribeAutoScalingInstances", aws.StringValueSlice(input.InstanceIds)...); err != nil {
+		return nil, err
+	}
+	output := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	for _, instanceID := range aws.StringValueSlice(input.InstanceIds) {
+		instance, found := fleet.instances[instanceID]
+		if !found || getTag(instance, autoScalingGroupTag) == "" {
+			continue
+		}
+		output.AutoScalingInstances = append(output.AutoScalingInstances, &autoscaling.InstanceDetails{
+			InstanceId:           instance.InstanceId,
+			AutoScalingGroupName: aws.String(getTag(instance, autoScalingGroupTag)),
+			HealthStatus:         aws.String(fleet.getHealthStatus(instanceID)),
+		})
+	}
+	return output, nil
+}
+
+// SetInstanceHealth - keep the health, like auto scaling an Unhealthy instance is terminated
+func (client *AutoScaling) SetInstanceHealth(input *autoscaling.SetInstanceHealthInput) (*autoscaling.SetInstanceHealthOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instanceID := aws.StringValue(input.InstanceId)
+	if err := fleet.record("SetInstanceHealth", instanceID); err != nil {
+		return nil, err
+	}
+	instance, found := fleet.instances[instanceID]
+	if !found || getTag(instance, autoScalingGroupTag) == "" {
+		return nil, awserr.New("ValidationError", fmt.Sprintf("Instance Id not found - %s", instanceID), nil)
+	}
+	fleet.healthStatus[instanceID] = aws.StringValue(input.HealthStatus)
+	if aws.StringValue(input.HealthStatus) == "Unhealthy" {
+		instance.State.Name = aws.String(ec2.InstanceStateNameShuttingDown)
+	}
+	return &autoscaling.SetInstanceHealthOutput{}, nil
+}
+
+// getHealthStatus - Healthy unless set otherwise, called with the lock held
+func (fleet *Fleet) getHealthStatus(instanceID string) string {
+	if status, found := fleet.healthStatus[instanceID]; found {
+		return status
+	}
+	return "Healthy"
+}
@@ -0,0 +1,112 @@
+package fakeaws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// CommandOutcome - how the commands sent to an instance complete
+type CommandOutcome struct {
+	Status   string
+	ExitCode int64
+	Output   string
+	Stderr   string
+}
+
+// SentCommand - a command sent with ssm
+type SentCommand struct {
+	CommandID  string
+	InstanceID string
+	Commands   []string
+	checks     int
+	outcome    CommandOutcome
+}
+
+// SSM - fake systems manager client. a command is in progress on the first invocation check
+// and completes with the instance outcome, Success by default, on the following ones
+type SSM struct {
+	fleet *Fleet
+}
+
+// SetCommandOutcome - the outcome of the commands sent to the instance from now on
+func (fleet *Fleet) SetCommandOutcome(instanceID string, outcome CommandOutcome) {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	fleet.commandOutcomes[instanceID] = outcome
+}
+
+// GetSentCommands - the commands sent with ssm
+func (fleet *Fleet) GetSentCommands() []SentCommand {
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	commands := []SentCommand{}
+	for _, command := range fleet.sentCommands {
+		commands = append(commands, *command)
+	}
+	return commands
+}
+
+// SendCommand - keep the command of every known instance
+func (client *SSM) SendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instanceIDs := aws.StringValueSlice(input.InstanceIds)
+	if err := fleet.record("SendCommand", instanceIDs...); err != nil {
+		return nil, err
+	}
+	commandID := fmt.Sprintf("command-%d", len(fleet.sentCommands)+1)
+	for _, instanceID := range instanceIDs {
+		if _, found := fleet.instances[instanceID]; !found {
+			return nil, awserr.New(ssm.ErrCodeInvalidInstanceId, fmt.Sprintf("Instances [[%s]] not in a valid state", instanceID), nil)
+		}
+	}
+	for _, instanceID := range instanceIDs {
+		outcome, found := fleet.commandOutcomes[instanceID]
+		if !found {
+			outcome = CommandOutcome{Status: ssm.CommandInvocationStatusSuccess}
+		}
+		fleet.sentCommands = append(fleet.sentCommands, &SentCommand{
+			CommandID:  commandID,
+			InstanceID: instanceID,
+			Commands:   aws.StringValueSlice(input.Parameters["commands"]),
+			outcome:    outcome,
+		})
+	}
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String(commandID)}}, nil
+}
+
+// GetCommandInvocation - InProgress on the first check, then the command outcome
+func (client *SSM) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	fleet := client.fleet
+	fleet.lock.Lock()
+	defer fleet.lock.Unlock()
+	instanceID := aws.StringValue(input.InstanceId)
+	if err := fleet.record("GetCommandInvocation", instanceID); err != nil {
+		return nil, err
+	}
+	for _, command := range fleet.sentCommands {
+		if command.CommandID != aws.StringValue(input.CommandId) || command.InstanceID != instanceID {
+			continue
+		}
+		command.checks++
+		output := &ssm.GetCommandInvocationOutput{
+			CommandId:    input.CommandId,
+			InstanceId:   input.InstanceId,
+			Status:       aws.String(ssm.CommandInvocationStatusInProgress),
+			ResponseCode: aws.Int64(-1),
+		}
+		if command.checks > 1 {
+			output.Status = aws.String(command.outcome.Status)
+			output.StatusDetails = aws.String(command.outcome.Status)
+			output.ResponseCode = aws.Int64(command.outcome.ExitCode)
+			output.StandardOutputContent = aws.String(command.outcome.Output)
+			output.StandardErrorContent = aws.String(command.outcome.Stderr)
+		}
+		return output, nil
+	}
+	return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "", nil)
+}
@@ -4,14 +4,36 @@ import (
 	"github.com/bsphere/le_go"
 	"log"
 	"os"
+	"sync"
 )
 
+var (
+	tokenLock sync.RWMutex
+	leToken   *string
+)
+
+// SetLogEntriesToken - use this token instead of LE_TOKEN, empty to log to stdout
+func SetLogEntriesToken(token string) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	leToken = &token
+}
+
+func getLogEntriesToken() string {
+	tokenLock.RLock()
+	defer tokenLock.RUnlock()
+	if leToken != nil {
+		return *leToken
+	}
+	return os.Getenv("LE_TOKEN")
+}
+
 // RecordLogLine - record line to le or stdout
 func RecordLogLine(line string) {
-	leToken := os.Getenv("LE_TOKEN")
+	leToken := getLogEntriesToken()
 	if leToken != "" {
 		le, _ := le_go.Connect(leToken)
-		le.Printf(line)
+		le.Println(line)
 	} else {
 		log.Println(line)
 	}
@@ -0,0 +1,230 @@
+package sshconnector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultSSHPort - port used when a hop has none
+const DefaultSSHPort = 22
+
+// Hop - an ssh server on the way to the target, or the target itself, with its own credentials
+type Hop struct {
+	Address string
+	Port    int
+	User    string
+	// KeyFile - private key file, skipped when empty
+	KeyFile string
+	// Password - password authentication, skipped when empty
+	Password string
+	// UseAgent - authenticate with the keys of the ssh agent
+	UseAgent        bool
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// Route - the target and the jump hosts to reach it, dialed in order
+type Route struct {
+	JumpHosts []Hop
+	Target    Hop
+	// ForwardAgent - make the ssh agent available to the commands run on the target
+	ForwardAgent bool
+	// AgentSocket - the ssh agent socket, SSH_AUTH_SOCK when empty
+	AgentSocket string
+	// Timeout - bound of every hop connection and ssh handshake, 5 seconds when 0
+	Timeout time.Duration
+}
+
+// Connection - ssh client of the route target, Close closes the jump hosts connections too
+type Connection struct {
+	Client       *ssh.Client
+	forwardAgent bool
+	closers      []io.Closer
+}
+
+// GetAddress - host:port of the hop
+func (hop Hop) GetAddress() string {
+	port := hop.Port
+	if port == 0 {
+		port = DefaultSSHPort
+	}
+	return net.JoinHostPort(hop.Address, fmt.Sprintf("%d", port))
+}
+
+// Dial - connect to the route target through its jump hosts
+func Dial(route Route) (*Connection, error) {
+	return DialContext(context.Background(), route)
+}
+
+// DialContext - connect to the route target through its jump hosts, every hop connection and handshake
+// is bounded by the route timeout and by the context
+func DialContext(ctx context.Context, route Route) (*Connection, error) {
+	connection := &Connection{forwardAgent: route.ForwardAgent}
+	var agentClient agent.ExtendedAgent
+	if route.ForwardAgent || route.usesAgent() {
+		socket := route.AgentSocket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if socket == "" {
+			return nil, errors.New("no ssh agent socket, SSH_AUTH_SOCK is not set")
+		}
+		agentConnection, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		connection.closers = append(connection.closers, agentConnection)
+		agentClient = agent.NewClient(agentConnection)
+	}
+	timeout := route.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	var client *ssh.Client
+	for _, hop := range append(append([]Hop{}, route.JumpHosts...), route.Target) {
+		config, err := hop.getClientConfig(agentClient)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		client, err = dialHop(ctx, client, hop.GetAddress(), config, timeout)
+		if err != nil {
+			connection.Close()
+			return nil, fmt.Errorf("%s: %v", hop.GetAddress(), err)
+		}
+		connection.closers = append(connection.closers, client)
+	}
+	connection.Client = client
+	if route.ForwardAgent {
+		if err := agent.ForwardToAgent(client, agentClient); err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	return connection, nil
+}
+
+// dialHop - open an ssh connection to the hop, tunneled through the jump host client when there's one
+func dialHop(ctx context.Context, jumpHost *ssh.Client, address string, config *ssh.ClientConfig,
+	timeout time.Duration) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var connection net.Conn
+	var err error
+	if jumpHost == nil {
+		dialer := net.Dialer{}
+		connection, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		connection, err = jumpHost.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handshake(ctx, connection, address, config)
+}
+
+// handshake - the ssh handshake on the connection, closed when the context is done first.
+// a server accepting connections without answering would hang it otherwise
+func handshake(ctx context.Context, connection net.Conn, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		// tunnels don't support deadlines, closing them is enough
+		connection.SetDeadline(deadline)
+	}
+	handshakeDone := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Close()
+			closed <- true
+		case <-handshakeDone:
+			closed <- false
+		}
+	}()
+	clientConnection, channels, requests, err := ssh.NewClientConn(connection, address, config)
+	close(handshakeDone)
+	if <-closed {
+		if err == nil {
+			clientConnection.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	connection.SetDeadline(time.Time{})
+	return ssh.NewClient(clientConnection, channels, requests), nil
+}
+
+func (route Route) usesAgent() bool {
+	for _, hop := range append(append([]Hop{}, route.JumpHosts...), route.Target) {
+		if hop.UseAgent {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientConfig - the hop authentication methods: agent, key file then password
+func (hop Hop) getClientConfig(agentClient agent.ExtendedAgent) (*ssh.ClientConfig, error) {
+	if hop.HostKeyCallback == nil {
+		return nil, fmt.Errorf("no host key callback for %s", hop.Address)
+	}
+	auth := []ssh.AuthMethod{}
+	if hop.UseAgent && agentClient != nil {
+		auth = append(auth, ssh.PublicKeysCallback(agentClient.Signers))
+	}
+	if hop.KeyFile != "" {
+		publicKey, err := PublicKeyFile(hop.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, publicKey)
+	}
+	if hop.Password != "" {
+		auth = append(auth, ssh.Password(hop.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no credentials for %s", hop.Address)
+	}
+	return &ssh.ClientConfig{
+		User:            hop.User,
+		Auth:            auth,
+		HostKeyCallback: hop.HostKeyCallback,
+	}, nil
+}
+
+// NewSession - a session on the target, with agent forwarding when the route asked for it
+func (connection *Connection) NewSession() (*ssh.Session, error) {
+	session, err := connection.Client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if connection.forwardAgent {
+		if err = agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Close - close the target, jump hosts and agent connections, last opened first
+func (connection *Connection) Close() error {
+	var firstError error
+	for index := len(connection.closers) - 1; index >= 0; index-- {
+		if err := connection.closers[index].Close(); err != nil && firstError == nil {
+			firstError = err
+		}
+	}
+	connection.closers = nil
+	return firstError
+}
@@ -0,0 +1,120 @@
+package sshconnector
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent - an ssh agent holding a new key, served on a unix socket
+func startTestAgent(t *testing.T) (string, ssh.PublicKey, func()) {
+	directory, err := ioutil.TempDir("", "ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(directory, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, connection)
+		}
+	}()
+	return socket, signer.PublicKey(), func() {
+		listener.Close()
+		os.RemoveAll(directory)
+	}
+}
+
+func TestDialThroughJumpHosts(t *testing.T) {
+	socket, agentKey, stopAgent := startTestAgent(t)
+	defer stopAgent()
+	target := startTestServer(t, "", agentKey)
+	defer target.Close()
+	innerBastion := startTestServer(t, "", agentKey)
+	defer innerBastion.Close()
+	outerBastion := startTestServer(t, "jump-secret", nil)
+	defer outerBastion.Close()
+
+	outerHop := outerBastion.Hop("jump")
+	outerHop.Password = "jump-secret"
+	innerHop := innerBastion.Hop("ubuntu")
+	innerHop.UseAgent = true
+	targetHop := target.Hop("ubuntu")
+	targetHop.UseAgent = true
+	connection, err := Dial(Route{
+		JumpHosts:    []Hop{outerHop, innerHop},
+		Target:       targetHop,
+		ForwardAgent: true,
+		AgentSocket:  socket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	session, err := connection.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Output("echo restarted")
+	if err != nil || string(output) != "restarted\n" {
+		t.Fatalf("bad output %q, %v", output, err)
+	}
+	outerTunnels, innerTunnels := outerBastion.getTunnels(), innerBastion.getTunnels()
+	if len(outerTunnels) != 1 || outerTunnels[0] != innerHop.GetAddress() ||
+		len(innerTunnels) != 1 || innerTunnels[0] != targetHop.GetAddress() {
+		t.Fatalf("expected a tunnel through each bastion, got %v %v", outerTunnels, innerTunnels)
+	}
+	if target.getAgentRequests() != 1 {
+		t.Fatal("expected the agent to be forwarded to the target")
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	bastion := startTestServer(t, "jump-secret", nil)
+	defer bastion.Close()
+	target := startTestServer(t, "target-secret", nil)
+	defer target.Close()
+	bastionHop := bastion.Hop("jump")
+	bastionHop.Password = "wrong"
+	targetHop := target.Hop("ubuntu")
+	targetHop.Password = "target-secret"
+	if _, err := Dial(Route{JumpHosts: []Hop{bastionHop}, Target: targetHop}); err == nil {
+		t.Fatal("the bastion credentials should be checked")
+	}
+	bastionHop.Password = "jump-secret"
+	targetHop.HostKeyCallback = bastion.Hop("ubuntu").HostKeyCallback
+	if _, err := Dial(Route{JumpHosts: []Hop{bastionHop}, Target: targetHop}); err == nil {
+		t.Fatal("the target host key should be verified")
+	}
+	targetHop = target.Hop("ubuntu")
+	targetHop.UseAgent = true
+	if _, err := Dial(Route{Target: targetHop, AgentSocket: filepath.Join(os.TempDir(), "no-agent.sock")}); err == nil {
+		t.Fatal("a missing agent should fail")
+	}
+}
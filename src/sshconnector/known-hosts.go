@@ -0,0 +1,202 @@
+package sshconnector
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	consoleFingerprintsStart = "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+	consoleFingerprintsEnd   = "-----END SSH HOST KEY FINGERPRINTS-----"
+	consoleKeysStart         = "-----BEGIN SSH HOST KEY KEYS-----"
+	consoleKeysEnd           = "-----END SSH HOST KEY KEYS-----"
+)
+
+// HostKeyMismatchError - the host presented a key other than the known ones
+type HostKeyMismatchError struct {
+	HostID string
+	// Expected - fingerprints of the known keys
+	Expected []string
+	// Received - fingerprint of the presented key
+	Received string
+}
+
+func (err *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: got %s, expected %s",
+		err.HostID, err.Received, strings.Join(err.Expected, " or "))
+}
+
+// UnknownHostKeyError - the host has no known key and trust on first use is off
+type UnknownHostKeyError struct {
+	HostID   string
+	Received string
+}
+
+func (err *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key %s for %s", err.Received, err.HostID)
+}
+
+// KnownHosts - host keys by host id, an instance id for the monitor, kept in a known_hosts file.
+// the hosts patterns of the file are the host ids, not addresses, since instance addresses change
+type KnownHosts struct {
+	lock sync.Mutex
+	// path - the known_hosts file, keys are kept in memory only when empty
+	path string
+	// trustOnFirstUse - accept and record the key of hosts without a known key or fingerprint
+	trustOnFirstUse bool
+	keys            map[string][]ssh.PublicKey
+	// fingerprints - trusted sha256 fingerprints, from the console output, of hosts without known keys
+	fingerprints map[string][]string
+}
+
+// LoadKnownHosts - read the known_hosts file, a missing file is an empty one
+func LoadKnownHosts(path string, trustOnFirstUse bool) (*KnownHosts, error) {
+	hosts := &KnownHosts{
+		path:            path,
+		trustOnFirstUse: trustOnFirstUse,
+		keys:            make(map[string][]ssh.PublicKey),
+		fingerprints:    make(map[string][]string),
+	}
+	if path == "" {
+		return hosts, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		var hostIDs []string
+		var key ssh.PublicKey
+		_, hostIDs, key, _, data, err = ssh.ParseKnownHosts(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, hostID := range hostIDs {
+			hosts.keys[hostID] = append(hosts.keys[hostID], key)
+		}
+	}
+	return hosts, nil
+}
+
+// IsKnown - true when the host has known keys or trusted fingerprints
+func (hosts *KnownHosts) IsKnown(hostID string) bool {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+	return len(hosts.keys[hostID]) > 0 || len(hosts.fingerprints[hostID]) > 0
+}
+
+// AddKey - record the host key, in the known_hosts file when there's one
+func (hosts *KnownHosts) AddKey(hostID string, key ssh.PublicKey) error {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+	return hosts.addKey(hostID, key)
+}
+
+// addKey - called with the lock held
+func (hosts *KnownHosts) addKey(hostID string, key ssh.PublicKey) error {
+	for _, knownKey := range hosts.keys[hostID] {
+		if bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	if hosts.path != "" {
+		file, err := os.OpenFile(hosts.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err = fmt.Fprintln(file, knownhosts.Line([]string{hostID}, key)); err != nil {
+			return err
+		}
+	}
+	hosts.keys[hostID] = append(hosts.keys[hostID], key)
+	return nil
+}
+
+// AddFingerprints - trust keys with these sha256 fingerprints for a host without known keys
+func (hosts *KnownHosts) AddFingerprints(hostID string, fingerprints []string) {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+	hosts.fingerprints[hostID] = append(hosts.fingerprints[hostID], fingerprints...)
+}
+
+// HostKeyCallback - verify the key presented by the host. a key matching a trusted fingerprint,
+// or any key with trust on first use, is recorded
+func (hosts *KnownHosts) HostKeyCallback(hostID string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hosts.lock.Lock()
+		defer hosts.lock.Unlock()
+		received := ssh.FingerprintSHA256(key)
+		if knownKeys := hosts.keys[hostID]; len(knownKeys) > 0 {
+			expected := []string{}
+			for _, knownKey := range knownKeys {
+				if bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+					return nil
+				}
+				expected = append(expected, ssh.FingerprintSHA256(knownKey))
+			}
+			return &HostKeyMismatchError{HostID: hostID, Expected: expected, Received: received}
+		}
+		if fingerprints := hosts.fingerprints[hostID]; len(fingerprints) > 0 {
+			for _, fingerprint := range fingerprints {
+				if fingerprint == received {
+					return hosts.addKey(hostID, key)
+				}
+			}
+			return &HostKeyMismatchError{HostID: hostID, Expected: fingerprints, Received: received}
+		}
+		if hosts.trustOnFirstUse {
+			return hosts.addKey(hostID, key)
+		}
+		return &UnknownHostKeyError{HostID: hostID, Received: received}
+	}
+}
+
+// ParseConsoleHostKeys - the host keys and sha256 fingerprints cloud-init prints to the console at boot
+func ParseConsoleHostKeys(output string) ([]ssh.PublicKey, []string) {
+	keys := []ssh.PublicKey{}
+	fingerprints := []string{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// console lines may be prefixed with the cloud-init logger name
+		if index := strings.Index(line, "-----"); index > 0 {
+			line = line[index:]
+		}
+		switch line {
+		case consoleFingerprintsStart, consoleKeysStart:
+			section = line
+			continue
+		case consoleFingerprintsEnd, consoleKeysEnd:
+			section = ""
+			continue
+		}
+		switch section {
+		case consoleKeysStart:
+			if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+				keys = append(keys, key)
+			}
+		case consoleFingerprintsStart:
+			// 256 SHA256:fingerprint root@host (ED25519)
+			for _, field := range strings.Fields(line) {
+				if strings.HasPrefix(field, "SHA256:") {
+					fingerprints = append(fingerprints, field)
+				}
+			}
+		}
+	}
+	return keys, fingerprints
+}
@@ -0,0 +1,102 @@
+package sshconnector
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHosts(t *testing.T) {
+	directory, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "known_hosts")
+	hostKey := generateHostKey(t)
+	impostorKey := generateHostKey(t)
+
+	strict, err := LoadKnownHosts(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := strict.HostKeyCallback("i-api")("10.0.0.1:22", nil, hostKey).(*UnknownHostKeyError); !ok {
+		t.Fatal("unknown hosts should be refused without trust on first use")
+	}
+	trusting, err := LoadKnownHosts(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trusting.HostKeyCallback("i-api")("10.0.0.1:22", nil, hostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadKnownHosts(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reloaded.HostKeyCallback("i-api")("10.0.0.2:22", nil, hostKey); err != nil {
+		t.Fatalf("the recorded key should be accepted on a new address, %v", err)
+	}
+	err = reloaded.HostKeyCallback("i-api")("10.0.0.1:22", nil, impostorKey)
+	mismatch, ok := err.(*HostKeyMismatchError)
+	if !ok || mismatch.Received != ssh.FingerprintSHA256(impostorKey) || mismatch.Expected[0] != ssh.FingerprintSHA256(hostKey) {
+		t.Fatalf("expected a host key mismatch, got %v", err)
+	}
+}
+
+func TestConsoleHostKeys(t *testing.T) {
+	hostKey := generateHostKey(t)
+	otherKey := generateHostKey(t)
+	output := fmt.Sprintf(`[   12.345678] cloud-init[1024]: Cloud-init v. 20.1 running 'modules:final'
+ec2: #############################################################
+ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----
+ec2: 256 %s root@ip-10-0-0-1 (ED25519)
+ec2: -----END SSH HOST KEY FINGERPRINTS-----
+ec2: #############################################################
+-----BEGIN SSH HOST KEY KEYS-----
+%s root@ip-10-0-0-1
+-----END SSH HOST KEY KEYS-----
+`, ssh.FingerprintSHA256(hostKey), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherKey))))
+	keys, fingerprints := ParseConsoleHostKeys(output)
+	if len(fingerprints) != 1 || fingerprints[0] != ssh.FingerprintSHA256(hostKey) {
+		t.Fatalf("bad fingerprints %v", fingerprints)
+	}
+	if len(keys) != 1 || ssh.FingerprintSHA256(keys[0]) != ssh.FingerprintSHA256(otherKey) {
+		t.Fatalf("bad keys %v", keys)
+	}
+
+	hosts, err := LoadKnownHosts("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts.AddFingerprints("i-api", fingerprints)
+	if !hosts.IsKnown("i-api") {
+		t.Fatal("the host should be known from its fingerprints")
+	}
+	if _, ok := hosts.HostKeyCallback("i-api")("10.0.0.1:22", nil, generateHostKey(t)).(*HostKeyMismatchError); !ok {
+		t.Fatal("a key not matching the console fingerprints should be refused")
+	}
+	if err = hosts.HostKeyCallback("i-api")("10.0.0.1:22", nil, hostKey); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+package sshconnector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMaxOutputSize - the end of longer stdout and stderr outputs is kept
+const DefaultMaxOutputSize = 64 * 1024
+
+// RunResult - outcome of a command run on the route target
+type RunResult struct {
+	Command string
+	Stdout  string
+	Stderr  string
+	// ExitCode - -1 when the command didn't exit with a status: killed by a signal, timed out or disconnected
+	ExitCode int
+	// Signal - the signal that killed the command, if any
+	Signal   string `json:",omitempty"`
+	TimedOut bool
+	// Truncated - stdout or stderr was longer than the limit, its beginning was dropped
+	Truncated bool
+	Started   time.Time
+	Duration  time.Duration
+}
+
+// Runner - runs commands on the route target, the connection is opened on first use and kept for the next
+// commands until Close. safe for concurrent use, every command has its own session
+type Runner struct {
+	Route Route
+	// Terminal - request a pty, sudo may require one. stderr is then part of stdout
+	Terminal      bool
+	MaxOutputSize int
+	lock          sync.Mutex
+	connection    *Connection
+}
+
+// NewRunner - a runner keeping DefaultMaxOutputSize bytes of each output
+func NewRunner(route Route) *Runner {
+	return &Runner{Route: route, MaxOutputSize: DefaultMaxOutputSize}
+}
+
+// Run - run the command, killing it when the context is done.
+// the result is nil when the command couldn't be started, the error is nil only when it exited with 0
+func (runner *Runner) Run(ctx context.Context, command string) (*RunResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	connection, session, err := runner.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	if runner.Terminal {
+		if err = RequestTerminal(session); err != nil {
+			return nil, err
+		}
+	}
+	stdout := &tailBuffer{limit: runner.MaxOutputSize}
+	stderr := &tailBuffer{limit: runner.MaxOutputSize}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	result := &RunResult{Command: command, ExitCode: -1, Started: time.Now()}
+	if err = session.Start(command); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// a hanging server may never close the session, the whole connection is dropped
+		session.Signal(ssh.SIGKILL)
+		runner.dropConnection(connection)
+		<-done
+		result.TimedOut = true
+		err = fmt.Errorf("%s: %v", command, ctx.Err())
+	}
+	result.Duration = time.Since(result.Started)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	switch exitError := err.(type) {
+	case nil:
+		result.ExitCode = 0
+	case *ssh.ExitError:
+		result.ExitCode = exitError.ExitStatus()
+		result.Signal = exitError.Signal()
+		if result.Signal != "" {
+			result.ExitCode = -1
+		}
+	}
+	return result, err
+}
+
+// newSession - a session on the kept connection, dialed again when it's missing or broken
+func (runner *Runner) newSession(ctx context.Context) (*Connection, *ssh.Session, error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	if runner.connection != nil {
+		session, err := runner.connection.NewSession()
+		if err == nil {
+			return runner.connection, session, nil
+		}
+		runner.connection.Close()
+		runner.connection = nil
+	}
+	connection, err := DialContext(ctx, runner.Route)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := connection.NewSession()
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	runner.connection = connection
+	return connection, session, nil
+}
+
+// dropConnection - close the connection, the next command dials again
+func (runner *Runner) dropConnection(connection *Connection) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	connection.Close()
+	if runner.connection == connection {
+		runner.connection = nil
+	}
+}
+
+// Close - close the kept connection
+func (runner *Runner) Close() error {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	if runner.connection == nil {
+		return nil
+	}
+	err := runner.connection.Close()
+	runner.connection = nil
+	return err
+}
+
+// tailBuffer - keeps the last limit bytes written
+type tailBuffer struct {
+	lock      sync.Mutex
+	limit     int
+	data      []byte
+	truncated bool
+}
+
+func (buffer *tailBuffer) Write(data []byte) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	buffer.data = append(buffer.data, data...)
+	if buffer.limit > 0 && len(buffer.data) > buffer.limit {
+		buffer.data = append([]byte{}, buffer.data[len(buffer.data)-buffer.limit:]...)
+		buffer.truncated = true
+	}
+	return len(data), nil
+}
+
+func (buffer *tailBuffer) String() string {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	return string(buffer.data)
+}
@@ -0,0 +1,123 @@
+package sshconnector
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunner(t *testing.T) {
+	server := startTestServer(t, "secret", nil)
+	defer server.Close()
+	hop := server.Hop("ubuntu")
+	hop.Password = "secret"
+	runner := NewRunner(Route{Target: hop})
+	runner.MaxOutputSize = 10
+	defer runner.Close()
+	cases := []struct {
+		command   string
+		stdout    string
+		stderr    string
+		exitCode  int
+		truncated bool
+	}{
+		{"echo restarted", "restarted\n", "", 0, false},
+		{"fail missing", "", "missing\n", 1, false},
+		{"exit 3", "", "", 3, false},
+		{"repeat 25 x", strings.Repeat("x", 10), "", 0, true},
+	}
+	for _, testCase := range cases {
+		result, err := runner.Run(context.Background(), testCase.command)
+		if result == nil {
+			t.Fatalf("%s: no result, %v", testCase.command, err)
+		}
+		if (err == nil) != (testCase.exitCode == 0) {
+			t.Errorf("%s: unexpected error %v", testCase.command, err)
+		}
+		if result.Stdout != testCase.stdout || result.Stderr != testCase.stderr ||
+			result.ExitCode != testCase.exitCode || result.Truncated != testCase.truncated || result.TimedOut {
+			t.Errorf("%s: bad result %+v", testCase.command, result)
+		}
+	}
+	if server.getConnections() != 1 || len(server.getCommands()) != len(cases) {
+		t.Fatalf("expected the commands to share a connection, got %d connections", server.getConnections())
+	}
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	server := startTestServer(t, "secret", nil)
+	defer server.Close()
+	hop := server.Hop("ubuntu")
+	hop.Password = "secret"
+	runner := NewRunner(Route{Target: hop})
+	defer runner.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := runner.Run(ctx, "sleep 2s")
+	if err == nil || result == nil || !result.TimedOut || result.ExitCode != -1 || result.Duration >= time.Second {
+		t.Fatalf("expected the command to time out, got %+v, %v", result, err)
+	}
+	if _, err = runner.Run(ctx, "echo late"); err == nil {
+		t.Fatal("a done context should not run commands")
+	}
+	result, err = runner.Run(context.Background(), "echo again")
+	if err != nil || result.Stdout != "again\n" {
+		t.Fatalf("expected a new connection after the timeout, got %+v, %v", result, err)
+	}
+	if server.getConnections() != 2 {
+		t.Fatalf("expected the timed out connection to be replaced, got %d connections", server.getConnections())
+	}
+	hop.Password = "wrong"
+	if result, err = NewRunner(Route{Target: hop}).Run(context.Background(), "echo denied"); err == nil || result != nil {
+		t.Fatal("a failed connection should not have a result")
+	}
+}
+
+func TestRunnerStalledHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accepts the connections without ever answering the handshake
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer connection.Close()
+		}
+	}()
+	bastion := startTestServer(t, "jump-secret", nil)
+	defer bastion.Close()
+	bastionHop := bastion.Hop("jump")
+	bastionHop.Password = "jump-secret"
+	address, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	stalledHop := Hop{Address: address, Port: portNumber, User: "ubuntu", Password: "secret",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	routes := map[string]Route{
+		"direct":        {Target: stalledHop, Timeout: time.Minute},
+		"through a hop": {JumpHosts: []Hop{bastionHop}, Target: stalledHop, Timeout: time.Minute},
+	}
+	for name, route := range routes {
+		runner := NewRunner(route)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		started := time.Now()
+		result, err := runner.Run(ctx, "echo stalled")
+		cancel()
+		if err == nil || result != nil || time.Since(started) > time.Second {
+			t.Fatalf("%s: expected the handshake to stop at the deadline, got %+v, %v after %v",
+				name, result, err, time.Since(started))
+		}
+	}
+	if len(bastion.getTunnels()) != 1 {
+		t.Fatalf("expected a tunnel through the bastion, got %v", bastion.getTunnels())
+	}
+}
@@ -1,9 +1,7 @@
 package sshconnector
 
 import (
-	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"time"
 
@@ -31,47 +29,44 @@ func PublicKeyFile(file string) (ssh.AuthMethod, error) {
 	return ssh.PublicKeys(key), nil
 }
 
-//CreateSSHSession - return ssh session
-func CreateSSHSession(serverAddress, username, authenticationParam string, serverPort, mode int16) (*ssh.Session, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: username,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-	}
-	var auth []ssh.AuthMethod
+// CreateSSHSession - return ssh session, the server key is verified with hostKeyCallback.
+// the connection is only closed on errors, Runner closes its connections
+//
+// Deprecated: use Runner, it keeps the connection, closes it and bounds the commands with a context
+func CreateSSHSession(serverAddress, username, authenticationParam string, serverPort, mode int16, hostKeyCallback ssh.HostKeyCallback) (*ssh.Session, error) {
+	hop := Hop{Address: serverAddress, Port: int(serverPort), User: username, HostKeyCallback: hostKeyCallback}
 	if mode == UseKey {
 		if _, err := os.Stat(authenticationParam); os.IsNotExist(err) {
 			return nil, err
 		}
-		publicKey, err := PublicKeyFile(authenticationParam)
-		if err != nil {
-			return nil, err
-		}
-		auth = []ssh.AuthMethod{publicKey}
+		hop.KeyFile = authenticationParam
 	} else if mode == UsePassword {
-		auth = []ssh.AuthMethod{ssh.Password(authenticationParam)}
+		hop.Password = authenticationParam
 	}
-	sshConfig.Auth = auth
-	sshConfig.Timeout = time.Second * 5
-	connectionString := fmt.Sprintf("%s:%d", serverAddress, serverPort)
-	connection, err := ssh.Dial("tcp", connectionString, sshConfig)
+	connection, err := Dial(Route{Target: hop, Timeout: time.Second * 5})
 	if err != nil {
 		return nil, err
 	}
 	sshSession, err := connection.NewSession()
 	if err != nil {
+		connection.Close()
 		return nil, err
 	}
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // disable echoing
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
-	err = sshSession.RequestPty("xterm", 80, 40, modes)
+	err = RequestTerminal(sshSession)
 	if err != nil {
 		sshSession.Close()
+		connection.Close()
 		return nil, err
 	}
 	return sshSession, nil
 }
+
+// RequestTerminal - ask for a pty without echo, sudo may require one
+func RequestTerminal(session *ssh.Session) error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	return session.RequestPty("xterm", 80, 40, modes)
+}
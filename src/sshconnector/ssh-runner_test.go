@@ -3,15 +3,25 @@ package sshconnector
 import (
 	"bytes"
 	"testing"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	sshPort = 22
 )
 
+func trustAnyHost(t *testing.T, hostID string) ssh.HostKeyCallback {
+	hosts, err := LoadKnownHosts("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hosts.HostKeyCallback(hostID)
+}
+
 func TestConnection(t *testing.T) {
 	t.SkipNow()
-	_, err := CreateSSHSession("192.168.0.61", "tal", "123", 22, UsePassword)
+	_, err := CreateSSHSession("192.168.0.61", "tal", "123", 22, UsePassword, trustAnyHost(t, "192.168.0.61"))
 	if err != nil {
 		t.Fatal("err", err, "Connecting to host")
 	}
@@ -21,7 +31,7 @@ func TestCommands(t *testing.T) {
 	t.SkipNow()
 	serverAddress := "192.168.100.100"
 	serverKey := "../../secrets/sample-key.pem"
-	session, err := CreateSSHSession(serverAddress, "ubuntu", serverKey, 22, UseKey)
+	session, err := CreateSSHSession(serverAddress, "ubuntu", serverKey, 22, UseKey, trustAnyHost(t, serverAddress))
 	if err != nil {
 		t.Fatal("err", err, "Connecting to host")
 	}
@@ -36,7 +46,7 @@ func TestCommands(t *testing.T) {
 func TestAgentRegistration(t *testing.T) {
 	t.SkipNow()
 	agentAddress := "192.168.100.100"
-	session, err := CreateSSHSession(agentAddress, "tal", "123", sshPort, UsePassword)
+	session, err := CreateSSHSession(agentAddress, "tal", "123", sshPort, UsePassword, trustAnyHost(t, agentAddress))
 	if err != nil {
 		t.Fatal(err)
 	}
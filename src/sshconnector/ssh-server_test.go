@@ -0,0 +1,248 @@
+package sshconnector
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer - in process ssh server running fake commands and forwarding tunnels
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	HostKey  ssh.PublicKey
+	lock     sync.Mutex
+	// connections, commands, tunnels, agentRequests - what the clients asked for
+	connections   int
+	commands      []string
+	tunnels       []string
+	agentRequests int
+}
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestServer - a server accepting the password, or the authorized key, of any user
+func startTestServer(t *testing.T, password string, authorizedKey ssh.PublicKey) *testServer {
+	hostKey := generateSigner(t)
+	server := &testServer{HostKey: hostKey.PublicKey()}
+	server.config = &ssh.ServerConfig{
+		PasswordCallback: func(metadata ssh.ConnMetadata, received []byte) (*ssh.Permissions, error) {
+			if password != "" && string(received) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("bad password for %s", metadata.User())
+		},
+		PublicKeyCallback: func(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKey != nil && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized key for %s", metadata.User())
+		},
+	}
+	server.config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = listener
+	go server.serve()
+	return server
+}
+
+func (server *testServer) Close() {
+	server.listener.Close()
+}
+
+// Hop - a hop to the server, trusting its host key
+func (server *testServer) Hop(user string) Hop {
+	address, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	hostKey := server.HostKey
+	return Hop{
+		Address: address,
+		Port:    portNumber,
+		User:    user,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), hostKey.Marshal()) {
+				return fmt.Errorf("bad host key for %s", hostname)
+			}
+			return nil
+		},
+	}
+}
+
+func (server *testServer) getTunnels() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string{}, server.tunnels...)
+}
+
+func (server *testServer) getConnections() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.connections
+}
+
+func (server *testServer) getCommands() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string{}, server.commands...)
+}
+
+func (server *testServer) getAgentRequests() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.agentRequests
+}
+
+func (server *testServer) serve() {
+	for {
+		connection, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConnection(connection)
+	}
+}
+
+func (server *testServer) handleConnection(connection net.Conn) {
+	serverConnection, channels, requests, err := ssh.NewServerConn(connection, server.config)
+	if err != nil {
+		connection.Close()
+		return
+	}
+	defer serverConnection.Close()
+	server.lock.Lock()
+	server.connections++
+	server.lock.Unlock()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			go server.handleTunnel(newChannel)
+		case "session":
+			go server.handleSession(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, newChannel.ChannelType())
+		}
+	}
+}
+
+// handleTunnel - connect the channel to the requested address
+func (server *testServer) handleTunnel(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	address := net.JoinHostPort(payload.Host, fmt.Sprintf("%d", payload.Port))
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	server.lock.Lock()
+	server.tunnels = append(server.tunnels, address)
+	server.lock.Unlock()
+	go func() {
+		io.Copy(target, channel)
+		target.Close()
+	}()
+	io.Copy(channel, target)
+	channel.Close()
+}
+
+// handleSession - run the exec requests with runCommand
+func (server *testServer) handleSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		switch request.Type {
+		case "auth-agent-req@openssh.com":
+			server.lock.Lock()
+			server.agentRequests++
+			server.lock.Unlock()
+			request.Reply(true, nil)
+		case "pty-req":
+			request.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(request.Payload, &payload)
+			request.Reply(true, nil)
+			server.lock.Lock()
+			server.commands = append(server.commands, payload.Command)
+			server.lock.Unlock()
+			exitStatus := runCommand(payload.Command, channel)
+			status := make([]byte, 4)
+			binary.BigEndian.PutUint32(status, exitStatus)
+			channel.SendRequest("exit-status", false, status)
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// runCommand - fake commands: echo, exit with a status, write to stderr, repeat a character or sleep
+func runCommand(command string, channel ssh.Channel) uint32 {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return 0
+	}
+	switch fields[0] {
+	case "echo":
+		fmt.Fprintln(channel, strings.Join(fields[1:], " "))
+		return 0
+	case "fail":
+		fmt.Fprintln(channel.Stderr(), strings.Join(fields[1:], " "))
+		return 1
+	case "exit":
+		status, _ := strconv.Atoi(fields[1])
+		return uint32(status)
+	case "repeat":
+		count, _ := strconv.Atoi(fields[1])
+		fmt.Fprint(channel, strings.Repeat(fields[2], count))
+		return 0
+	case "sleep":
+		duration, _ := time.ParseDuration(fields[1])
+		time.Sleep(duration)
+		return 0
+	}
+	fmt.Fprintf(channel.Stderr(), "%s: command not found\n", fields[0])
+	return 127
+}